@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redawl/gitm/internal/socks5"
+)
+
+const usage = `Usage: gitm ca|certs <command> [flags]
+
+CA commands:
+  import [-password password] file   replace the gitm CA with the CA in file (pem with the private key, or PKCS #12)
+  rotate                             replace the gitm CA with a new one
+  export [-format der|pem|p12|mobileconfig] [-password password] [-out file]
+                                     write the gitm CA to file, or stdout
+  status                             show whether the CA or any issued certificate is about to expire
+
+Certificate commands:
+  list                               list the certificates issued by the CA
+  show key                           write the pem of the certificate stored under key
+  delete key...                      delete the certificates stored under each key
+  reissue key...                     reissue the certificates stored under each key
+  prune                              delete the certificates not issued by the current CA
+`
+
+// isCommand returns whether args (without the program name) are a command line command.
+// Anything else starts the ui, since launchers can pass arguments of their own, i.e. -psn_... on macOS.
+func isCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case "ca", "certs", "-h", "-help", "--help", "help":
+		return true
+	default:
+		return false
+	}
+}
+
+// runCommand runs the command line command in args, and returns the exit code.
+func runCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	var err error
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	case "ca":
+		err = runCACommand(args[1:], stdout)
+	case "certs":
+		err = runCertsCommand(args[1:], stdout)
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprint(stderr, usage)
+		return 2
+	} else if err != nil {
+		fmt.Fprintf(stderr, "gitm: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func runCACommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+
+	flags := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	password := flags.String("password", "", "password of the PKCS #12 file")
+	format := flags.String("format", socks5.CAFormatPEM, "format to export the CA as")
+	out := flags.String("out", "", "file to export the CA to")
+	if err := flags.Parse(args[1:]); err != nil {
+		return flag.ErrHelp
+	}
+
+	switch args[0] {
+	case "import":
+		if flags.NArg() != 1 {
+			return flag.ErrHelp
+		}
+		data, err := os.ReadFile(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("reading ca: %w", err)
+		}
+		if err := socks5.ImportCA(data, *password); err != nil {
+			return fmt.Errorf("importing ca: %w", err)
+		}
+		fmt.Fprintln(stdout, "CA imported. Make sure your devices trust it.")
+	case "rotate":
+		if err := socks5.RotateCA(); err != nil {
+			return fmt.Errorf("rotating ca: %w", err)
+		}
+		fmt.Fprintln(stdout, "CA rotated. Install the new CA on your devices.")
+	case "export":
+		if *format == socks5.CAFormatPKCS12 && *password == "" {
+			return errors.New("a password is required to export the CA as PKCS #12")
+		}
+		data, err := socks5.ExportCA(*format, *password)
+		if err != nil {
+			return fmt.Errorf("exporting ca: %w", err)
+		}
+		if *out == "" {
+			_, err = stdout.Write(data)
+		} else {
+			err = os.WriteFile(*out, data, 0o600)
+		}
+		if err != nil {
+			return fmt.Errorf("writing ca: %w", err)
+		}
+	case "status":
+		warnings, err := socks5.CheckExpiry()
+		if err != nil {
+			return fmt.Errorf("checking expiry: %w", err)
+		}
+		if len(warnings) == 0 {
+			fmt.Fprintln(stdout, "No certificates are about to expire")
+		}
+		for _, warning := range warnings {
+			fmt.Fprintln(stdout, warning)
+		}
+	default:
+		return flag.ErrHelp
+	}
+
+	return nil
+}
+
+func runCertsCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+
+	switch args[0] {
+	case "list":
+		certificates, err := socks5.ListCertificates()
+		if err != nil {
+			return fmt.Errorf("listing certificates: %w", err)
+		}
+		writer := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "KEY\tSANS\tEXPIRES\tKEY TYPE\tSTATUS")
+		for _, certificate := range certificates {
+			status := "ok"
+			if certificate.Error != "" {
+				status = "invalid: " + certificate.Error
+			} else if certificate.Expired() {
+				status = "expired"
+			} else if !certificate.IssuedByCA {
+				status = "old ca"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n",
+				certificate.Key,
+				strings.Join(certificate.SANs, ","),
+				certificate.NotAfter.Format(time.DateOnly),
+				certificate.KeyType,
+				status,
+			)
+		}
+		return writer.Flush()
+	case "show":
+		if len(args) != 2 {
+			return flag.ErrHelp
+		}
+		certificates, err := socks5.ListCertificates()
+		if err != nil {
+			return fmt.Errorf("listing certificates: %w", err)
+		}
+		for _, certificate := range certificates {
+			if certificate.Key == args[1] {
+				_, err := io.WriteString(stdout, certificate.PEM)
+				return err
+			}
+		}
+		return fmt.Errorf("no certificate stored under %s", args[1])
+	case "delete":
+		if len(args) < 2 {
+			return flag.ErrHelp
+		}
+		for _, key := range args[1:] {
+			if err := socks5.DeleteCertificate(key); err != nil {
+				return err
+			}
+		}
+	case "reissue":
+		if len(args) < 2 {
+			return flag.ErrHelp
+		}
+		for _, key := range args[1:] {
+			if err := socks5.ReissueCertificate(key); err != nil {
+				return err
+			}
+		}
+	case "prune":
+		pruned, err := socks5.PruneCertificates()
+		if err != nil {
+			return fmt.Errorf("pruning certificates: %w", err)
+		}
+		fmt.Fprintf(stdout, "Deleted %d certificates not issued by the current CA\n", pruned)
+	default:
+		return flag.ErrHelp
+	}
+
+	return nil
+}
@@ -5,6 +5,9 @@ go 1.23
 require (
 	fyne.io/fyne/v2 v2.7.4
 	github.com/mattn/go-sqlite3 v1.14.24
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
 
 require (
@@ -38,7 +41,6 @@ require (
 	github.com/stretchr/testify v1.11.1 // indirect
 	github.com/yuin/goldmark v1.7.8 // indirect
 	golang.org/x/image v0.24.0 // indirect
-	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -3,6 +3,8 @@ package internal
 import (
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"fyne.io/fyne/v2"
 )
@@ -11,22 +13,118 @@ type Config struct {
 	SocksListenURI  string
 	PACListenURI    string
 	EnablePACServer bool
+	// PACDirectHosts are the hosts, ips or cidrs the PAC file sends DIRECT, instead of through gitm.
+	PACDirectHosts []string
+	// PACProxyHosts are the only hosts, ips or cidrs the PAC file sends through gitm, when there is at least one.
+	PACProxyHosts []string
+	// PACProxyType is which of gitm's proxies the PAC file advertises, one of the PACProxy constants.
+	PACProxyType    string
 	Debug           bool
 	CustomDecodings []string
 	configDir       string
 	Theme           string
+	// SocksCredentials are the "username:password" pairs clients can authenticate with.
+	// Authentication is only required when there is at least one.
+	SocksCredentials []string
+	// HTTPProxyListenURI is where the explicit http proxy listens, when EnableHTTPProxy is set.
+	HTTPProxyListenURI string
+	EnableHTTPProxy    bool
+	// TransparentListenURI is where connections redirected by the firewall are accepted, when EnableTransparentProxy is set.
+	// Only supported on linux.
+	TransparentListenURI   string
+	EnableTransparentProxy bool
+	// UpstreamProxy is the proxy all outbound connections are made through (i.e. "http://proxy:3128", "socks5://proxy:1080").
+	// Outbound connections are made directly when it is empty.
+	UpstreamProxy         string
+	UpstreamProxyUsername string
+	UpstreamProxyPassword string
+	// UpstreamProxyBypass are the hosts, ips or cidrs that are connected to directly instead of through UpstreamProxy.
+	UpstreamProxyBypass []string
+	// VerifyUpstreamCerts is whether the certificates of the servers gitm connects to are verified.
+	// Connections that fail verification are flagged, unless the host is in RefuseUnverifiedHosts.
+	VerifyUpstreamCerts bool
+	// UpstreamCAFile is a pem bundle of CAs that are trusted for verifying servers, in addition to the system roots.
+	UpstreamCAFile string
+	// RefuseUnverifiedHosts are the hosts, ips or cidrs whose connections are refused when verification fails.
+	RefuseUnverifiedHosts []string
+	// ClientCertificates are the "host=file" pairs of client certificates presented to servers that ask for one.
+	// file is a pem file with the certificate chain and its private key.
+	// "=" separates them, since both ipv6 hosts and windows paths contain ":".
+	ClientCertificates []string
+	// KeyLogFile is where the secrets of intercepted tls sessions are written in NSS key log format, so
+	// tools like wireshark can decrypt them. Secrets aren't written when it is empty.
+	KeyLogFile string
+	// TLSInterceptHosts are the only hosts, ips or cidrs whose tls connections are intercepted, when there is at least one.
+	TLSInterceptHosts []string
+	// TLSPassthroughHosts are the hosts, ips or cidrs whose tls connections are never intercepted.
+	// Their traffic is passed through untouched, and only its metadata is recorded.
+	TLSPassthroughHosts []string
+	// TLSPinnedFailureThreshold is how many handshakes in a row a client has to fail for a host, i.e. because it pins
+	// the server's certificate, before the host is added to TLSPassthroughHosts. Hosts aren't added when it is 0.
+	TLSPinnedFailureThreshold int
 }
 
 const (
-	SocksListenURI     = "socksListenUri"
-	PACListenURI       = "pacListenUri"
-	EnablePACServer    = "enablePacServer"
-	EnableDebugLogging = "enableDebugLogging"
-	CustomDecodings    = "customDecodings"
-	ConfigDir          = "configDir"
-	Theme              = "customTheme"
+	SocksListenURI            = "socksListenUri"
+	PACListenURI              = "pacListenUri"
+	EnablePACServer           = "enablePacServer"
+	EnableDebugLogging        = "enableDebugLogging"
+	CustomDecodings           = "customDecodings"
+	ConfigDir                 = "configDir"
+	Theme                     = "customTheme"
+	SocksCredentials          = "socksCredentials"
+	HTTPProxyListenURI        = "httpProxyListenUri"
+	EnableHTTPProxy           = "enableHttpProxy"
+	TransparentListenURI      = "transparentListenUri"
+	EnableTransparentProxy    = "enableTransparentProxy"
+	UpstreamProxy             = "upstreamProxy"
+	UpstreamProxyUsername     = "upstreamProxyUsername"
+	UpstreamProxyPassword     = "upstreamProxyPassword"
+	UpstreamProxyBypass       = "upstreamProxyBypass"
+	VerifyUpstreamCerts       = "verifyUpstreamCerts"
+	UpstreamCAFile            = "upstreamCaFile"
+	RefuseUnverifiedHosts     = "refuseUnverifiedHosts"
+	ClientCertificates        = "clientCertificates"
+	KeyLogFile                = "keyLogFile"
+	PACDirectHosts            = "pacDirectHosts"
+	PACProxyHosts             = "pacProxyHosts"
+	PACProxyType              = "pacProxyType"
+	TLSInterceptHosts         = "tlsInterceptHosts"
+	TLSPassthroughHosts       = "tlsPassthroughHosts"
+	TLSPinnedFailureThreshold = "tlsPinnedFailureThreshold"
 )
 
+// The proxies the PAC file can advertise
+const (
+	// PACProxyAll advertises the http proxy when it is enabled, falling back to the socks5 proxy
+	PACProxyAll   = "all"
+	PACProxySocks = "socks5"
+	PACProxyHTTP  = "http"
+)
+
+// DefaultTLSPinnedFailureThreshold is the default TLSPinnedFailureThreshold
+const DefaultTLSPinnedFailureThreshold = 3
+
+// AddTLSPassthroughHost adds host to the TLSPassthroughHosts preference, if it isn't already there
+func AddTLSPassthroughHost(preferences fyne.Preferences, host string) {
+	hosts := preferences.StringList(TLSPassthroughHosts)
+	if slices.Contains(hosts, host) {
+		return
+	}
+
+	preferences.SetStringList(TLSPassthroughHosts, append(hosts, host))
+}
+
+// ClientCertificate joins host and file into an entry of the ClientCertificates preference
+func ClientCertificate(host string, file string) string {
+	return host + "=" + file
+}
+
+// SplitClientCertificate splits an entry of the ClientCertificates preference into its host and file
+func SplitClientCertificate(entry string) (string, string, bool) {
+	return strings.Cut(entry, "=")
+}
+
 func stringWithFallbackSave(prefs fyne.Preferences, key string, defaultValue string) string {
 	value := prefs.String(key)
 
@@ -59,13 +157,34 @@ func FromPreferences(preferences fyne.Preferences) Config {
 
 	userCfgDir = filepath.Join(userCfgDir, "gitm")
 	conf := Config{
-		SocksListenURI:  stringWithFallbackSave(preferences, SocksListenURI, "127.0.0.1:1080"),
-		PACListenURI:    stringWithFallbackSave(preferences, PACListenURI, "127.0.0.1:8080"),
-		EnablePACServer: boolWithFallbackSave(preferences, EnablePACServer, false),
-		Debug:           boolWithFallbackSave(preferences, EnableDebugLogging, false),
-		CustomDecodings: preferences.StringList(CustomDecodings),
-		configDir:       stringWithFallbackSave(preferences, ConfigDir, userCfgDir),
-		Theme:           stringWithFallbackSave(preferences, Theme, ""),
+		SocksListenURI:         stringWithFallbackSave(preferences, SocksListenURI, "127.0.0.1:1080"),
+		PACListenURI:           stringWithFallbackSave(preferences, PACListenURI, "127.0.0.1:8080"),
+		EnablePACServer:        boolWithFallbackSave(preferences, EnablePACServer, false),
+		Debug:                  boolWithFallbackSave(preferences, EnableDebugLogging, false),
+		CustomDecodings:        preferences.StringList(CustomDecodings),
+		configDir:              stringWithFallbackSave(preferences, ConfigDir, userCfgDir),
+		Theme:                  stringWithFallbackSave(preferences, Theme, ""),
+		SocksCredentials:       preferences.StringList(SocksCredentials),
+		HTTPProxyListenURI:     stringWithFallbackSave(preferences, HTTPProxyListenURI, "127.0.0.1:3128"),
+		EnableHTTPProxy:        boolWithFallbackSave(preferences, EnableHTTPProxy, false),
+		TransparentListenURI:   stringWithFallbackSave(preferences, TransparentListenURI, "127.0.0.1:8082"),
+		EnableTransparentProxy: boolWithFallbackSave(preferences, EnableTransparentProxy, false),
+		UpstreamProxy:          preferences.String(UpstreamProxy),
+		UpstreamProxyUsername:  preferences.String(UpstreamProxyUsername),
+		UpstreamProxyPassword:  preferences.String(UpstreamProxyPassword),
+		UpstreamProxyBypass:    preferences.StringList(UpstreamProxyBypass),
+		VerifyUpstreamCerts:    boolWithFallbackSave(preferences, VerifyUpstreamCerts, false),
+		UpstreamCAFile:         preferences.String(UpstreamCAFile),
+		RefuseUnverifiedHosts:  preferences.StringList(RefuseUnverifiedHosts),
+		ClientCertificates:     preferences.StringList(ClientCertificates),
+		KeyLogFile:             preferences.String(KeyLogFile),
+		PACDirectHosts:         preferences.StringList(PACDirectHosts),
+		PACProxyHosts:          preferences.StringList(PACProxyHosts),
+		PACProxyType:           stringWithFallbackSave(preferences, PACProxyType, PACProxyAll),
+		TLSInterceptHosts:      preferences.StringList(TLSInterceptHosts),
+		TLSPassthroughHosts:    preferences.StringList(TLSPassthroughHosts),
+		// 0 disables learning, so it can't fall back to the default like the other preferences
+		TLSPinnedFailureThreshold: preferences.IntWithFallback(TLSPinnedFailureThreshold, DefaultTLSPinnedFailureThreshold),
 	}
 
 	return conf
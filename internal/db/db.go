@@ -3,38 +3,91 @@ package db
 import (
 	"database/sql"
 	"path/filepath"
+	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/redawl/gitm/internal/util"
 )
 
 type DomainInfo struct {
-	Domain  string
-	Cert    []byte
-	PrivKey []byte
+	Domain string
+	// Upstream is the fingerprint of the server certificate that Cert mirrors, or "" if it doesn't mirror one
+	Upstream string
+	Cert     []byte
+	PrivKey  []byte
 }
 
+var (
+	connMu sync.Mutex
+	// sharedConn is the open connection to the db in sharedConnPath
+	sharedConn     *sql.DB
+	sharedConnPath string
+)
+
+// getConn returns the connection to the db in the config dir, opening it if needed.
+// The connection is shared, and only reopened when the config dir changes.
 func getConn() (*sql.DB, error) {
 	configDir, err := util.GetConfigDir()
 	if err != nil {
 		return nil, err
 	}
+	path := filepath.Join(configDir, "domains.db")
+
+	connMu.Lock()
+	defer connMu.Unlock()
+
+	if sharedConn != nil && sharedConnPath == path {
+		return sharedConn, nil
+	}
 
-	conn, err := sql.Open("sqlite3", filepath.Join(configDir, "domains.db"))
+	newConn, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := conn.Exec(`
+	if _, err := newConn.Exec(`
         CREATE TABLE IF NOT EXISTS DOMAINS (
             domain varchar(100) PRIMARY KEY,
             cert BLOB,
-            privkey BLOB
+            privkey BLOB,
+            upstream TEXT NOT NULL DEFAULT ''
         )
     `); err != nil {
+		newConn.Close() //nolint:errcheck
 		return nil, err
 	}
+	if err := migrateUpstream(newConn); err != nil {
+		newConn.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	if sharedConn != nil {
+		sharedConn.Close() //nolint:errcheck
+	}
+	sharedConn, sharedConnPath = newConn, path
 
-	return conn, nil
+	return sharedConn, nil
+}
+
+// migrateUpstream adds the upstream column to dbs created before it existed.
+// Those dbs stored a row per server certificate under "domain@fingerprint", which are deleted,
+// since they are reissued under the domain the next time it is intercepted.
+func migrateUpstream(conn *sql.DB) error {
+	var columns int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM pragma_table_info('DOMAINS') WHERE name = 'upstream'").Scan(&columns); err != nil {
+		return err
+	}
+	if columns > 0 {
+		return nil
+	}
+
+	if _, err := conn.Exec("ALTER TABLE DOMAINS ADD COLUMN upstream TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := conn.Exec("DELETE FROM DOMAINS WHERE domain LIKE '%@%'"); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 func GetDomains() ([]DomainInfo, error) {
@@ -42,28 +95,24 @@ func GetDomains() ([]DomainInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			util.ReportUIError(err, nil)
-		}
-	}()
 
-	rows, err := conn.Query("SELECT domain, cert, privkey from DOMAINS")
+	rows, err := conn.Query("SELECT domain, upstream, cert, privkey from DOMAINS")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close() //nolint:errcheck
 
 	domains := make([]DomainInfo, 0)
 	for rows.Next() {
 		domainInfo := DomainInfo{}
-		if err := rows.Scan(&domainInfo.Domain, &domainInfo.Cert, &domainInfo.PrivKey); err != nil {
+		if err := rows.Scan(&domainInfo.Domain, &domainInfo.Upstream, &domainInfo.Cert, &domainInfo.PrivKey); err != nil {
 			return nil, err
 		}
 
 		domains = append(domains, domainInfo)
 	}
 
-	return domains, nil
+	return domains, rows.Err()
 }
 
 func GetDomain(domain string) (*DomainInfo, error) {
@@ -72,10 +121,10 @@ func GetDomain(domain string) (*DomainInfo, error) {
 		return nil, err
 	}
 
-	row := conn.QueryRow("SELECT domain, cert, privkey from DOMAINS where domain = $1", domain)
+	row := conn.QueryRow("SELECT domain, upstream, cert, privkey from DOMAINS where domain = $1", domain)
 
 	domainInfo := DomainInfo{}
-	if err := row.Scan(&domainInfo.Domain, &domainInfo.Cert, &domainInfo.PrivKey); err != nil {
+	if err := row.Scan(&domainInfo.Domain, &domainInfo.Upstream, &domainInfo.Cert, &domainInfo.PrivKey); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
@@ -86,16 +135,45 @@ func GetDomain(domain string) (*DomainInfo, error) {
 	return &domainInfo, nil
 }
 
-func AddDomain(domain string, cert []byte, privkey []byte) error {
+// AddDomain stores cert and privkey under domain, replacing the certificate stored under it before in one statement,
+// so that there is no moment without a certificate. upstream is the fingerprint of the server certificate cert mirrors, if any.
+func AddDomain(domain string, upstream string, cert []byte, privkey []byte) error {
 	conn, err := getConn()
 	if err != nil {
 		return err
 	}
 
 	if _, err := conn.Exec(`
-        INSERT INTO DOMAINS (domain, cert, privkey) 
-        VALUES ($1, $2, $3) ON CONFLICT (domain) DO NOTHING
-    `, domain, cert, privkey); err != nil {
+        INSERT INTO DOMAINS (domain, upstream, cert, privkey) 
+        VALUES ($1, $2, $3, $4) ON CONFLICT (domain) DO UPDATE SET upstream = excluded.upstream, cert = excluded.cert, privkey = excluded.privkey
+    `, domain, upstream, cert, privkey); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func DeleteDomain(domain string) error {
+	conn, err := getConn()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Exec("DELETE FROM DOMAINS WHERE domain = $1", domain); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteDomains deletes every certificate.
+func DeleteDomains() error {
+	conn, err := getConn()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Exec("DELETE FROM DOMAINS"); err != nil {
 		return err
 	}
 
@@ -25,11 +25,15 @@ const (
 	// TODO filter on version?
 	FilterStatus   = "status"
 	FilterRespBody = "respbody"
+	FilterUser     = "user"
+	// FilterFingerprint matches the JA3, JA4, JA3S and JA4S fingerprints of the tls connection
+	FilterFingerprint = "fingerprint"
 )
 
 // HTTPPacket represents a captured packet from either the https or http proxy.
 // An HTTPPacket contains all the information from the http request, as well as the information from the http response (once it has been captured).
 type HTTPPacket struct {
+	ConnInfo
 	Encrypted_ bool      `json:"Encrypted"`
 	TimeStamp_ time.Time `json:"TimeStamp"`
 	Type_      string    `json:"Type"`
@@ -85,7 +89,7 @@ func CreatePacket(
 }
 
 func (p *HTTPPacket) Encrypted() bool {
-	return p.Encrypted_
+	return p.Encrypted_ || p.TLS != nil
 }
 
 func (p *HTTPPacket) TimeStamp() time.Time {
@@ -99,7 +103,7 @@ func (p *HTTPPacket) Type() string {
 func (p *HTTPPacket) FindPacket(packets []Packet) Packet {
 	for _, pac := range packets {
 		if httpPacket, ok := pac.(*HTTPPacket); ok && httpPacket.ID == p.ID {
-			return p
+			return httpPacket
 		}
 	}
 
@@ -134,6 +138,10 @@ func (p *HTTPPacket) MatchesFilter(tokens []internal.FilterToken) bool {
 			filterStr = p.Status
 		case FilterRespBody:
 			filterStr = string(p.RespBody)
+		case FilterUser:
+			filterStr = p.Username
+		case FilterFingerprint:
+			filterStr = p.fingerprints()
 		default:
 			slog.Warn("Unknown filter specified", "filterType", token.FilterType, "filterContent", token.FilterContent)
 		}
@@ -148,6 +156,7 @@ func (p *HTTPPacket) MatchesFilter(tokens []internal.FilterToken) bool {
 
 func (p *HTTPPacket) UpdatePacket(inPacket Packet) {
 	if httpPacket, ok := inPacket.(*HTTPPacket); ok {
+		p.ConnInfo = httpPacket.ConnInfo
 		p.Hostname = httpPacket.Hostname
 		p.Method = httpPacket.Method
 		p.Status = httpPacket.Status
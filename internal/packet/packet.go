@@ -22,6 +22,20 @@ type Packet interface {
 	MatchesFilter([]internal.FilterToken) bool
 }
 
+// ConnInfo is information about the proxied connection a packet was captured on.
+// Every packet captured on the same connection has the same ConnInfo.
+type ConnInfo struct {
+	// Username is the name the client authenticated to the proxy with.
+	// It is empty when authentication is disabled.
+	Username string `json:",omitempty"`
+	// TLS is the metadata of the intercepted tls session.
+	// It is nil when the connection wasn't tls, or wasn't decrypted.
+	TLS *TLSInfo `json:",omitempty"`
+	// Fingerprints are the fingerprints of the client's and server's hellos.
+	// It is nil when the connection wasn't tls.
+	Fingerprints *TLSFingerprints `json:",omitempty"`
+}
+
 func MarshalPackets(p []Packet) ([]byte, error) {
 	return json.Marshal(p)
 }
@@ -51,6 +65,24 @@ func UnmarshalPackets(data []byte, p *[]Packet) error {
 				return err
 			}
 			*p = append(*p, &websocketPacket)
+		} else if pacMap["Type"] == "udp" {
+			var udpPacket UDPPacket
+			if err := json.Unmarshal(*pac, &udpPacket); err != nil {
+				return err
+			}
+			*p = append(*p, &udpPacket)
+		} else if pacMap["Type"] == "stream" {
+			var streamPacket StreamPacket
+			if err := json.Unmarshal(*pac, &streamPacket); err != nil {
+				return err
+			}
+			*p = append(*p, &streamPacket)
+		} else if pacMap["Type"] == "tls-failure" {
+			var failurePacket TLSFailurePacket
+			if err := json.Unmarshal(*pac, &failurePacket); err != nil {
+				return err
+			}
+			*p = append(*p, &failurePacket)
 		} else {
 			slog.Error("Unknown packet type encountered!", "type", pacMap["Type"])
 		}
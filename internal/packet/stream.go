@@ -0,0 +1,169 @@
+package packet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+)
+
+var _ Packet = (*StreamPacket)(nil)
+
+// StreamPacket represents a tcp connection whose protocol is not understood by gitm.
+// The bytes sent in each direction are recorded as is.
+type StreamPacket struct {
+	ConnInfo
+	TimeStamp_ time.Time `json:"TimeStamp"`
+	Type_      string    `json:"Type"`
+	ID         [16]byte  `json:"id"`
+	// RemoteAddr is the address of the remote host, i.e. "10.0.0.1:21"
+	RemoteAddr string
+	ClientData []byte
+	ServerData []byte
+	// Closed is whether the connection has been closed
+	Closed bool
+	// Passthrough is whether this is a tls connection gitm didn't intercept.
+	// Only the number of bytes relayed is recorded, not the bytes themselves.
+	Passthrough bool `json:",omitempty"`
+	// ServerName is the server name (SNI) the client sent, for passthrough connections
+	ServerName  string `json:",omitempty"`
+	ClientBytes int64  `json:",omitempty"`
+	ServerBytes int64  `json:",omitempty"`
+}
+
+func CreateStreamPacket(remoteAddr string) *StreamPacket {
+	packet := &StreamPacket{
+		TimeStamp_: time.Now(),
+		Type_:      "stream",
+		RemoteAddr: remoteAddr,
+		ClientData: []byte{},
+		ServerData: []byte{},
+	}
+
+	if _, err := rand.Read(packet.ID[:]); err != nil {
+		slog.Error("Error generating id", "error", err)
+	}
+
+	return packet
+}
+
+func (p *StreamPacket) Encrypted() bool {
+	return p.Passthrough
+}
+
+func (p *StreamPacket) TimeStamp() time.Time {
+	return p.TimeStamp_
+}
+
+func (p *StreamPacket) Type() string {
+	return p.Type_
+}
+
+func (p *StreamPacket) FindPacket(packets []Packet) Packet {
+	for _, pac := range packets {
+		if streamPacket, ok := pac.(*StreamPacket); ok && streamPacket.ID == p.ID {
+			return streamPacket
+		}
+	}
+
+	return nil
+}
+
+func (p *StreamPacket) UpdatePacket(inPacket Packet) {
+	if streamPacket, ok := inPacket.(*StreamPacket); ok {
+		p.ConnInfo = streamPacket.ConnInfo
+		p.RemoteAddr = streamPacket.RemoteAddr
+		p.ClientData = streamPacket.ClientData
+		p.ServerData = streamPacket.ServerData
+		p.Closed = streamPacket.Closed
+		p.Passthrough = streamPacket.Passthrough
+		p.ServerName = streamPacket.ServerName
+		p.ClientBytes = streamPacket.ClientBytes
+		p.ServerBytes = streamPacket.ServerBytes
+	}
+}
+
+func (p *StreamPacket) FormatHostname() string {
+	if p.ServerName != "" {
+		if _, port, err := net.SplitHostPort(p.RemoteAddr); err == nil {
+			return net.JoinHostPort(p.ServerName, port)
+		}
+	}
+
+	return p.RemoteAddr
+}
+
+func (p *StreamPacket) FormatRequestLine() string {
+	if p.Passthrough {
+		return fmt.Sprintf("TLS passthrough --> %d bytes <-- %d bytes", p.ClientBytes, p.ServerBytes)
+	}
+
+	return fmt.Sprintf("TCP --> %d bytes <-- %d bytes", len(p.ClientData), len(p.ServerData))
+}
+
+func (p *StreamPacket) FormatResponseLine() string {
+	if p.Closed {
+		return "closed"
+	}
+
+	return "open"
+}
+
+func (p *StreamPacket) FormatRequestContent() string {
+	if p.Passthrough {
+		return p.formatPassthrough("Sent to", p.ClientBytes)
+	}
+
+	return fmt.Sprintf("Sent to %s\n\n%s", p.RemoteAddr, hex.Dump(p.ClientData))
+}
+
+func (p *StreamPacket) FormatResponseContent() string {
+	if p.Passthrough {
+		return p.formatPassthrough("Received from", p.ServerBytes)
+	}
+
+	return fmt.Sprintf("Received from %s\n\n%s", p.RemoteAddr, hex.Dump(p.ServerData))
+}
+
+// formatPassthrough describes one direction of a passthrough connection, whose contents weren't recorded
+func (p *StreamPacket) formatPassthrough(direction string, bytes int64) string {
+	serverName := p.ServerName
+	if serverName == "" {
+		serverName = "none"
+	}
+
+	return fmt.Sprintf("%s %s\nServer name: %s\n\n%d bytes, passed through without interception", direction, p.RemoteAddr, serverName, bytes)
+}
+
+func (p *StreamPacket) MatchesFilter(tokens []internal.FilterToken) bool {
+	for _, token := range tokens {
+		filterStr := ""
+		switch token.FilterType {
+		case FilterHostname:
+			filterStr = p.RemoteAddr + " " + p.ServerName
+		case FilterReqBody:
+			filterStr = string(p.ClientData)
+		case FilterRespBody:
+			filterStr = string(p.ServerData)
+		case FilterUser:
+			filterStr = p.Username
+		case FilterFingerprint:
+			filterStr = p.fingerprints()
+		case FilterMethod, FilterPath, FilterStatus:
+			// Not applicable to raw streams
+		default:
+			slog.Warn("Unknown filter specified", "filterType", token.FilterType, "filterContent", token.FilterContent)
+		}
+
+		if token.Negate == strings.Contains(filterStr, token.FilterContent) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,208 @@
+package packet
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TLSInfo is the metadata of an intercepted tls session.
+// The client and the server each negotiate their own session with gitm, so each has its own parameters.
+type TLSInfo struct {
+	// ServerName is the SNI sent by the client. It is empty if the client didn't send one.
+	ServerName string `json:",omitempty"`
+	// Client is the session between the client and gitm
+	Client TLSSession
+	// Server is the session between gitm and the server
+	Server TLSSession
+	// ServerCertificates is the DER encoded certificate chain sent by the server, starting with the leaf
+	ServerCertificates [][]byte
+	// Verified is whether the server certificate chain was verified successfully
+	Verified bool `json:",omitempty"`
+	// VerificationError is why verifying the server certificate chain failed.
+	// It is empty if verification succeeded, or wasn't enabled.
+	VerificationError string `json:",omitempty"`
+	// ClientCertificateRequested is whether the server asked for a client certificate
+	ClientCertificateRequested bool `json:",omitempty"`
+	// PresentedCertificate is the DER encoded client certificate gitm presented to the server
+	PresentedCertificate []byte `json:",omitempty"`
+	// ClientCertificates is the DER encoded certificate chain the client presented to gitm
+	ClientCertificates [][]byte `json:",omitempty"`
+}
+
+// TLSSession is the parameters negotiated for one tls session.
+type TLSSession struct {
+	// Version is the tls version, i.e. "TLS 1.3"
+	Version string
+	// CipherSuite is the name of the cipher suite, i.e. "TLS_AES_128_GCM_SHA256"
+	CipherSuite string
+	// ALPN is the negotiated application protocol, i.e. "h2". It is empty if none was negotiated.
+	ALPN string `json:",omitempty"`
+}
+
+// TLSFingerprints are the JA3 and JA4 fingerprints of the hellos sent on a tls connection,
+// which identify the tls library used by the client and the server.
+// A fingerprint is empty when its hello wasn't seen.
+type TLSFingerprints struct {
+	// JA3 and JA4 are the fingerprints of the client's ClientHello
+	JA3 string `json:",omitempty"`
+	JA4 string `json:",omitempty"`
+	// JA3S and JA4S are the fingerprints of the server's ServerHello
+	JA3S string `json:",omitempty"`
+	JA4S string `json:",omitempty"`
+}
+
+// CreateTLSInfo creates the TLSInfo for a connection, from the state of the session with the client,
+// and the state of the session with the server.
+func CreateTLSInfo(client tls.ConnectionState, server tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		ServerName:         client.ServerName,
+		Client:             createTLSSession(client),
+		Server:             createTLSSession(server),
+		ServerCertificates: make([][]byte, 0, len(server.PeerCertificates)),
+	}
+
+	for _, cert := range server.PeerCertificates {
+		info.ServerCertificates = append(info.ServerCertificates, cert.Raw)
+	}
+	for _, cert := range client.PeerCertificates {
+		info.ClientCertificates = append(info.ClientCertificates, cert.Raw)
+	}
+
+	return info
+}
+
+func createTLSSession(state tls.ConnectionState) TLSSession {
+	return TLSSession{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+	}
+}
+
+// FormatTLS formats the tls metadata of the connection for display.
+// An empty string is returned when the connection wasn't tls.
+func (c ConnInfo) FormatTLS() string {
+	if c.TLS == nil {
+		// Connections that weren't intercepted only have their fingerprints
+		return c.Fingerprints.format()
+	}
+
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "Server Name: %s\n\n", c.TLS.ServerName)
+	fmt.Fprintf(&builder, "Client -> gitm\n%s\n", c.TLS.Client.format())
+	fmt.Fprintf(&builder, "gitm -> Server\n%s\n", c.TLS.Server.format())
+	builder.WriteString(c.Fingerprints.format())
+
+	switch {
+	case c.TLS.VerificationError != "":
+		fmt.Fprintf(&builder, "Verification: FAILED: %s\n\n", c.TLS.VerificationError)
+	case c.TLS.Verified:
+		builder.WriteString("Verification: OK\n\n")
+	default:
+		builder.WriteString("Verification: disabled\n\n")
+	}
+
+	builder.WriteString("Server Certificates\n")
+	formatCertificates(&builder, c.TLS.ServerCertificates)
+
+	if c.TLS.ClientCertificateRequested {
+		builder.WriteString("The server requested a client certificate\n\n")
+		if c.TLS.PresentedCertificate != nil {
+			builder.WriteString("Client Certificate Presented By gitm\n")
+			formatCertificates(&builder, [][]byte{c.TLS.PresentedCertificate})
+		}
+	}
+
+	if len(c.TLS.ClientCertificates) > 0 {
+		builder.WriteString("Client Certificates\n")
+		formatCertificates(&builder, c.TLS.ClientCertificates)
+	}
+
+	return builder.String()
+}
+
+func formatCertificates(builder *strings.Builder, certificates [][]byte) {
+	for i, der := range certificates {
+		fmt.Fprintf(builder, "[%d]\n", i)
+		builder.WriteString(formatCertificate(der))
+		builder.WriteByte('\n')
+	}
+}
+
+// TLSVerificationError is why verifying the server certificate chain failed.
+// An empty string is returned if the connection wasn't intercepted tls, or verification didn't fail.
+func (c ConnInfo) TLSVerificationError() string {
+	if c.TLS == nil {
+		return ""
+	}
+
+	return c.TLS.VerificationError
+}
+
+// fingerprints returns the fingerprints of the connection for filtering, or "" if it has none.
+func (c ConnInfo) fingerprints() string {
+	if c.Fingerprints == nil {
+		return ""
+	}
+
+	return strings.Join([]string{c.Fingerprints.JA3, c.Fingerprints.JA4, c.Fingerprints.JA3S, c.Fingerprints.JA4S}, " ")
+}
+
+func (f *TLSFingerprints) format() string {
+	if f == nil {
+		return ""
+	}
+
+	orNone := func(fingerprint string) string {
+		if fingerprint == "" {
+			return "none"
+		}
+		return fingerprint
+	}
+
+	return fmt.Sprintf("Fingerprints\n    JA3: %s\n    JA4: %s\n    JA3S: %s\n    JA4S: %s\n\n",
+		orNone(f.JA3), orNone(f.JA4), orNone(f.JA3S), orNone(f.JA4S))
+}
+
+func (s TLSSession) format() string {
+	alpn := s.ALPN
+	if alpn == "" {
+		alpn = "none"
+	}
+
+	return fmt.Sprintf("    Version: %s\n    Cipher Suite: %s\n    ALPN: %s\n", s.Version, s.CipherSuite, alpn)
+}
+
+func formatCertificate(der []byte) string {
+	fingerprint := sha256.Sum256(der)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Sprintf("    Unparsable certificate: %v\n    SHA-256: %s\n", err, hex.EncodeToString(fingerprint[:]))
+	}
+
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "    Subject: %s\n", cert.Subject)
+	fmt.Fprintf(&builder, "    Issuer: %s\n", cert.Issuer)
+	fmt.Fprintf(&builder, "    Not Before: %s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(&builder, "    Not After: %s\n", cert.NotAfter.Format(time.RFC3339))
+	if len(cert.DNSNames) > 0 {
+		fmt.Fprintf(&builder, "    DNS Names: %s\n", strings.Join(cert.DNSNames, ", "))
+	}
+	if len(cert.IPAddresses) > 0 {
+		ips := make([]string, 0, len(cert.IPAddresses))
+		for _, ip := range cert.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		fmt.Fprintf(&builder, "    IP Addresses: %s\n", strings.Join(ips, ", "))
+	}
+	fmt.Fprintf(&builder, "    Signature Algorithm: %s\n", cert.SignatureAlgorithm)
+	fmt.Fprintf(&builder, "    SHA-256: %s\n", hex.EncodeToString(fingerprint[:]))
+
+	return builder.String()
+}
@@ -0,0 +1,153 @@
+package packet
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+)
+
+var _ Packet = (*TLSFailurePacket)(nil)
+
+// TLSFailurePacket represents a tls connection whose client rejected gitm's certificate,
+// i.e. because the client pins the server's certificate.
+type TLSFailurePacket struct {
+	ConnInfo
+	TimeStamp_ time.Time `json:"TimeStamp"`
+	Type_      string    `json:"Type"`
+	ID         [16]byte  `json:"id"`
+	// RemoteAddr is the address of the remote host, i.e. "10.0.0.1:443"
+	RemoteAddr string
+	// ServerName is the server name (SNI) the client sent, or "" if it didn't send one
+	ServerName string `json:",omitempty"`
+	// Host is the host failures are counted for: ServerName, or the host the client asked to connect to without one
+	Host string
+	// Reason is why the handshake failed, i.e. the alert the client sent
+	Reason string
+	// Failures is how many handshakes with the host have failed in a row, including this one
+	Failures int
+	// Passthrough is whether the host was added to the tls passthrough list because of this failure
+	Passthrough bool `json:",omitempty"`
+}
+
+func CreateTLSFailurePacket(remoteAddr string, serverName string, host string, reason string) *TLSFailurePacket {
+	packet := &TLSFailurePacket{
+		TimeStamp_: time.Now(),
+		Type_:      "tls-failure",
+		RemoteAddr: remoteAddr,
+		ServerName: serverName,
+		Host:       host,
+		Reason:     reason,
+	}
+
+	if _, err := rand.Read(packet.ID[:]); err != nil {
+		slog.Error("Error generating id", "error", err)
+	}
+
+	return packet
+}
+
+func (p *TLSFailurePacket) Encrypted() bool {
+	return true
+}
+
+func (p *TLSFailurePacket) TimeStamp() time.Time {
+	return p.TimeStamp_
+}
+
+func (p *TLSFailurePacket) Type() string {
+	return p.Type_
+}
+
+func (p *TLSFailurePacket) FindPacket(packets []Packet) Packet {
+	for _, pac := range packets {
+		if failurePacket, ok := pac.(*TLSFailurePacket); ok && failurePacket.ID == p.ID {
+			return failurePacket
+		}
+	}
+
+	return nil
+}
+
+func (p *TLSFailurePacket) UpdatePacket(inPacket Packet) {
+	if failurePacket, ok := inPacket.(*TLSFailurePacket); ok {
+		p.ConnInfo = failurePacket.ConnInfo
+		p.RemoteAddr = failurePacket.RemoteAddr
+		p.ServerName = failurePacket.ServerName
+		p.Host = failurePacket.Host
+		p.Reason = failurePacket.Reason
+		p.Failures = failurePacket.Failures
+		p.Passthrough = failurePacket.Passthrough
+	}
+}
+
+func (p *TLSFailurePacket) FormatHostname() string {
+	if _, port, err := net.SplitHostPort(p.RemoteAddr); err == nil && p.Host != "" {
+		return net.JoinHostPort(p.Host, port)
+	}
+
+	return p.RemoteAddr
+}
+
+func (p *TLSFailurePacket) FormatRequestLine() string {
+	return "TLS handshake failed: " + p.Reason
+}
+
+func (p *TLSFailurePacket) FormatResponseLine() string {
+	if p.Passthrough {
+		return "passthrough"
+	}
+
+	return fmt.Sprintf("%d failures", p.Failures)
+}
+
+func (p *TLSFailurePacket) FormatRequestContent() string {
+	serverName := p.ServerName
+	if serverName == "" {
+		serverName = "none"
+	}
+
+	content := fmt.Sprintf(
+		"The client rejected gitm's certificate for %s (%s)\nServer name: %s\nReason: %s\nFailures in a row: %d\n",
+		p.Host, p.RemoteAddr, serverName, p.Reason, p.Failures,
+	)
+	if p.Passthrough {
+		content += "\nThe host was added to the tls passthrough list, so its connections are no longer intercepted\n"
+	}
+
+	return content
+}
+
+func (p *TLSFailurePacket) FormatResponseContent() string {
+	return ""
+}
+
+func (p *TLSFailurePacket) MatchesFilter(tokens []internal.FilterToken) bool {
+	for _, token := range tokens {
+		filterStr := ""
+		switch token.FilterType {
+		case FilterHostname:
+			filterStr = p.RemoteAddr + " " + p.Host
+		case FilterUser:
+			filterStr = p.Username
+		case FilterFingerprint:
+			filterStr = p.fingerprints()
+		case FilterReqBody:
+			filterStr = p.Reason
+		case FilterRespBody, FilterMethod, FilterPath, FilterStatus:
+			// Not applicable to failed handshakes
+		default:
+			slog.Warn("Unknown filter specified", "filterType", token.FilterType, "filterContent", token.FilterContent)
+		}
+
+		if token.Negate == strings.Contains(filterStr, token.FilterContent) {
+			return false
+		}
+	}
+
+	return true
+}
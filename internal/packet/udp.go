@@ -0,0 +1,138 @@
+package packet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+)
+
+var _ Packet = (*UDPPacket)(nil)
+
+// UDPPacket represents a single datagram relayed by the socks5 udp associate relay.
+type UDPPacket struct {
+	ConnInfo
+	TimeStamp_ time.Time `json:"TimeStamp"`
+	Type_      string    `json:"Type"`
+	ID         [16]byte  `json:"id"`
+	// FromClient is whether the datagram was sent by the client, or received from the remote host
+	FromClient bool
+	// RemoteAddr is the address of the remote host, i.e. "10.0.0.1:53"
+	RemoteAddr string
+	Payload    []byte
+}
+
+func CreateUDPPacket(fromClient bool, remoteAddr string, payload []byte) *UDPPacket {
+	packet := &UDPPacket{
+		TimeStamp_: time.Now(),
+		Type_:      "udp",
+		FromClient: fromClient,
+		RemoteAddr: remoteAddr,
+		Payload:    payload,
+	}
+
+	if _, err := rand.Read(packet.ID[:]); err != nil {
+		slog.Error("Error generating id", "error", err)
+	}
+
+	return packet
+}
+
+func (p *UDPPacket) Encrypted() bool {
+	return false
+}
+
+func (p *UDPPacket) TimeStamp() time.Time {
+	return p.TimeStamp_
+}
+
+func (p *UDPPacket) Type() string {
+	return p.Type_
+}
+
+func (p *UDPPacket) FindPacket(packets []Packet) Packet {
+	for _, pac := range packets {
+		if udpPacket, ok := pac.(*UDPPacket); ok && udpPacket.ID == p.ID {
+			return udpPacket
+		}
+	}
+
+	return nil
+}
+
+func (p *UDPPacket) UpdatePacket(inPacket Packet) {
+	if udpPacket, ok := inPacket.(*UDPPacket); ok {
+		p.ConnInfo = udpPacket.ConnInfo
+		p.FromClient = udpPacket.FromClient
+		p.RemoteAddr = udpPacket.RemoteAddr
+		p.Payload = udpPacket.Payload
+	}
+}
+
+func (p *UDPPacket) FormatHostname() string {
+	return p.RemoteAddr
+}
+
+func (p *UDPPacket) FormatRequestLine() string {
+	if p.FromClient {
+		return fmt.Sprintf("UDP --> %d bytes", len(p.Payload))
+	}
+
+	return fmt.Sprintf("UDP <-- %d bytes", len(p.Payload))
+}
+
+func (p *UDPPacket) FormatResponseLine() string {
+	return ""
+}
+
+func (p *UDPPacket) FormatRequestContent() string {
+	if !p.FromClient {
+		return ""
+	}
+
+	return fmt.Sprintf("UDP datagram to %s\n\n%s", p.RemoteAddr, hex.Dump(p.Payload))
+}
+
+func (p *UDPPacket) FormatResponseContent() string {
+	if p.FromClient {
+		return ""
+	}
+
+	return fmt.Sprintf("UDP datagram from %s\n\n%s", p.RemoteAddr, hex.Dump(p.Payload))
+}
+
+func (p *UDPPacket) MatchesFilter(tokens []internal.FilterToken) bool {
+	for _, token := range tokens {
+		filterStr := ""
+		switch token.FilterType {
+		case FilterHostname:
+			filterStr = p.RemoteAddr
+		case FilterReqBody:
+			if p.FromClient {
+				filterStr = string(p.Payload)
+			}
+		case FilterRespBody:
+			if !p.FromClient {
+				filterStr = string(p.Payload)
+			}
+		case FilterUser:
+			filterStr = p.Username
+		case FilterFingerprint:
+			filterStr = p.fingerprints()
+		case FilterMethod, FilterPath, FilterStatus:
+			// Not applicable to udp
+		default:
+			slog.Warn("Unknown filter specified", "filterType", token.FilterType, "filterContent", token.FilterContent)
+		}
+
+		if token.Negate == strings.Contains(filterStr, token.FilterContent) {
+			return false
+		}
+	}
+
+	return true
+}
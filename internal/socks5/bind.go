@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// bindTimeout is how long to wait for the remote host to connect after a BIND request
+const bindTimeout = 2 * time.Minute
+
+// handleBind accepts a single inbound connection for the client, as described by the BIND command in RFC 1928.
+//
+// The first reply tells the client where to have the remote host connect to, and the second reply is sent
+// once the remote host has connected. The inbound connection is then relayed and recorded as a raw stream.
+func handleBind(client net.Conn, request *ClientConnRequest, connInfo packet.ConnInfo, packetHandler func(packet.Packet)) error {
+	logger := slog.With("RemoteAddr", client.RemoteAddr(), "LocalAddr", client.LocalAddr(), "DstIp", request.DstIP, "DstPort", request.DstPort)
+	logger.Debug("Handling bind", "request", request)
+
+	expectedIP := net.ParseIP(request.DstIP)
+	if expectedIP == nil {
+		ips, err := net.LookupIP(request.DstIP)
+		if err != nil {
+			if _, err := client.Write(FormatConnResponse(
+				SocksVer5,
+				StatusHostUnreachable,
+				client.LocalAddr(),
+			)); err != nil {
+				return fmt.Errorf("formatting conn response: %w", err)
+			}
+			return fmt.Errorf("looking up ip for domain name: %w", err)
+		}
+		expectedIP = ips[0]
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: bindIP(client, expectedIP)})
+	if err != nil {
+		if _, err := client.Write(FormatConnResponse(
+			SocksVer5,
+			StatusGeneralFailure,
+			client.LocalAddr(),
+		)); err != nil {
+			return fmt.Errorf("formatting conn response: %w", err)
+		}
+		return fmt.Errorf("opening bind listener: %w", err)
+	}
+	defer listener.Close() //nolint:errcheck
+
+	if _, err := client.Write(FormatConnResponse(
+		SocksVer5,
+		StatusSucceeded,
+		listener.Addr(),
+	)); err != nil {
+		return fmt.Errorf("formatting first bind response: %w", err)
+	}
+
+	if err := listener.SetDeadline(time.Now().Add(bindTimeout)); err != nil {
+		return fmt.Errorf("setting bind deadline: %w", err)
+	}
+
+	var inbound net.Conn
+	for inbound == nil {
+		conn, err := listener.Accept()
+		if err != nil {
+			if _, err := client.Write(FormatConnResponse(
+				SocksVer5,
+				StatusTTLExpired,
+				listener.Addr(),
+			)); err != nil {
+				return fmt.Errorf("formatting second bind response: %w", err)
+			}
+			return fmt.Errorf("accepting bind connection: %w", err)
+		}
+
+		remoteIP := conn.RemoteAddr().(*net.TCPAddr).IP
+		if expectedIP != nil && !expectedIP.IsUnspecified() && !expectedIP.Equal(remoteIP) {
+			logger.Info("Rejecting bind connection from unexpected host", "host", conn.RemoteAddr())
+			conn.Close() //nolint:errcheck
+			continue
+		}
+
+		inbound = conn
+	}
+
+	logger.Debug("Accepted bind connection", "host", inbound.RemoteAddr())
+	if _, err := client.Write(FormatConnResponse(
+		SocksVer5,
+		StatusSucceeded,
+		inbound.RemoteAddr(),
+	)); err != nil {
+		inbound.Close() //nolint:errcheck
+		return fmt.Errorf("formatting second bind response: %w", err)
+	}
+
+	recordedProxy(client, inbound, connInfo, packetHandler)
+
+	return nil
+}
+
+// bindIP finds the local ip that remoteIP would use to reach us, so that it can be sent to the client
+// in the first BIND reply. The ip the client connected to is used if remoteIP isn't known.
+func bindIP(client net.Conn, remoteIP net.IP) net.IP {
+	localIP := client.LocalAddr().(*net.TCPAddr).IP
+	if remoteIP == nil || remoteIP.IsUnspecified() {
+		return localIP
+	}
+
+	// Dialing udp doesn't send anything, but does pick the interface that routes to remoteIP
+	conn, err := net.Dial("udp", net.JoinHostPort(remoteIP.String(), strconv.Itoa(9)))
+	if err != nil {
+		return localIP
+	}
+	defer conn.Close() //nolint:errcheck
+
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
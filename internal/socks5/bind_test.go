@@ -0,0 +1,100 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/redawl/gitm/internal/packet"
+	"github.com/redawl/gitm/internal/util"
+)
+
+func TestHandleBind(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer listener.Close() //nolint:errcheck
+
+	closed := make(chan *packet.StreamPacket, 1)
+	done := make(chan error)
+	go func() {
+		server, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		// Clients are always buffered, since their protocol is sniffed first
+		done <- handleBind(newBufferedConn(server), &ClientConnRequest{DstIP: "127.0.0.1"}, packet.ConnInfo{}, func(p packet.Packet) {
+			if streamPacket := p.(*packet.StreamPacket); streamPacket.Closed {
+				closed <- streamPacket
+			}
+		})
+	}()
+
+	control, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer control.Close() //nolint:errcheck
+
+	reply, err := util.ReadCount(control, 10)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if reply[1] != StatusSucceeded {
+		t.Fatalf("Expected first reply to succeed, got %x", reply)
+	}
+	bindAddr := &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 + int(reply[9])}
+
+	remote, err := net.DialTCP("tcp", nil, bindAddr)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer remote.Close() //nolint:errcheck
+
+	reply, err = util.ReadCount(control, 10)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if reply[1] != StatusSucceeded || int(reply[8])<<8+int(reply[9]) != remote.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("Expected second reply with the remote address, got %x", reply)
+	}
+
+	if _, err := remote.Write([]byte("220 ready\r\n")); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if greeting, err := util.ReadCount(control, 11); err != nil || string(greeting) != "220 ready\r\n" {
+		t.Fatalf("Expected greeting to be relayed, got %q, err = %v", greeting, err)
+	}
+	if _, err := control.Write([]byte("QUIT\r\n")); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if quit, err := util.ReadCount(remote, 6); err != nil || string(quit) != "QUIT\r\n" {
+		t.Fatalf("Expected QUIT to be relayed, got %q, err = %v", quit, err)
+	}
+
+	_ = remote.CloseWrite()
+	_, _ = io.Copy(io.Discard, control)
+	_ = control.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected err = nil, got err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handleBind did not return after the connections closed")
+	}
+
+	// Packets are handled after the connection they were captured from
+	select {
+	case last := <-closed:
+		if string(last.ClientData) != "QUIT\r\n" || string(last.ServerData) != "220 ready\r\n" {
+			t.Errorf("Expected closed stream packet with both sides recorded, got %+v", last)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the closed stream packet")
+	}
+}
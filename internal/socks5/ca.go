@@ -0,0 +1,236 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	_ "embed"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/redawl/gitm/internal/db"
+	"github.com/redawl/gitm/internal/util"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// The formats the CA can be exported as
+const (
+	CAFormatDER    = "der"
+	CAFormatPEM    = "pem"
+	CAFormatPKCS12 = "p12"
+	// CAFormatMobileConfig is an iOS and macOS configuration profile, which installs the CA when opened
+	CAFormatMobileConfig = "mobileconfig"
+)
+
+// ExpiryWarningPeriod is how long before the CA or an issued certificate expires that it is warned about
+const ExpiryWarningPeriod = 30 * 24 * time.Hour
+
+// ImportCA replaces the gitm CA with the CA in data, which is either pem with the certificate and its private key,
+// or PKCS #12 protected by password. Every certificate issued by the old CA is deleted.
+func ImportCA(data []byte, password string) error {
+	var (
+		caCert    *x509.Certificate
+		caPrivKey crypto.Signer
+		err       error
+	)
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		caCert, caPrivKey, err = parsePemCA(data)
+	} else {
+		caCert, caPrivKey, err = parsePKCS12CA(data, password)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !caCert.IsCA {
+		return fmt.Errorf("certificate %q is not a CA", caCert.Subject)
+	}
+	if publicKey, ok := caCert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(caPrivKey.Public()) {
+		return errors.New("private key doesn't match the certificate")
+	}
+
+	return replaceCA(caCert, caPrivKey)
+}
+
+func parsePemCA(data []byte) (*x509.Certificate, crypto.Signer, error) {
+	var (
+		caCert    *x509.Certificate
+		caPrivKey crypto.Signer
+	)
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch {
+		case block.Type == "CERTIFICATE" && caCert == nil:
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing certificate: %w", err)
+			}
+			caCert = cert
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && caPrivKey == nil:
+			key, err := parsePrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing private key: %w", err)
+			}
+			caPrivKey = key
+		}
+	}
+
+	if caCert == nil {
+		return nil, nil, errors.New("no certificate found")
+	}
+	if caPrivKey == nil {
+		return nil, nil, errors.New("no private key found")
+	}
+
+	return caCert, caPrivKey, nil
+}
+
+func parsePKCS12CA(data []byte, password string) (*x509.Certificate, crypto.Signer, error) {
+	key, caCert, err := pkcs12.Decode(data, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding PKCS #12: %w", err)
+	}
+
+	caPrivKey, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return caCert, caPrivKey, nil
+}
+
+// RotateCA replaces the gitm CA with a newly created one, deleting every certificate issued by the old CA.
+// Clients have to trust the new CA before they can be intercepted again.
+func RotateCA() error {
+	caCert, caPrivKey, err := createCA()
+	if err != nil {
+		return fmt.Errorf("creating ca: %w", err)
+	}
+
+	return replaceCA(caCert, caPrivKey)
+}
+
+// replaceCA writes caCert and caPrivKey to the config dir, and deletes the certificates issued by the previous CA.
+func replaceCA(caCert *x509.Certificate, caPrivKey crypto.Signer) error {
+	configDir, err := util.GetConfigDir()
+	if err != nil {
+		return err
+	}
+
+	caMu.Lock()
+	defer caMu.Unlock()
+
+	if err := writeCA(configDir, caCert, caPrivKey); err != nil {
+		return fmt.Errorf("writing ca: %w", err)
+	}
+	caCache, caCachePrivKey, caCacheDir = caCert, caPrivKey, configDir
+
+	if err := db.DeleteDomains(); err != nil {
+		return fmt.Errorf("deleting certificates issued by the old ca: %w", err)
+	}
+	certificates.Clear()
+
+	return nil
+}
+
+// ExportCA returns the gitm CA encoded as format.
+// The PKCS #12 export includes the private key, encrypted with password, so that it can be imported by another gitm.
+func ExportCA(format string, password string) ([]byte, error) {
+	caCert, caPrivKey, err := getCaCert()
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case CAFormatDER:
+		return caCert.Raw, nil
+	case CAFormatPEM:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), nil
+	case CAFormatPKCS12:
+		return pkcs12.Modern.Encode(caPrivKey, caCert, nil, password)
+	case CAFormatMobileConfig:
+		return mobileConfig(caCert)
+	default:
+		return nil, fmt.Errorf("unknown ca format %q, must be %s, %s, %s or %s", format, CAFormatDER, CAFormatPEM, CAFormatPKCS12, CAFormatMobileConfig)
+	}
+}
+
+//go:embed assets/gitm.mobileconfig
+var mobileConfigTemplate string
+
+// mobileConfig returns a configuration profile that installs caCert as a trusted root.
+// The profile's UUIDs are derived from caCert, so installing it again replaces the previous install.
+func mobileConfig(caCert *x509.Certificate) ([]byte, error) {
+	profile, err := template.New("mobileconfig").Parse(mobileConfigTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(caCert.Raw)
+	uuid := func(b []byte) string {
+		return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := profile.Execute(buffer, map[string]string{
+		"Certificate":     base64.StdEncoding.EncodeToString(caCert.Raw),
+		"CertificateUUID": uuid(fingerprint[:16]),
+		"ProfileUUID":     uuid(fingerprint[16:]),
+	}); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// CheckExpiry returns a warning for the CA, and for the certificates it issued, if they expire within ExpiryWarningPeriod.
+// Certificates mirroring a server's certificate aren't checked, since they expire along with it.
+func CheckExpiry() ([]string, error) {
+	caCert, _, err := getCaCert()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	warnings := make([]string, 0)
+	if now.After(caCert.NotAfter) {
+		warnings = append(warnings, fmt.Sprintf("The gitm CA expired on %s, rotate it and install the new one on your devices", caCert.NotAfter.Format(time.DateOnly)))
+	} else if now.Add(ExpiryWarningPeriod).After(caCert.NotAfter) {
+		warnings = append(warnings, fmt.Sprintf("The gitm CA expires on %s, rotate it and install the new one on your devices", caCert.NotAfter.Format(time.DateOnly)))
+	}
+
+	domains, err := db.GetDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	expiring := 0
+	for _, domain := range domains {
+		if domain.Upstream != "" {
+			continue
+		}
+
+		block, _ := pem.Decode(domain.Cert)
+		if block == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+
+		if now.Add(ExpiryWarningPeriod).After(cert.NotAfter) {
+			expiring++
+		}
+	}
+	if expiring > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d issued certificates expire within %d days, they are reissued automatically when they expire", expiring, int(ExpiryWarningPeriod.Hours()/24)))
+	}
+
+	return warnings, nil
+}
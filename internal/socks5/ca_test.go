@@ -0,0 +1,181 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redawl/gitm/internal/db"
+	"github.com/redawl/gitm/internal/util"
+)
+
+func TestImportExportCA(t *testing.T) {
+	useTempConfigDir(t)
+
+	original, _, err := getCaCert()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	exported, err := ExportCA(CAFormatPKCS12, "secret")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	der, err := ExportCA(CAFormatDER, "")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if !bytes.Equal(der, original.Raw) {
+		t.Errorf("DER export is not the CA certificate")
+	}
+
+	if err := RotateCA(); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if err := ImportCA(exported, "wrong"); err == nil {
+		t.Errorf("Expected an error importing with the wrong password")
+	}
+	if err := ImportCA(exported, "secret"); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	imported, _, err := getCaCert()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if !imported.Equal(original) {
+		t.Errorf("Imported CA is not the exported CA")
+	}
+
+	// A pem bundle of the certificate and its key, as written to the config dir
+	configDir, err := util.GetConfigDir()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	caPem, err := os.ReadFile(filepath.Join(configDir, caPemFile))
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	privKeyPem, err := os.ReadFile(filepath.Join(configDir, caPrivKeyFile))
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if err := ImportCA(append(caPem, privKeyPem...), ""); err != nil {
+		t.Errorf("Expected err = nil, got err = %v", err)
+	}
+	if err := ImportCA(caPem, ""); err == nil {
+		t.Errorf("Expected an error importing a CA without its private key")
+	}
+
+	// A leaf is not a CA
+	leaf, err := getCertificate([]string{"leaf.example.com"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	domains, err := db.GetDomains()
+	if err != nil || len(domains) != 1 {
+		t.Fatalf("Expected one domain, got %v, err = %v", domains, err)
+	}
+	if err := ImportCA(append(domains[0].Cert, domains[0].PrivKey...), ""); err == nil {
+		t.Errorf("Expected an error importing %s, which is not a CA", leaf.Leaf.Subject)
+	}
+
+	if _, err := ExportCA("jks", ""); err == nil {
+		t.Errorf("Expected an error exporting an unknown format")
+	}
+}
+
+func TestRotateCA(t *testing.T) {
+	useTempConfigDir(t)
+
+	oldCa, _, err := getCaCert()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if _, err := getCertificate([]string{"rotate.example.com"}, nil, nil); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	if err := RotateCA(); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	newCa, _, err := getCaCert()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if newCa.Equal(oldCa) {
+		t.Errorf("CA wasn't rotated")
+	}
+	if domains, err := db.GetDomains(); err != nil || len(domains) != 0 {
+		t.Errorf("Expected certificates issued by the old CA to be deleted, got %d, err = %v", len(domains), err)
+	}
+
+	certificate, err := getCertificate([]string{"rotate.example.com"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if err := certificate.Leaf.CheckSignatureFrom(newCa); err != nil {
+		t.Errorf("Expected certificate issued by the new CA, got err = %v", err)
+	}
+}
+
+func TestCheckExpiry(t *testing.T) {
+	useTempConfigDir(t)
+
+	warnings, err := CheckExpiry()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Expected no warnings for a new CA, got %v", warnings)
+	}
+
+	expiring := hostTemplate([]string{"expiring.example.com"}, nil)
+	expiring.NotAfter = time.Now().Add(ExpiryWarningPeriod / 2)
+	if _, err := addCertificate("expiring.example.com", "", expiring); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	// Mirrored certificates expire along with the server's certificate, so they aren't warned about
+	mirrored := hostTemplate([]string{"mirrored.example.com"}, nil)
+	mirrored.NotAfter = expiring.NotAfter
+	if _, err := addCertificate("mirrored.example.com", "0011223344556677", mirrored); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	expiringCa, caPrivKey, err := createCA()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	template := *expiringCa
+	template.NotAfter = time.Now().Add(ExpiryWarningPeriod / 2)
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, caPrivKey.Public(), caPrivKey)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if expiringCa, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	// Replace the CA without purging the expiring certificate
+	configDir, err := util.GetConfigDir()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	caMu.Lock()
+	err = writeCA(configDir, expiringCa, caPrivKey)
+	caCache = nil
+	caMu.Unlock()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	warnings, err = CheckExpiry()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if len(warnings) != 2 {
+		t.Errorf("Expected a warning for the CA and one for the issued certificate, got %v", warnings)
+	}
+}
@@ -2,25 +2,115 @@ package socks5
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/big"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/redawl/gitm/internal/db"
 	"github.com/redawl/gitm/internal/util"
 )
 
+// The files the CA is stored in, in the config dir
+const (
+	caCertFile    = "ca.crt"
+	caPemFile     = "ca.pem"
+	caPrivKeyFile = "privkey.pem"
+)
+
 // AddHostname creates a certificate for hostname, and adds it to the sqlite db stored in the config dir.
+// hostname can also be an ip, which the certificate is then issued for.
 func AddHostname(hostname string) (*db.DomainInfo, error) {
+	dnsNames, ips := hostNames(hostname)
+	return addCertificate(certificateKey(dnsNames, ips), "", hostTemplate(dnsNames, ips))
+}
+
+// getCertificate returns the certificate for dnsNames and ips from the sqlite db, creating it if it doesn't exist yet.
+//
+// If the server sent serverCerts, the certificate mirrors the names, subject and validity of the server's certificate,
+// with dnsNames and ips added if the server's certificate doesn't cover them. The stored certificate is replaced
+// once the server's certificate changes.
+//
+// Certificates are cached in memory once parsed, so only the first handshake for a host has to wait on the db.
+// Expired certificates are reissued, unless they are expired because the server's certificate is.
+func getCertificate(dnsNames []string, ips []net.IP, serverCerts []*x509.Certificate) (*tls.Certificate, error) {
+	key := certificateKey(dnsNames, ips)
+	template := hostTemplate(dnsNames, ips)
+	upstream := ""
+	if len(serverCerts) > 0 {
+		fingerprint := sha256.Sum256(serverCerts[0].Raw)
+		upstream = hex.EncodeToString(fingerprint[:])
+		template = mirrorTemplate(serverCerts[0], dnsNames, ips)
+	}
+
+	configDir, err := util.GetConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	// Each config dir has its own CA and db
+	cacheKey := configDir + "|" + key
+	if certificate := certificates.Get(cacheKey, upstream); certificate != nil && !needsReissue(certificate, template) {
+		return certificate, nil
+	}
+
+	domainInfo, err := db.GetDomain(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if domainInfo != nil {
+		certificate, err := tls.X509KeyPair(domainInfo.Cert, domainInfo.PrivKey)
+		if err == nil && domainInfo.Upstream == upstream && !needsReissue(&certificate, template) {
+			certificates.Add(cacheKey, upstream, &certificate)
+			return &certificate, nil
+		}
+
+		// addCertificate replaces the stored certificate
+		slog.Info("Reissuing certificate", "key", key, "upstreamChanged", domainInfo.Upstream != upstream, "error", err)
+	}
+
+	if domainInfo, err = addCertificate(key, upstream, template); err != nil {
+		return nil, err
+	}
+
+	certificate, err := tls.X509KeyPair(domainInfo.Cert, domainInfo.PrivKey)
+	if err != nil {
+		return nil, err
+	}
+	certificates.Add(cacheKey, upstream, &certificate)
+
+	return &certificate, nil
+}
+
+// needsReissue reports whether certificate has expired, and reissuing it from template would fix that.
+func needsReissue(certificate *tls.Certificate, template *x509.Certificate) bool {
+	now := time.Now()
+
+	return now.After(certificate.Leaf.NotAfter) && now.Before(template.NotAfter)
+}
+
+// addCertificate creates a certificate from template signed by the gitm CA, and adds it to the sqlite db stored in the config dir under key,
+// replacing the certificate stored under key before. upstream is the fingerprint of the server certificate that template mirrors, if any.
+// The names, subject and validity are taken from template. The certificate has an ECDSA P-256 key,
+// which is much faster to generate than an RSA key.
+func addCertificate(key string, upstream string, template *x509.Certificate) (*db.DomainInfo, error) {
 	ca, caPrivKey, err := getCaCert()
 	if err != nil {
 		return nil, err
@@ -34,21 +124,28 @@ func AddHostname(hostname string) (*db.DomainInfo, error) {
 	subjectKeyID := sha1.Sum(serialNumber.Bytes())
 
 	cert := &x509.Certificate{
-		SerialNumber: serialNumber,
-		Issuer:       *getName(),
-		Subject: pkix.Name{
-			CommonName: hostname,
-		}, DNSNames: []string{hostname},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(1, 0, 0),
-		SubjectKeyId: subjectKeyID[:],
+		SerialNumber:   serialNumber,
+		Issuer:         *getName(),
+		Subject:        template.Subject,
+		DNSNames:       template.DNSNames,
+		IPAddresses:    template.IPAddresses,
+		EmailAddresses: template.EmailAddresses,
+		URIs:           template.URIs,
+		NotBefore:      template.NotBefore,
+		NotAfter:       template.NotAfter,
+		SubjectKeyId:   subjectKeyID[:],
 		ExtKeyUsage: []x509.ExtKeyUsage{
 			x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth,
 		},
 		KeyUsage: x509.KeyUsageDigitalSignature,
 	}
 
-	certPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	certPrivKey, err := newLeafKey()
+	if err != nil {
+		return nil, err
+	}
+
+	certPrivKeyBytes, err := x509.MarshalECPrivateKey(certPrivKey)
 	if err != nil {
 		return nil, err
 	}
@@ -77,88 +174,207 @@ func AddHostname(hostname string) (*db.DomainInfo, error) {
 	}
 
 	if err := pem.Encode(certPrivKeyPem, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certPrivKey),
+		Type:  "EC PRIVATE KEY",
+		Bytes: certPrivKeyBytes,
 	}); err != nil {
 		return nil, err
 	}
 	domainCert := append(certPem.Bytes(), caPem.Bytes()...)
-	if err := db.AddDomain(hostname, domainCert, certPrivKeyPem.Bytes()); err != nil {
+	if err := db.AddDomain(key, upstream, domainCert, certPrivKeyPem.Bytes()); err != nil {
 		return nil, err
 	}
 
 	return &db.DomainInfo{
-		Domain:  hostname,
-		Cert:    domainCert,
-		PrivKey: certPrivKeyPem.Bytes(),
+		Domain:   key,
+		Upstream: upstream,
+		Cert:     domainCert,
+		PrivKey:  certPrivKeyPem.Bytes(),
 	}, nil
 }
 
-func getCaCert() (*x509.Certificate, *rsa.PrivateKey, error) {
+// hostTemplate is the template of a certificate for dnsNames and ips, valid for a year.
+func hostTemplate(dnsNames []string, ips []net.IP) *x509.Certificate {
+	commonName := ""
+	if len(dnsNames) > 0 {
+		commonName = dnsNames[0]
+	} else if len(ips) > 0 {
+		commonName = ips[0].String()
+	}
+
+	return &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+	}
+}
+
+// mirrorTemplate is the template of a certificate with the same names, subject and validity as serverCert.
+// dnsNames and ips are added to the names, unless serverCert already covers them (i.e. with a wildcard).
+func mirrorTemplate(serverCert *x509.Certificate, dnsNames []string, ips []net.IP) *x509.Certificate {
+	template := &x509.Certificate{
+		Subject:        serverCert.Subject,
+		DNSNames:       slices.Clone(serverCert.DNSNames),
+		IPAddresses:    slices.Clone(serverCert.IPAddresses),
+		EmailAddresses: serverCert.EmailAddresses,
+		URIs:           serverCert.URIs,
+		NotBefore:      serverCert.NotBefore,
+		NotAfter:       serverCert.NotAfter,
+	}
+	// Subject.Names are the parsed attributes, which would be copied in place of the fields
+	template.Subject.Names = nil
+
+	for _, dnsName := range dnsNames {
+		if serverCert.VerifyHostname(dnsName) != nil {
+			template.DNSNames = append(template.DNSNames, dnsName)
+		}
+	}
+	for _, ip := range ips {
+		if !slices.ContainsFunc(template.IPAddresses, ip.Equal) {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+
+	if template.Subject.CommonName == "" && len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	}
+
+	return template
+}
+
+// hostNames returns hostname as the names a certificate is issued for.
+func hostNames(hostname string) ([]string, []net.IP) {
+	if ip := net.ParseIP(hostname); ip != nil {
+		return nil, []net.IP{ip}
+	}
+
+	return []string{hostname}, nil
+}
+
+// certificateKey is the key the certificate for dnsNames and ips is stored under in the sqlite db.
+// A certificate for a single name is stored under that name.
+func certificateKey(dnsNames []string, ips []net.IP) string {
+	names := slices.Clone(dnsNames)
+	for _, ip := range ips {
+		names = append(names, ip.String())
+	}
+
+	return strings.Join(names, ",")
+}
+
+var (
+	caMu sync.Mutex
+	// caCache is the CA loaded from caCacheDir, so it isn't read and parsed for every certificate
+	caCache        *x509.Certificate
+	caCachePrivKey crypto.Signer
+	caCacheDir     string
+)
+
+// getCaCert returns the gitm CA from the config dir, creating it if it doesn't exist yet.
+func getCaCert() (*x509.Certificate, crypto.Signer, error) {
 	configDir, err := util.GetConfigDir()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	certLocation := filepath.Join(configDir, "ca.crt")
+	caMu.Lock()
+	defer caMu.Unlock()
 
-	if _, err := os.Stat(certLocation); errors.Is(err, os.ErrNotExist) {
-		serialNumber, err := createSerialNumber()
-		if err != nil {
-			return nil, nil, err
-		}
-
-		ca := &x509.Certificate{
-			SerialNumber: serialNumber,
-			Subject:      *getName(),
-			NotBefore:    time.Now(),
-			NotAfter:     time.Now().AddDate(1, 0, 0),
-			IsCA:         true,
-			ExtKeyUsage: []x509.ExtKeyUsage{
-				x509.ExtKeyUsageServerAuth,
-			},
-			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-			BasicConstraintsValid: true,
-		}
+	if caCache != nil && caCacheDir == configDir {
+		return caCache, caCachePrivKey, nil
+	}
 
-		caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if _, err := os.Stat(filepath.Join(configDir, caCertFile)); errors.Is(err, os.ErrNotExist) {
+		caCert, caPrivKey, err := createCA()
 		if err != nil {
 			return nil, nil, err
 		}
-
-		caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivKey.PublicKey, caPrivKey)
-		if err != nil {
+		if err := writeCA(configDir, caCert, caPrivKey); err != nil {
 			return nil, nil, err
 		}
+	}
 
-		caPem := new(bytes.Buffer)
-		caPrivKeyPem := new(bytes.Buffer)
-		if err := pem.Encode(caPem, &pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: caBytes,
-		}); err != nil {
-			return nil, nil, err
-		}
+	caCert, privKey, err := loadCA(configDir)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if err := pem.Encode(caPrivKeyPem, &pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(caPrivKey),
-		}); err != nil {
-			return nil, nil, err
-		}
+	caCache, caCachePrivKey, caCacheDir = caCert, privKey, configDir
 
-		if err := os.WriteFile(filepath.Join(configDir, "ca.crt"), caBytes, 0o400); err != nil {
-			return nil, nil, err
-		}
-		if err := os.WriteFile(filepath.Join(configDir, "ca.pem"), caPem.Bytes(), 0o400); err != nil {
-			return nil, nil, err
+	return caCert, privKey, nil
+}
+
+// createCA creates a new self signed CA, valid for a year.
+func createCA() (*x509.Certificate, crypto.Signer, error) {
+	serialNumber, err := createSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      *getName(),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		IsCA:         true,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+		},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivKey.PublicKey, caPrivKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caCert, err := x509.ParseCertificate(caBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return caCert, caPrivKey, nil
+}
+
+// writeCA writes the CA to the config dir, replacing the existing one.
+func writeCA(configDir string, caCert *x509.Certificate, caPrivKey crypto.Signer) error {
+	privKeyBytes, err := x509.MarshalPKCS8PrivateKey(caPrivKey)
+	if err != nil {
+		return fmt.Errorf("marshalling ca private key: %w", err)
+	}
+
+	files := map[string][]byte{
+		caCertFile:    caCert.Raw,
+		caPemFile:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}),
+		caPrivKeyFile: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privKeyBytes}),
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(configDir, name)
+		// The files are read only, so they can't be written over
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
 		}
-		if err := os.WriteFile(filepath.Join(configDir, "privkey.pem"), caPrivKeyPem.Bytes(), 0o400); err != nil {
-			return nil, nil, err
+		if err := os.WriteFile(path, contents, 0o400); err != nil {
+			return err
 		}
 	}
 
-	caPem, err := os.ReadFile(filepath.Join(configDir, "ca.pem"))
+	return nil
+}
+
+// loadCA reads the CA from the config dir.
+func loadCA(configDir string) (*x509.Certificate, crypto.Signer, error) {
+	caPem, err := os.ReadFile(filepath.Join(configDir, caPemFile))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -169,7 +385,7 @@ func getCaCert() (*x509.Certificate, *rsa.PrivateKey, error) {
 		return nil, nil, fmt.Errorf("parsing ca.pem, leftover bytes")
 	}
 
-	privKeyPem, err := os.ReadFile(filepath.Join(configDir, "/privkey.pem"))
+	privKeyPem, err := os.ReadFile(filepath.Join(configDir, caPrivKeyFile))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -185,7 +401,7 @@ func getCaCert() (*x509.Certificate, *rsa.PrivateKey, error) {
 		return nil, nil, err
 	}
 
-	privKey, err := x509.ParsePKCS1PrivateKey(privKeyBlock.Bytes)
+	privKey, err := parsePrivateKey(privKeyBlock.Bytes)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -193,6 +409,28 @@ func getCaCert() (*x509.Certificate, *rsa.PrivateKey, error) {
 	return caCert, privKey, nil
 }
 
+// parsePrivateKey parses a DER encoded PKCS #1, PKCS #8 or SEC 1 (EC) private key.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return signer, nil
+}
+
 func createSerialNumber() (*big.Int, error) {
 	return rand.Int(rand.Reader, big.NewInt(999999999999999999))
 }
@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMirrorTemplate(t *testing.T) {
+	serverCert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "example.com", Organization: []string{"Example Inc"}},
+		DNSNames:    []string{"example.com", "*.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+		NotBefore:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		host     string
+		dnsNames []string
+		ips      []string
+	}{
+		{"example.com", []string{"example.com", "*.example.com"}, []string{"10.0.0.1", "10.0.0.2"}},
+		// Covered by the wildcard
+		{"www.example.com", []string{"example.com", "*.example.com"}, []string{"10.0.0.1", "10.0.0.2"}},
+		{"other.com", []string{"example.com", "*.example.com", "other.com"}, []string{"10.0.0.1", "10.0.0.2"}},
+		{"10.0.0.1", []string{"example.com", "*.example.com"}, []string{"10.0.0.1", "10.0.0.2"}},
+		{"10.0.0.3", []string{"example.com", "*.example.com"}, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+	}
+
+	for _, test := range tests {
+		dnsNames, ips := hostNames(test.host)
+		template := mirrorTemplate(serverCert, dnsNames, ips)
+		templateIPs := make([]string, 0, len(template.IPAddresses))
+		for _, ip := range template.IPAddresses {
+			templateIPs = append(templateIPs, ip.String())
+		}
+
+		if !slices.Equal(template.DNSNames, test.dnsNames) || !slices.Equal(templateIPs, test.ips) {
+			t.Errorf("mirrorTemplate(%s) names = %v, %v, want %v, %v", test.host, template.DNSNames, templateIPs, test.dnsNames, test.ips)
+		}
+		if template.Subject.String() != serverCert.Subject.String() {
+			t.Errorf("mirrorTemplate(%s).Subject = %s, want %s", test.host, template.Subject, serverCert.Subject)
+		}
+		if !template.NotBefore.Equal(serverCert.NotBefore) || !template.NotAfter.Equal(serverCert.NotAfter) {
+			t.Errorf("mirrorTemplate(%s) validity = %s - %s, want %s - %s", test.host, template.NotBefore, template.NotAfter, serverCert.NotBefore, serverCert.NotAfter)
+		}
+	}
+
+	// The slices of serverCert must not be modified
+	if len(serverCert.DNSNames) != 2 || len(serverCert.IPAddresses) != 2 {
+		t.Errorf("mirrorTemplate modified the server certificate's names")
+	}
+}
+
+func TestCertificateKey(t *testing.T) {
+	// Certificates for a single hostname keep the key they had before ips were supported
+	if key := certificateKey(hostNames("example.com")); key != "example.com" {
+		t.Errorf("certificateKey(example.com) = %s, want example.com", key)
+	}
+
+	if key := certificateKey([]string{"example.com"}, []net.IP{net.ParseIP("10.0.0.1")}); key != "example.com,10.0.0.1" {
+		t.Errorf("certificateKey(example.com, 10.0.0.1) = %s, want example.com,10.0.0.1", key)
+	}
+}
@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"log/slog"
+	"sync"
+)
+
+// certificateCacheSize is the number of parsed certificates kept in memory
+const certificateCacheSize = 1024
+
+// keyPoolSize is the number of leaf keys generated ahead of time
+const keyPoolSize = 16
+
+// certificates are the most recently used forged certificates, so that they
+// don't have to be read from the db and parsed on every handshake.
+var certificates = newCertificateCache(certificateCacheSize)
+
+// certificateCache is a least recently used cache of parsed certificates.
+type certificateCache struct {
+	mu       sync.Mutex
+	capacity int
+	// order has the most recently used entry at the front
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type certificateCacheEntry struct {
+	key string
+	// upstream is the fingerprint of the server certificate that certificate mirrors, if any
+	upstream    string
+	certificate *tls.Certificate
+}
+
+func newCertificateCache(capacity int) *certificateCache {
+	return &certificateCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the certificate stored under key, or nil if there isn't one, or it doesn't mirror upstream.
+func (c *certificateCache) Get(key string, upstream string) *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element := c.entries[key]
+	if element == nil {
+		return nil
+	}
+	c.order.MoveToFront(element)
+
+	entry := element.Value.(*certificateCacheEntry)
+	if entry.upstream != upstream {
+		return nil
+	}
+
+	return entry.certificate
+}
+
+// Add stores certificate mirroring upstream under key, replacing the certificate stored under it before,
+// and evicting the least recently used certificate if the cache is full.
+func (c *certificateCache) Add(key string, upstream string, certificate *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element := c.entries[key]; element != nil {
+		entry := element.Value.(*certificateCacheEntry)
+		entry.upstream, entry.certificate = upstream, certificate
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&certificateCacheEntry{key: key, upstream: upstream, certificate: certificate})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*certificateCacheEntry).key)
+	}
+}
+
+// Remove removes the certificate stored under key, if there is one.
+func (c *certificateCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element := c.entries[key]; element != nil {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// Clear removes every certificate from the cache.
+func (c *certificateCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	clear(c.entries)
+}
+
+var (
+	keyPoolOnce sync.Once
+	keyPool     = make(chan *ecdsa.PrivateKey, keyPoolSize)
+)
+
+// newLeafKey returns a new private key for a forged certificate.
+// Keys are generated in the background ahead of time, so a handshake rarely has to wait for one.
+func newLeafKey() (*ecdsa.PrivateKey, error) {
+	keyPoolOnce.Do(func() {
+		go fillKeyPool()
+	})
+
+	select {
+	case key := <-keyPool:
+		return key, nil
+	default:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+}
+
+// fillKeyPool keeps keyPool full, for as long as the program runs.
+func fillKeyPool() {
+	for {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			slog.Error("Error generating pooled key", "error", err)
+			return
+		}
+		keyPool <- key
+	}
+}
@@ -0,0 +1,151 @@
+package socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fyne.io/fyne/v2/test"
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// useTempConfigDir points the config dir, and so the CA and db, at a temporary directory for the rest of the test.
+func useTempConfigDir(tb testing.TB) {
+	tb.Helper()
+
+	app := test.NewTempApp(tb)
+	app.Preferences().SetString(internal.ConfigDir, tb.TempDir())
+	if err := InitCaCert(); err != nil {
+		tb.Fatalf("Expected err = nil, got err = %v", err)
+	}
+}
+
+func TestCertificateCache(t *testing.T) {
+	cache := newCertificateCache(2)
+	one, two, three := &tls.Certificate{}, &tls.Certificate{}, &tls.Certificate{}
+
+	cache.Add("one", "", one)
+	cache.Add("two", "", two)
+	// one is now the most recently used, so two is evicted
+	if cache.Get("one", "") != one {
+		t.Errorf("cache.Get(one) is not the certificate added")
+	}
+	cache.Add("three", "upstream", three)
+
+	if cache.Get("two", "") != nil {
+		t.Errorf("cache.Get(two) != nil, want it evicted")
+	}
+	if cache.Get("one", "") != one || cache.Get("three", "upstream") != three {
+		t.Errorf("cache lost a recently used certificate")
+	}
+	if cache.Get("three", "other upstream") != nil {
+		t.Errorf("cache.Get(three) != nil for another upstream certificate")
+	}
+
+	cache.Clear()
+	if cache.Get("one", "") != nil {
+		t.Errorf("cache.Get(one) != nil after Clear")
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	useTempConfigDir(t)
+
+	dnsNames, ips := hostNames("cached.example.com")
+	certificate, err := getCertificate(dnsNames, ips, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	if _, ok := certificate.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("certificate.PrivateKey is %T, want *ecdsa.PrivateKey", certificate.PrivateKey)
+	}
+	if err := certificate.Leaf.VerifyHostname("cached.example.com"); err != nil {
+		t.Errorf("Expected err = nil, got err = %v", err)
+	}
+
+	cached, err := getCertificate(dnsNames, ips, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if cached != certificate {
+		t.Errorf("getCertificate didn't return the cached certificate")
+	}
+
+	// A certificate already in the db is loaded after the cache is cleared
+	certificates.Clear()
+	loaded, err := getCertificate(dnsNames, ips, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if !loaded.Leaf.Equal(certificate.Leaf) {
+		t.Errorf("getCertificate issued a new certificate instead of loading it from the db")
+	}
+}
+
+// BenchmarkInterceptTLSHandshake measures how long the client waits for the tls handshake with gitm to complete,
+// including the handshake with the server.
+func BenchmarkInterceptTLSHandshake(b *testing.B) {
+	useTempConfigDir(b)
+
+	// Every connection logs that it isn't http
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer slog.SetDefault(logger)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer listener.Close() //nolint:errcheck
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close() //nolint:errcheck
+				server, err := net.Dial("tcp", server.Listener.Addr().String())
+				if err != nil {
+					return
+				}
+				defer server.Close() //nolint:errcheck
+				_ = interceptTLS(client, server, &internal.Config{}, "127.0.0.1", packet.ConnInfo{}, func(packet.Packet) {})
+			}()
+		}
+	}()
+
+	handshake := func(b *testing.B, serverName string) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			b.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		conn.Close() //nolint:errcheck
+	}
+
+	b.Run("new host", func(b *testing.B) {
+		for i := range b.N {
+			handshake(b, fmt.Sprintf("host%d.example.com", i))
+		}
+	})
+
+	b.Run("cached host", func(b *testing.B) {
+		handshake(b, "cached.example.com")
+		b.ResetTimer()
+		for range b.N {
+			handshake(b, "cached.example.com")
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redawl/gitm/internal/db"
+	"github.com/redawl/gitm/internal/util"
+)
+
+// CertificateInfo describes a forged certificate stored in the sqlite db.
+type CertificateInfo struct {
+	// Key is what the certificate is stored under in the db
+	Key string
+	// Domain is the host the certificate was issued for
+	Domain string
+	// Mirrored is whether the certificate mirrors a server's certificate
+	Mirrored bool
+	// SANs are the dns names and ips the certificate is valid for
+	SANs      []string
+	NotBefore time.Time
+	NotAfter  time.Time
+	KeyType   string
+	// IssuedByCA is whether the certificate was issued by the current gitm CA
+	IssuedByCA bool
+	// PEM is the certificate chain, as stored in the db
+	PEM string
+	// Error is why the certificate couldn't be parsed
+	Error string
+}
+
+// Expired reports whether the certificate has expired.
+func (c CertificateInfo) Expired() bool {
+	return time.Now().After(c.NotAfter)
+}
+
+// ListCertificates returns every forged certificate in the sqlite db.
+func ListCertificates() ([]CertificateInfo, error) {
+	ca, _, err := getCaCert()
+	if err != nil {
+		return nil, err
+	}
+
+	domains, err := db.GetDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]CertificateInfo, 0, len(domains))
+	for _, domain := range domains {
+		info := CertificateInfo{
+			Key:      domain.Domain,
+			Domain:   domain.Domain,
+			Mirrored: domain.Upstream != "",
+			PEM:      string(domain.Cert),
+		}
+
+		certificate, err := tls.X509KeyPair(domain.Cert, domain.PrivKey)
+		if err != nil {
+			info.Error = err.Error()
+			infos = append(infos, info)
+			continue
+		}
+
+		leaf := certificate.Leaf
+		info.SANs = append(info.SANs, leaf.DNSNames...)
+		for _, ip := range leaf.IPAddresses {
+			info.SANs = append(info.SANs, ip.String())
+		}
+		info.NotBefore = leaf.NotBefore
+		info.NotAfter = leaf.NotAfter
+		info.KeyType = keyType(leaf)
+		info.IssuedByCA = leaf.CheckSignatureFrom(ca) == nil
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// keyType describes the public key of cert, i.e. "ECDSA P-256" or "RSA 2048".
+func keyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+// DeleteCertificate deletes the certificate stored under key.
+// A new certificate is issued the next time the host is intercepted.
+func DeleteCertificate(key string) error {
+	if err := db.DeleteDomain(key); err != nil {
+		return fmt.Errorf("deleting certificate %s: %w", key, err)
+	}
+
+	return forgetCertificate(key)
+}
+
+// ReissueCertificate replaces the certificate stored under key with a new one, signed by the current gitm CA.
+// The new certificate has the same names, and a mirrored certificate keeps the validity of the server's certificate.
+func ReissueCertificate(key string) error {
+	domain, err := db.GetDomain(key)
+	if err != nil {
+		return err
+	}
+	if domain == nil {
+		return fmt.Errorf("no certificate stored under %s", key)
+	}
+
+	certificate, err := tls.X509KeyPair(domain.Cert, domain.PrivKey)
+	if err != nil {
+		return fmt.Errorf("parsing certificate %s: %w", key, err)
+	}
+
+	template := hostTemplate(certificate.Leaf.DNSNames, certificate.Leaf.IPAddresses)
+	if domain.Upstream != "" {
+		template = mirrorTemplate(certificate.Leaf, nil, nil)
+	}
+
+	// The old certificate is only replaced once the new one is issued, so a failure keeps it
+	if _, err := addCertificate(key, domain.Upstream, template); err != nil {
+		return fmt.Errorf("reissuing certificate %s: %w", key, err)
+	}
+
+	return forgetCertificate(key)
+}
+
+// PruneCertificates deletes the certificates that weren't issued by the current gitm CA, or can't be parsed,
+// and returns how many were deleted.
+func PruneCertificates() (int, error) {
+	infos, err := ListCertificates()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, certificate := range infos {
+		if certificate.IssuedByCA && certificate.Error == "" {
+			continue
+		}
+
+		slog.Info("Pruning certificate", "key", certificate.Key, "error", certificate.Error)
+		if err := DeleteCertificate(certificate.Key); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}
+
+// forgetCertificate removes the certificate stored under key from the in memory cache.
+func forgetCertificate(key string) error {
+	configDir, err := util.GetConfigDir()
+	if err != nil {
+		return err
+	}
+
+	certificates.Remove(configDir + "|" + key)
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package socks5
+
+import (
+	"crypto/x509"
+	"slices"
+	"testing"
+
+	"github.com/redawl/gitm/internal/db"
+)
+
+func TestListCertificates(t *testing.T) {
+	useTempConfigDir(t)
+
+	if _, err := getCertificate([]string{"list.example.com"}, nil, nil); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	serverCert := hostTemplate([]string{"*.example.com"}, nil)
+	if _, err := getCertificate([]string{"mirror.example.com"}, nil, []*x509.Certificate{serverCert}); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if err := db.AddDomain("broken.example.com", "", []byte("not a certificate"), nil); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	certificates, err := ListCertificates()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if len(certificates) != 3 {
+		t.Fatalf("len(certificates) = %d, expected 3", len(certificates))
+	}
+
+	for _, certificate := range certificates {
+		switch certificate.Domain {
+		case "list.example.com":
+			if certificate.Mirrored || !certificate.IssuedByCA || certificate.KeyType != "ECDSA P-256" || !slices.Equal(certificate.SANs, []string{"list.example.com"}) {
+				t.Errorf("Unexpected certificate %+v", certificate)
+			}
+		case "mirror.example.com":
+			if !certificate.Mirrored || !slices.Equal(certificate.SANs, []string{"*.example.com"}) {
+				t.Errorf("Unexpected mirrored certificate %+v", certificate)
+			}
+		case "broken.example.com":
+			if certificate.Error == "" {
+				t.Errorf("Expected an error for the broken certificate")
+			}
+		default:
+			t.Errorf("Unexpected certificate for %s", certificate.Domain)
+		}
+	}
+
+	pruned, err := PruneCertificates()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if pruned != 1 {
+		t.Errorf("pruned = %d, expected only the broken certificate", pruned)
+	}
+}
+
+func TestDeleteAndReissueCertificate(t *testing.T) {
+	useTempConfigDir(t)
+
+	original, err := getCertificate([]string{"reissue.example.com"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	if err := ReissueCertificate("reissue.example.com"); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	reissued, err := getCertificate([]string{"reissue.example.com"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if reissued.Leaf.Equal(original.Leaf) {
+		t.Errorf("Expected a new certificate after reissuing")
+	}
+	if !slices.Equal(reissued.Leaf.DNSNames, original.Leaf.DNSNames) {
+		t.Errorf("reissued.DNSNames = %v, expected %v", reissued.Leaf.DNSNames, original.Leaf.DNSNames)
+	}
+
+	if err := DeleteCertificate("reissue.example.com"); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if domain, err := db.GetDomain("reissue.example.com"); err != nil || domain != nil {
+		t.Errorf("Expected certificate to be deleted, got %v, err = %v", domain, err)
+	}
+
+	if err := ReissueCertificate("missing.example.com"); err == nil {
+		t.Errorf("Expected an error reissuing a certificate that doesn't exist")
+	}
+}
+
+func TestMirroredCertificateReplaced(t *testing.T) {
+	useTempConfigDir(t)
+
+	dnsNames, ips := hostNames("renewed.example.com")
+	serverCert := hostTemplate(dnsNames, ips)
+	serverCert.Raw = []byte("old server certificate")
+	original, err := getCertificate(dnsNames, ips, []*x509.Certificate{serverCert})
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	// The server renews its certificate
+	renewedCert := hostTemplate(dnsNames, ips)
+	renewedCert.Raw = []byte("renewed server certificate")
+	renewed, err := getCertificate(dnsNames, ips, []*x509.Certificate{renewedCert})
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if renewed.Leaf.Equal(original.Leaf) {
+		t.Errorf("Expected a new certificate for the renewed server certificate")
+	}
+
+	domains, err := db.GetDomains()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if len(domains) != 1 || domains[0].Domain != "renewed.example.com" || domains[0].Upstream == "" {
+		t.Errorf("Expected one mirrored certificate for renewed.example.com, got %+v", domains)
+	}
+}
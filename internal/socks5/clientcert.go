@@ -0,0 +1,41 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+
+	"github.com/redawl/gitm/internal"
+)
+
+// clientCertificate loads the client certificate configured for host, the server name the client sent,
+// or the host it asked to connect to when it sent none.
+// nil is returned if no client certificate is configured for host.
+//
+// Each of conf.ClientCertificates is "host=file", where file is a pem file with the certificate chain
+// and its private key, and host is matched like the upstream proxy bypass rules.
+//
+// The client is asked for a certificate too when the server asks for one, so that it is recorded,
+// but it can't be passed on to the server without its private key.
+func clientCertificate(conf *internal.Config, host string) (*tls.Certificate, error) {
+	for _, entry := range conf.ClientCertificates {
+		certHost, file, found := internal.SplitClientCertificate(entry)
+		if !found {
+			slog.Error("Invalid client certificate, must be host=file", "entry", entry)
+			continue
+		}
+
+		if !matchesHost(host, []string{certHost}) {
+			continue
+		}
+
+		cert, err := tls.LoadX509KeyPair(file, file)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate for %s: %w", certHost, err)
+		}
+
+		return &cert, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,167 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+)
+
+// writeClientCertificate creates a self signed client certificate, and writes it with its key to a pem file.
+func writeClientCertificate(t *testing.T, commonName string) (*x509.Certificate, tls.Certificate, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	file := filepath.Join(t.TempDir(), commonName+".pem")
+	if err := os.WriteFile(file, append(certPEM, keyPEM...), 0o600); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	return cert, keyPair, file
+}
+
+func TestInterceptTLSClientCertificate(t *testing.T) {
+	gitmCert, _, gitmFile := writeClientCertificate(t, "gitm")
+	clientCert, clientKeyPair, _ := writeClientCertificate(t, "client")
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "gitm" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(gitmCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &internal.Config{ClientCertificates: []string{"other.com=/does/not/exist", "example.com=" + gitmFile}}
+	handler, wait := collectPackets()
+	listener, roots := interceptTLSTo(t, server, conf, handler)
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientKeyPair}},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, listener.Addr().String())
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Get("https://example.com/mtls")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("resp.StatusCode = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	p := wait(t, 1)["/mtls"]
+	if p == nil || p.TLS == nil {
+		t.Fatalf("Expected a packet with tls metadata, got %v", p)
+	}
+	if !p.TLS.ClientCertificateRequested {
+		t.Errorf("TLS.ClientCertificateRequested = false, want true")
+	}
+	if !bytes.Equal(p.TLS.PresentedCertificate, gitmCert.Raw) {
+		t.Errorf("TLS.PresentedCertificate is not the configured certificate")
+	}
+	if len(p.TLS.ClientCertificates) != 1 || !bytes.Equal(p.TLS.ClientCertificates[0], clientCert.Raw) {
+		t.Errorf("TLS.ClientCertificates = %d certificates, want the client's certificate", len(p.TLS.ClientCertificates))
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	_, _, file := writeClientCertificate(t, "gitm")
+	conf := &internal.Config{ClientCertificates: []string{"api.example.com=" + file, "broken.com=/does/not/exist"}}
+
+	tests := map[string]bool{
+		"api.example.com":    true,
+		"v1.api.example.com": true,
+		"example.com":        false,
+		"":                   false,
+	}
+	for serverName, expected := range tests {
+		cert, err := clientCertificate(conf, serverName)
+		if err != nil {
+			t.Errorf("Expected err = nil, got err = %v", err)
+		}
+		if (cert != nil) != expected {
+			t.Errorf("clientCertificate(%q) = %v, want a certificate %v", serverName, cert, expected)
+		}
+	}
+
+	if _, err := clientCertificate(conf, "broken.com"); err == nil {
+		t.Errorf("clientCertificate(broken.com) = nil error, want error")
+	}
+}
+
+func TestClientCertificateEntries(t *testing.T) {
+	_, _, file := writeClientCertificate(t, "gitm")
+	windowsFile := `C:\certs\client.pem`
+	conf := &internal.Config{ClientCertificates: []string{"::1=" + file, "fd00::/8=" + file, "windows.example.com=" + windowsFile}}
+
+	for _, host := range []string{"::1", "fd00::2"} {
+		if cert, err := clientCertificate(conf, host); err != nil || cert == nil {
+			t.Errorf("clientCertificate(%q) = %v, %v, want a certificate", host, cert, err)
+		}
+	}
+	if cert, err := clientCertificate(conf, "::2"); err != nil || cert != nil {
+		t.Errorf("clientCertificate(::2) = %v, %v, want no certificate", cert, err)
+	}
+
+	// The drive letter stays part of the file
+	if host, file, found := internal.SplitClientCertificate(conf.ClientCertificates[2]); !found || host != "windows.example.com" || file != windowsFile {
+		t.Errorf("SplitClientCertificate(...) = %q, %q, %v, want windows.example.com, %s", host, file, found, windowsFile)
+	}
+	if _, err := clientCertificate(conf, "windows.example.com"); err == nil || !strings.Contains(err.Error(), windowsFile) {
+		t.Errorf("Expected an error loading %s, got err = %v", windowsFile, err)
+	}
+}
@@ -0,0 +1,227 @@
+package socks5
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// tlsFingerprints fingerprints the ClientHello and ServerHello handshake messages of a connection.
+// Either message can be nil if it wasn't seen, in which case its fingerprints are left empty.
+// nil is returned when neither message could be fingerprinted.
+//
+// The hellos are recorded as they are relayed, both by interceptTLS and passthroughTLS,
+// and the fingerprints end up in the ConnInfo of the connection's packets.
+func tlsFingerprints(clientHelloMessage []byte, serverHelloMessage []byte) *packet.TLSFingerprints {
+	fingerprints := &packet.TLSFingerprints{}
+
+	if clientHelloMessage != nil {
+		if hello, err := parseClientHello(clientHelloMessage); err != nil {
+			slog.Debug("Error parsing ClientHello for fingerprinting", "error", err)
+		} else {
+			fingerprints.JA3 = ja3(hello)
+			fingerprints.JA4 = ja4(hello)
+		}
+	}
+
+	if serverHelloMessage != nil {
+		if hello, err := parseServerHello(serverHelloMessage); err != nil {
+			slog.Debug("Error parsing ServerHello for fingerprinting", "error", err)
+		} else {
+			fingerprints.JA3S = ja3s(hello)
+			fingerprints.JA4S = ja4s(hello)
+		}
+	}
+
+	if *fingerprints == (packet.TLSFingerprints{}) {
+		return nil
+	}
+
+	return fingerprints
+}
+
+// ja3 returns the JA3 fingerprint of hello: the md5 of its version, cipher suites, extensions, groups and point formats.
+func ja3(hello *clientHello) string {
+	pointFormats := make([]uint16, 0, len(hello.pointFormats))
+	for _, pointFormat := range hello.pointFormats {
+		pointFormats = append(pointFormats, uint16(pointFormat))
+	}
+
+	fields := []string{
+		strconv.Itoa(int(hello.version)),
+		joinDecimal(hello.cipherSuites),
+		joinDecimal(hello.extensions),
+		joinDecimal(hello.supportedGroups),
+		joinDecimal(pointFormats),
+	}
+	hash := md5.Sum([]byte(strings.Join(fields, ",")))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// ja3s returns the JA3S fingerprint of hello: the md5 of its version, cipher suite and extensions.
+func ja3s(hello *serverHello) string {
+	fields := []string{
+		strconv.Itoa(int(hello.version)),
+		strconv.Itoa(int(hello.cipherSuite)),
+		joinDecimal(hello.extensions),
+	}
+	hash := md5.Sum([]byte(strings.Join(fields, ",")))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// ja4 returns the JA4 fingerprint of hello, i.e. "t13d1516h2_8daaf6152771_e5627efa2ab1".
+//
+// The first part describes the hello: the version, whether it has a server name, the number of
+// cipher suites and extensions, and the first alpn protocol. The second part is the hash of the sorted cipher suites,
+// and the third the hash of the sorted extensions, followed by the signature algorithms.
+func ja4(hello *clientHello) string {
+	cipherSuites := withoutGREASE(hello.cipherSuites)
+	extensions := withoutGREASE(hello.extensions)
+
+	version := hello.version
+	if supportedVersions := withoutGREASE(hello.supportedVersions); len(supportedVersions) > 0 {
+		version = slices.Max(supportedVersions)
+	}
+
+	serverName := "i"
+	if slices.Contains(extensions, extensionServerName) {
+		serverName = "d"
+	}
+
+	alpn := ""
+	if len(hello.alpnProtocols) > 0 {
+		alpn = hello.alpnProtocols[0]
+	}
+
+	// The server name and alpn are already part of the first part, so only the other extensions are hashed
+	hashedExtensions := slices.DeleteFunc(slices.Clone(extensions), func(extension uint16) bool {
+		return extension == extensionServerName || extension == extensionALPN
+	})
+	slices.Sort(hashedExtensions)
+	extensionsHash := "000000000000"
+	if len(extensions) > 0 {
+		extensionsString := joinHex(hashedExtensions)
+		if signatureAlgorithms := withoutGREASE(hello.signatureAlgorithms); len(signatureAlgorithms) > 0 {
+			extensionsString += "_" + joinHex(signatureAlgorithms)
+		}
+		extensionsHash = truncatedHash(extensionsString)
+	}
+
+	cipherSuitesHash := "000000000000"
+	if len(cipherSuites) > 0 {
+		sortedCipherSuites := slices.Clone(cipherSuites)
+		slices.Sort(sortedCipherSuites)
+		cipherSuitesHash = truncatedHash(joinHex(sortedCipherSuites))
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		ja4Version(version), serverName, min(len(cipherSuites), 99), min(len(extensions), 99), ja4ALPN(alpn),
+		cipherSuitesHash, extensionsHash)
+}
+
+// ja4s returns the JA4S fingerprint of hello, i.e. "t130200_1301_234ea6891581".
+//
+// The first part describes the hello: the version, the number of extensions and the alpn protocol.
+// The second part is the cipher suite, and the third the hash of the extensions, in the order they were sent.
+func ja4s(hello *serverHello) string {
+	extensions := withoutGREASE(hello.extensions)
+
+	version := hello.version
+	if hello.supportedVersion != 0 {
+		version = hello.supportedVersion
+	}
+
+	extensionsHash := "000000000000"
+	if len(extensions) > 0 {
+		extensionsHash = truncatedHash(joinHex(extensions))
+	}
+
+	return fmt.Sprintf("t%s%02d%s_%04x_%s",
+		ja4Version(version), min(len(extensions), 99), ja4ALPN(hello.alpnProtocol), hello.cipherSuite, extensionsHash)
+}
+
+// ja4Version returns the two characters JA4 uses for a tls version.
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the two characters JA4 uses for an alpn protocol: its first and last characters,
+// or the first and last characters of its hex encoding if either of those isn't alphanumeric.
+func ja4ALPN(alpn string) string {
+	if alpn == "" {
+		return "00"
+	}
+
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		encoded := hex.EncodeToString([]byte(alpn))
+		return encoded[:1] + encoded[len(encoded)-1:]
+	}
+
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isGREASE returns whether value is one of the reserved GREASE values (RFC 8701),
+// which clients send at random to keep servers tolerant of unknown values.
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+// joinDecimal joins values in decimal with "-", leaving out GREASE values, as JA3 does.
+func joinDecimal(values []uint16) string {
+	strs := make([]string, 0, len(values))
+	for _, value := range withoutGREASE(values) {
+		strs = append(strs, strconv.Itoa(int(value)))
+	}
+
+	return strings.Join(strs, "-")
+}
+
+// joinHex joins values as 4 digit hex with ",", as JA4 does.
+func joinHex(values []uint16) string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		strs = append(strs, fmt.Sprintf("%04x", value))
+	}
+
+	return strings.Join(strs, ",")
+}
+
+// truncatedHash returns the first 12 characters of the hex encoded sha256 of s, as JA4 does.
+func truncatedHash(s string) string {
+	hash := sha256.Sum256([]byte(s))
+
+	return hex.EncodeToString(hash[:])[:12]
+}
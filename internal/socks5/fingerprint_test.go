@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+func TestJA4(t *testing.T) {
+	// The example from the JA4 specification, with GREASE values added
+	hello := &clientHello{
+		version: 0x0303,
+		cipherSuites: []uint16{
+			0x1a1a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		extensions: []uint16{
+			0x2a2a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005,
+			0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x0015, 0x4469,
+		},
+		signatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		alpnProtocols:       []string{"h2", "http/1.1"},
+		supportedVersions:   []uint16{0x3a3a, 0x0304, 0x0303},
+	}
+
+	if actual, expected := ja4(hello), "t13d1516h2_8daaf6152771_e5627efa2ab1"; actual != expected {
+		t.Errorf("Expected ja4 = %s, got ja4 = %s", expected, actual)
+	}
+
+	// No extensions at all
+	if actual, expected := ja4(&clientHello{version: 0x0301, cipherSuites: []uint16{0x002f}}), "t10i010000_"; !strings.HasPrefix(actual, expected) || !strings.HasSuffix(actual, "_000000000000") {
+		t.Errorf("Expected ja4 = %s..._000000000000, got ja4 = %s", expected, actual)
+	}
+}
+
+func TestJA3(t *testing.T) {
+	hello := &clientHello{
+		version:         0x0303,
+		cipherSuites:    []uint16{0x0a0a, 0x1301, 0x1302},
+		extensions:      []uint16{0xfafa, 0x0000, 0x000a, 0x000b},
+		supportedGroups: []uint16{0x8a8a, 29, 23},
+		pointFormats:    []uint8{0},
+	}
+	hash := md5.Sum([]byte("771,4865-4866,0-10-11,29-23,0"))
+
+	if actual, expected := ja3(hello), hex.EncodeToString(hash[:]); actual != expected {
+		t.Errorf("Expected ja3 = %s, got ja3 = %s", expected, actual)
+	}
+}
+
+func TestJA4S(t *testing.T) {
+	hello := &serverHello{
+		version:          0x0303,
+		cipherSuite:      0x1301,
+		extensions:       []uint16{0x002b, 0x0033},
+		supportedVersion: 0x0304,
+	}
+
+	if actual, expected := ja4s(hello), "t130200_1301_a56c5b993250"; actual != expected {
+		t.Errorf("Expected ja4s = %s, got ja4s = %s", expected, actual)
+	}
+
+	hello.alpnProtocol = "h2"
+	if actual := ja4s(hello); !strings.HasPrefix(actual, "t1302h2_") {
+		t.Errorf("Expected ja4s to include the alpn protocol, got ja4s = %s", actual)
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	for alpn, expected := range map[string]string{
+		"":         "00",
+		"h2":       "h2",
+		"http/1.1": "h1",
+		"x":        "xx",
+		"\xab\xcd": "ad",
+	} {
+		if actual := ja4ALPN(alpn); actual != expected {
+			t.Errorf("ja4ALPN(%q) = %s, expected %s", alpn, actual, expected)
+		}
+	}
+}
+
+func TestInterceptTLSFingerprints(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	handler, wait := collectPackets()
+	listener, roots := interceptTLSTo(t, server, &internal.Config{}, handler)
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, listener.Addr().String())
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := http.Client{Transport: transport}
+
+	resp, err := client.Get("https://example.com/fingerprinted")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	_ = resp.Body.Close()
+
+	httpPacket := wait(t, 1)["/fingerprinted"]
+	if httpPacket == nil || httpPacket.Fingerprints == nil {
+		t.Fatalf("Expected a fingerprinted packet, got %+v", httpPacket)
+	}
+	fingerprints := httpPacket.Fingerprints
+	if len(fingerprints.JA3) != 32 || len(fingerprints.JA3S) != 32 {
+		t.Errorf("Expected md5 JA3 and JA3S fingerprints, got %+v", fingerprints)
+	}
+	if !strings.HasPrefix(fingerprints.JA4, "t13d") || !strings.HasPrefix(fingerprints.JA4S, "t13") {
+		t.Errorf("Expected tls 1.3 JA4 and JA4S fingerprints, got %+v", fingerprints)
+	}
+
+	for filter, expected := range map[string]bool{
+		fingerprints.JA4:        true,
+		fingerprints.JA3S:       true,
+		"-" + fingerprints.JA4:  false,
+		"t12d1516h2_8daaf61527": false,
+	} {
+		token := internal.FilterToken{FilterType: packet.FilterFingerprint, FilterContent: strings.TrimPrefix(filter, "-"), Negate: strings.HasPrefix(filter, "-")}
+		if actual := httpPacket.MatchesFilter([]internal.FilterToken{token}); actual != expected {
+			t.Errorf("MatchesFilter(fingerprint:%s) = %v, expected %v", filter, actual, expected)
+		}
+	}
+}
@@ -1,38 +1,84 @@
 package socks5
 
 import (
-	"fmt"
 	"log/slog"
 	"net"
 	"strconv"
-	"strings"
 )
 
 func FormatServerChoice(version byte, auth byte) []byte {
 	return []byte{version, auth}
 }
 
+func FormatAuthResponse(status byte) []byte {
+	return []byte{AuthVer1, status}
+}
+
 func FormatConnResponse(
 	version byte,
 	status byte,
 	bndAddr net.Addr,
 ) []byte {
-	parts := strings.Split(bndAddr.String(), ":")
-	ip := parts[0]
-	port, err := strconv.Atoi(parts[1])
-	if err != nil {
-		slog.Error("Cannot parse port", "port", parts[1])
-	}
-
-	var i1, i2, i3, i4 byte
-	fmt.Sscanf(ip, "%d.%d.%d.%d", &i1, &i2, &i3, &i4)
-	return []byte{
+	response := []byte{
 		version,
 		status,
 		0x00, // Rsv is always 0x00
-		// No IPV6 support for now
-		AddressTypeIPv4, i1, i2, i3, i4,
-		byte(port >> 8),
-		byte(port & 0xFF),
 	}
+
+	return append(response, formatAddress(bndAddr)...)
+}
+
+// FormatSocks4Response formats a SOCKS4 reply. SOCKS4 only supports ipv4,
+// so any other bndAddr is reported as the unspecified address.
+func FormatSocks4Response(status byte, bndAddr net.Addr) []byte {
+	// formatAddress returns the address type, the address, and then the port
+	address := formatAddress(bndAddr)
+	response := []byte{Socks4ReplyVer, status}
+	response = append(response, address[len(address)-2:]...)
+	if address[0] != AddressTypeIPv4 {
+		return append(response, 0x00, 0x00, 0x00, 0x00)
+	}
+
+	return append(response, address[1:5]...)
+}
+
+// FormatUDPResponse encapsulates data received from srcAddr, so that it can be sent to the client by the udp relay.
+func FormatUDPResponse(srcAddr net.Addr, data []byte) []byte {
+	response := []byte{
+		0x00, 0x00, // Rsv is always 0x0000
+		0x00, // Fragmentation is not supported
+	}
+	response = append(response, formatAddress(srcAddr)...)
+
+	return append(response, data...)
+}
+
+// formatAddress formats addr as an address type, the address, and then the port.
+func formatAddress(addr net.Addr) []byte {
+	host, portString, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		slog.Error("Cannot split address", "address", addr, "error", err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		slog.Error("Cannot parse port", "port", portString)
+	}
+
+	var formatted []byte
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		formatted = append(formatted, AddressTypeIPv4)
+		formatted = append(formatted, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		formatted = append(formatted, AddressTypeIPv6)
+		formatted = append(formatted, ip16...)
+	} else {
+		// Not an ip (i.e. our internal gitm hostname), so report the unspecified address
+		formatted = append(formatted, AddressTypeIPv4, 0x00, 0x00, 0x00, 0x00)
+	}
+
+	return append(formatted,
+		byte(port>>8),
+		byte(port&0xFF),
+	)
 }
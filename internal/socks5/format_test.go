@@ -30,3 +30,40 @@ func TestFormatConnResponseSuccess(t *testing.T) {
 		t.Errorf("FormatConnResponse(...) = %x, want %x", actual, expected)
 	}
 }
+
+func TestFormatConnResponseIPv6(t *testing.T) {
+	expected := []byte{
+		0x05, 0x00, 0x00, 0x04,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x01, 0xbb,
+	}
+
+	actual := FormatConnResponse(
+		SocksVer5,
+		StatusSucceeded,
+		&net.TCPAddr{
+			IP:   net.ParseIP("2001:db8::1"),
+			Port: 443,
+		},
+	)
+
+	if !slices.Equal(expected, actual) {
+		t.Errorf("FormatConnResponse(...) = %x, want %x", actual, expected)
+	}
+}
+
+func TestFormatSocks4Response(t *testing.T) {
+	expected := []byte{0x00, Socks4StatusGranted, 0x00, 0x50, 0x01, 0x01, 0x01, 0x01}
+
+	actual := FormatSocks4Response(
+		Socks4StatusGranted,
+		&net.TCPAddr{
+			IP:   net.IPv4(0x01, 0x01, 0x01, 0x01),
+			Port: 80,
+		},
+	)
+
+	if !slices.Equal(expected, actual) {
+		t.Errorf("FormatSocks4Response(...) = %x, want %x", actual, expected)
+	}
+}
@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	_ "embed"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+)
+
+//go:embed assets/gitm.html
+var landingPageTemplate string
+
+var landingPage = template.Must(template.New("gitm").Parse(landingPageTemplate))
+
+// caDownloads are the forms of the CA served by the gitm web server, by path
+var caDownloads = map[string]struct {
+	format      string
+	contentType string
+}{
+	"/ca.crt":            {CAFormatDER, "application/x-x509-ca-cert"},
+	"/ca.pem":            {CAFormatPEM, "application/x-pem-file"},
+	"/gitm.mobileconfig": {CAFormatMobileConfig, "application/x-apple-aspen-config"},
+}
+
+// handleGITM serves the gitm web server (http://gitm) on client, until the client closes the connection.
+func handleGITM(client net.Conn, conf *internal.Config) error {
+	done := make(chan struct{})
+	server := &http.Server{
+		Handler:           newGITMHandler(conf),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	err := server.Serve(&singleConnListener{conn: &notifyCloseConn{Conn: client, done: done}, done: done})
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// newGITMHandler creates the handler for the gitm web server.
+func newGITMHandler(conf *internal.Config) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := landingPage.Execute(w, newLandingPageData(conf, r)); err != nil {
+			slog.Error("Error rendering landing page", "error", err)
+		}
+	})
+
+	for path, download := range caDownloads {
+		mux.HandleFunc("GET "+path, func(w http.ResponseWriter, r *http.Request) {
+			contents, err := ExportCA(download.format, "")
+			if err != nil {
+				slog.Error("Error getting ca cert", "error", err)
+				http.Error(w, "Error getting ca cert", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", download.contentType)
+			_, _ = w.Write(contents)
+		})
+	}
+
+	for _, path := range pacPaths {
+		mux.HandleFunc("GET "+path, func(w http.ResponseWriter, r *http.Request) {
+			writePAC(w, r, conf)
+		})
+	}
+
+	return mux
+}
+
+// landingPageData is what the landing page shows the device visiting it
+type landingPageData struct {
+	SocksProxy       string
+	HTTPProxy        string
+	PACURL           string
+	TransparentProxy string
+	Authenticated    bool
+}
+
+func newLandingPageData(conf *internal.Config, r *http.Request) landingPageData {
+	localAddr := requestLocalAddr(r)
+
+	data := landingPageData{
+		SocksProxy:    reachableAddress(conf.SocksListenURI, localAddr),
+		Authenticated: len(conf.SocksCredentials) > 0,
+	}
+	if conf.EnableHTTPProxy {
+		data.HTTPProxy = reachableAddress(conf.HTTPProxyListenURI, localAddr)
+	}
+	if conf.EnablePACServer {
+		data.PACURL = "http://" + reachableAddress(conf.PACListenURI, localAddr) + "/proxy.pac"
+	}
+	if conf.EnableTransparentProxy {
+		data.TransparentProxy = conf.TransparentListenURI
+	}
+
+	return data
+}
+
+// requestLocalAddr returns the address the client reached gitm at with r, or nil if it isn't known.
+// It is what addresses of listeners on every interface are given to the client as.
+func requestLocalAddr(r *http.Request) net.Addr {
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	return localAddr
+}
+
+// reachableAddress returns listenURI with an unspecified host (i.e. 0.0.0.0) replaced by the host of localAddr.
+func reachableAddress(listenURI string, localAddr net.Addr) string {
+	host, port, err := net.SplitHostPort(listenURI)
+	if err != nil || localAddr == nil {
+		return listenURI
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listenURI
+	}
+
+	localHost, _, err := net.SplitHostPort(localAddr.String())
+	if err != nil {
+		return listenURI
+	}
+
+	return net.JoinHostPort(localHost, port)
+}
+
+// singleConnListener is a net.Listener that accepts conn once.
+// Accept then blocks until done is closed, so that http.Server.Serve returns once conn is closed.
+type singleConnListener struct {
+	conn     net.Conn
+	done     chan struct{}
+	accepted bool
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// notifyCloseConn closes done when the conn is closed.
+type notifyCloseConn struct {
+	net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *notifyCloseConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+)
+
+func TestHandleGITM(t *testing.T) {
+	useTempConfigDir(t)
+
+	conf := &internal.Config{
+		SocksListenURI:     "0.0.0.0:1080",
+		HTTPProxyListenURI: "127.0.0.1:8081",
+		EnableHTTPProxy:    true,
+	}
+
+	client, server := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- handleGITM(server, conf)
+	}()
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return client, nil
+		},
+	}}
+	get := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := httpClient.Get("http://gitm" + path)
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		defer resp.Body.Close() //nolint:errcheck
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		return resp, body
+	}
+
+	resp, body := get("/")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "/ca.crt") {
+		t.Errorf("Expected the landing page, got status = %d, body = %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), "127.0.0.1:8081") {
+		t.Errorf("Expected the landing page to show the http proxy, got %s", body)
+	}
+
+	resp, body = get("/ca.crt")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status = 200, got status = %d", resp.StatusCode)
+	}
+	if _, err := x509.ParseCertificate(body); err != nil {
+		t.Errorf("Expected a DER certificate, got err = %v", err)
+	}
+
+	_, body = get("/ca.pem")
+	if block, _ := pem.Decode(body); block == nil || block.Type != "CERTIFICATE" {
+		t.Errorf("Expected a pem certificate, got %s", body)
+	}
+
+	resp, body = get("/gitm.mobileconfig")
+	if resp.Header.Get("Content-Type") != "application/x-apple-aspen-config" || !strings.Contains(string(body), "com.apple.security.root") {
+		t.Errorf("Expected a configuration profile, got %s", body)
+	}
+
+	_, body = get("/proxy.pac")
+	if !strings.Contains(string(body), "PROXY 127.0.0.1:8081; SOCKS5 0.0.0.0:1080") {
+		t.Errorf("Expected the pac file, got %s", body)
+	}
+
+	if resp, _ := get("/missing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status = 404, got status = %d", resp.StatusCode)
+	}
+
+	httpClient.CloseIdleConnections()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected err = nil, got err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("handleGITM didn't return after the client closed the connection")
+	}
+}
+
+func TestReachableAddress(t *testing.T) {
+	localAddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 1080}
+
+	for listenURI, expected := range map[string]string{
+		"0.0.0.0:1080":   "192.168.1.10:1080",
+		":8080":          "192.168.1.10:8080",
+		"[::]:8080":      "192.168.1.10:8080",
+		"127.0.0.1:1080": "127.0.0.1:1080",
+		"gitm.lan:1080":  "gitm.lan:1080",
+	} {
+		if actual := reachableAddress(listenURI, localAddr); actual != expected {
+			t.Errorf("reachableAddress(%s) = %s, expected %s", listenURI, actual, expected)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -19,115 +20,250 @@ import (
 	"github.com/redawl/gitm/internal/util"
 )
 
+// maxPipelinedRequests is the number of requests that can be read from a client
+// before the responses for those requests have been read from the server.
+const maxPipelinedRequests = 32
+
+// httpExchange is a request read from the client that is waiting on a response from the server.
+type httpExchange struct {
+	// method is the method of the request, which decides whether its response has a body.
+	method string
+	// request receives the request once its body has been read from the client.
+	// request is closed without receiving anything if the body couldn't be read.
+	request chan *packet.HTTPPacket
+	// upgraded receives whether the server accepted a websocket upgrade.
+	// upgraded is nil for requests that did not ask for an upgrade.
+	upgraded chan bool
+	// websocket is the packet tracking the websocket frames, once the connection is upgraded.
+	websocket *packet.WebsocketPacket
+}
+
 // HandleHTTPRequest reads http requests from inboundConn to outboundConn,
 // and then read http responses from outboundConn to inboundConn.
 //
+// Requests are read until inboundConn is closed, so every request on a keep-alive
+// connection is captured, including requests pipelined before their responses arrive.
+//
+// Every packet is tagged with connInfo.
+//
 // httpPacketHandler is called first on the packet when inboundConn -> outboundConn completes,
-// and again when outboundConn -> inboundConn completes.
-func HandleHTTPRequest(inboundConn, outboundConn net.Conn, httpPacketHandler func(packet.Packet)) error {
-	encrypted := strings.HasSuffix(outboundConn.RemoteAddr().String(), ":443")
+// and again when outboundConn -> inboundConn completes. It is called in that order from a goroutine
+// of its own, so the connection isn't held up by it.
+func HandleHTTPRequest(inboundConn, outboundConn net.Conn, connInfo packet.ConnInfo, httpPacketHandler func(packet.Packet)) error {
+	_, encrypted := outboundConn.(*tls.Conn)
+	httpPacketHandler = queuePackets(httpPacketHandler)
 	bufReader := bufio.NewReader(io.TeeReader(inboundConn, outboundConn))
-	reader := textproto.NewReader(bufReader)
 	clientBufioReader := bufio.NewReader(io.TeeReader(outboundConn, inboundConn))
-	clientReader := textproto.NewReader(clientBufioReader)
 
-	method, uri, proto, err := ReadLine1(reader)
-	if err != nil {
-		return fmt.Errorf("http request line1: %w", err)
+	exchanges := make(chan *httpExchange, maxPipelinedRequests)
+	done := make(chan struct{})
+	defer close(done)
+	requestErr := make(chan error, 1)
+
+	// Conns that rewrite what the client sends need to know when that stops being http
+	upgrade := func() {}
+	if conn, ok := inboundConn.(interface{ upgrade() }); ok {
+		upgrade = conn.upgrade
 	}
-	headers, err := reader.ReadMIMEHeader()
-	if err != nil {
-		return fmt.Errorf("http request header: %w", err)
+
+	go func() {
+		defer close(exchanges)
+		requestErr <- readRequests(bufReader, encrypted, connInfo, exchanges, done, upgrade, httpPacketHandler)
+	}()
+
+	for exchange := range exchanges {
+		upgraded, err := readResponse(clientBufioReader, exchange, httpPacketHandler)
+		if err != nil {
+			return err
+		}
+
+		if upgraded {
+			for {
+				if err := handleWebsocket(clientBufioReader, exchange.websocket.AddServerFrame); err != nil {
+					if !errors.Is(err, io.EOF) {
+						slog.Error("Error handling websocket", "error", err)
+					}
+					break
+				}
+				httpPacketHandler(exchange.websocket)
+			}
+			break
+		}
 	}
 
-	requestBody, err := readBody(headers, bufReader)
-	if err != nil {
-		return fmt.Errorf("http request body: %w", err)
-	}
-
-	httpPacket := packet.CreatePacket(
-		encrypted,
-		headers.Get("Host"),
-		method,
-		"",
-		uri,
-		"",
-		proto,
-		nil,
-		nil,
-		http.Header(headers),
-		requestBody,
-	)
+	return <-requestErr
+}
 
-	if headers.Get("Upgrade") != "websocket" {
-		go httpPacketHandler(&httpPacket)
+// readRequests reads http requests from reader until the client closes the connection,
+// sending each request to exchanges so that its response can be matched up with it.
+//
+// upgrade is called once the server accepts a websocket upgrade, before the websocket frames are read.
+func readRequests(
+	reader *bufio.Reader,
+	encrypted bool,
+	connInfo packet.ConnInfo,
+	exchanges chan<- *httpExchange,
+	done <-chan struct{},
+	upgrade func(),
+	httpPacketHandler func(packet.Packet),
+) error {
+	textReader := textproto.NewReader(reader)
+	for {
+		method, uri, proto, err := ReadLine1(textReader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("http request line1: %w", err)
+		}
+		headers, err := textReader.ReadMIMEHeader()
+		if err != nil {
+			return fmt.Errorf("http request header: %w", err)
+		}
+
+		exchange := &httpExchange{method: method, request: make(chan *packet.HTTPPacket, 1)}
+		if headers.Get("Upgrade") == "websocket" {
+			exchange.upgraded = make(chan bool, 1)
+		}
+
+		// Queued before the body is read, so that interim responses the client waits on
+		// before sending the body (i.e. 100 Continue) are relayed
+		select {
+		case exchanges <- exchange:
+		case <-done:
+			return nil
+		}
+
+		requestBody, err := readBody(headers, reader)
+		if err != nil {
+			close(exchange.request)
+			return fmt.Errorf("http request body: %w", err)
+		}
+
+		httpPacket := packet.CreatePacket(
+			encrypted,
+			headers.Get("Host"),
+			method,
+			"",
+			uri,
+			"",
+			proto,
+			nil,
+			nil,
+			http.Header(headers),
+			requestBody,
+		)
+		httpPacket.ConnInfo = connInfo
+
+		if exchange.upgraded == nil {
+			// Called before the request is sent to the exchange, so the request always
+			// reaches httpPacketHandler before its response does
+			httpPacketHandler(&httpPacket)
+		}
+		exchange.request <- &httpPacket
+
+		if exchange.upgraded == nil {
+			continue
+		}
+
+		select {
+		case upgraded := <-exchange.upgraded:
+			if !upgraded {
+				continue
+			}
+		case <-done:
+			return nil
+		}
+
+		// After a successful upgrade, everything the client sends is websocket frames
+		upgrade()
+		websocketPacket := exchange.websocket
+		for {
+			if err := handleWebsocket(reader, websocketPacket.AddClientFrame); err != nil {
+				if !errors.Is(err, io.EOF) {
+					slog.Error("Error handling websocket", "error", err)
+				}
+				return nil
+			}
+			httpPacketHandler(websocketPacket)
+		}
 	}
+}
 
-	respProto, statusCode, statusCodeMessage, err := ReadLine1(clientReader)
-	if err != nil {
-		return fmt.Errorf("http response line1: %w", err)
+// readResponse reads the http response for exchange from reader, and reports whether
+// the connection was upgraded to a websocket.
+func readResponse(reader *bufio.Reader, exchange *httpExchange, httpPacketHandler func(packet.Packet)) (bool, error) {
+	textReader := textproto.NewReader(reader)
+
+	var (
+		respProto, statusCode, statusCodeMessage string
+		responseHeaders                          textproto.MIMEHeader
+		err                                      error
+	)
+	for {
+		respProto, statusCode, statusCodeMessage, err = ReadLine1(textReader)
+		if err != nil {
+			return false, fmt.Errorf("http response line1: %w", err)
+		}
+
+		responseHeaders, err = textReader.ReadMIMEHeader()
+		if err != nil {
+			return false, fmt.Errorf("http response header: %w", err)
+		}
+
+		// Interim responses (i.e. 100 Continue) are followed by the final response
+		if !strings.HasPrefix(statusCode, "1") || statusCode == "101" {
+			break
+		}
 	}
 
-	responseHeaders, err := clientReader.ReadMIMEHeader()
-	if err != nil {
-		return fmt.Errorf("http response header: %w", err)
+	var responseBody []byte
+	if responseHasBody(exchange.method, statusCode) {
+		if responseBody, err = readResponseBody(responseHeaders, reader); err != nil {
+			return false, fmt.Errorf("http response body: %w", err)
+		}
+	} else {
+		responseBody = []byte{}
 	}
 
-	responseBody, err := readBody(responseHeaders, clientBufioReader)
-	if err != nil {
-		return fmt.Errorf("http response body: %w", err)
+	httpPacket, ok := <-exchange.request
+	if !ok {
+		return false, errors.New("http request body was not read")
 	}
 
 	completedPacket := packet.CreatePacket(
-		encrypted,
-		headers.Get("Host"),
-		method,
+		httpPacket.Encrypted(),
+		httpPacket.Hostname,
+		httpPacket.Method,
 		fmt.Sprintf("%s %s", statusCode, statusCodeMessage),
-		uri,
+		httpPacket.Path,
 		respProto,
-		proto,
+		httpPacket.ReqProto,
 		http.Header(responseHeaders),
 		responseBody,
-		http.Header(headers),
-		requestBody,
+		httpPacket.ReqHeaders,
+		httpPacket.ReqBody,
 	)
+	completedPacket.ID = httpPacket.ID
+	completedPacket.ConnInfo = httpPacket.ConnInfo
 
-	httpPacket.UpdatePacket(&completedPacket)
+	if exchange.upgraded == nil {
+		httpPacketHandler(&completedPacket)
+		return false, nil
+	}
 
-	if headers.Get("Upgrade") == "websocket" {
-		done := make(chan bool)
-		p := packet.CreateWebsocketPacket(httpPacket)
-		httpPacketHandler(p)
-		go func() {
-			for {
-				if err := handleWebsocket(bufReader, p.AddClientFrame); err != nil {
-					if !errors.Is(err, io.EOF) {
-						slog.Error("Error handling websocket", "error", err)
-					}
-					break
-				}
-				go httpPacketHandler(p)
-			}
-			done <- true
-		}()
-		go func() {
-			for {
-				if err := handleWebsocket(clientBufioReader, p.AddServerFrame); err != nil {
-					if !errors.Is(err, io.EOF) {
-						slog.Error("Error handling websocket", "error", err)
-					}
-					break
-				}
-				go httpPacketHandler(p)
-			}
-			done <- true
-		}()
-		<-done
-		<-done
-		return nil
+	if statusCode != "101" {
+		exchange.upgraded <- false
+		httpPacketHandler(&completedPacket)
+		return false, nil
 	}
 
-	return nil
+	websocketPacket := packet.CreateWebsocketPacket(completedPacket)
+	httpPacketHandler(websocketPacket)
+	exchange.websocket = websocketPacket
+	exchange.upgraded <- true
+
+	return true, nil
 }
 
 func ReadLine1(reader *textproto.Reader) (string, string, string, error) {
@@ -136,11 +272,21 @@ func ReadLine1(reader *textproto.Reader) (string, string, string, error) {
 		return "", "", "", err
 	}
 
+	// Clients may send empty lines between requests on a keep-alive connection
+	for line1 == "" {
+		if line1, err = reader.ReadLine(); err != nil {
+			return "", "", "", err
+		}
+	}
+
 	line1Parts := strings.Split(line1, " ")
+	if len(line1Parts) < 2 {
+		return "", "", "", fmt.Errorf("malformed line1: %q", line1)
+	}
 	return line1Parts[0], line1Parts[1], strings.Join(line1Parts[2:], " "), nil
 }
 
-func readBody(headers textproto.MIMEHeader, reader io.Reader) ([]byte, error) {
+func readBody(headers textproto.MIMEHeader, reader *bufio.Reader) ([]byte, error) {
 	logger := slog.With("hostname", headers.Get("Host"))
 	transferEncoding := headers.Get("Transfer-Encoding")
 
@@ -148,7 +294,18 @@ func readBody(headers textproto.MIMEHeader, reader io.Reader) ([]byte, error) {
 		// TODO: handle other encodings
 		// For now, handle chunked only
 		if transferEncoding == "chunked" {
-			return io.ReadAll(httputil.NewChunkedReader(reader))
+			body, err := io.ReadAll(httputil.NewChunkedReader(reader))
+			if err != nil {
+				return nil, err
+			}
+
+			// The chunked reader stops at the last chunk, leaving the trailer
+			// (and the empty line ending it) for the next message to trip over
+			if _, err := textproto.NewReader(reader).ReadMIMEHeader(); err != nil {
+				return nil, fmt.Errorf("reading trailer: %w", err)
+			}
+
+			return body, nil
 		} else {
 			logger.Error("Not handling unknown Transfer-Encoding", "encoding", transferEncoding)
 		}
@@ -180,6 +337,25 @@ func readBody(headers textproto.MIMEHeader, reader io.Reader) ([]byte, error) {
 	return bytes, nil
 }
 
+// readResponseBody is the same as readBody, except that a response with neither
+// Transfer-Encoding nor Content-Length is delimited by the server closing the connection.
+func readResponseBody(headers textproto.MIMEHeader, reader *bufio.Reader) ([]byte, error) {
+	if headers.Get("Transfer-Encoding") == "" && headers.Get("Content-Length") == "" {
+		return io.ReadAll(reader)
+	}
+
+	return readBody(headers, reader)
+}
+
+// responseHasBody reports whether a response with statusCode, sent for a request with method, can have a body.
+func responseHasBody(method string, statusCode string) bool {
+	if method == http.MethodHead {
+		return false
+	}
+
+	return !strings.HasPrefix(statusCode, "1") && statusCode != "204" && statusCode != "304"
+}
+
 func handleWebsocket(reader *bufio.Reader, frameHandler func(*packet.WebsocketFrame)) error {
 	header, err := util.ReadCount(reader, 2)
 	if err != nil {
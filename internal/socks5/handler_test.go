@@ -0,0 +1,270 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// proxyHTTP starts a listener that forwards every accepted connection to target using HandleHTTPRequest.
+func proxyHTTP(t *testing.T, target string, packetHandler func(packet.Packet)) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close() //nolint:errcheck
+				server, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer server.Close() //nolint:errcheck
+				// Errors show up as missing packets, since this can outlive the test
+				_ = HandleHTTPRequest(client, server, packet.ConnInfo{}, packetHandler)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// collectPackets returns a packet handler, and a function that waits for count completed http packets,
+// returning them keyed by their path.
+func collectPackets() (func(packet.Packet), func(t *testing.T, count int) map[string]*packet.HTTPPacket) {
+	var mu sync.Mutex
+	completed := make(map[string]*packet.HTTPPacket)
+
+	handler := func(p packet.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		if httpPacket, ok := p.(*packet.HTTPPacket); ok && httpPacket.Status != "" {
+			completed[httpPacket.Path] = httpPacket
+		}
+	}
+
+	wait := func(t *testing.T, count int) map[string]*packet.HTTPPacket {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			if len(completed) >= count {
+				packets := maps.Clone(completed)
+				mu.Unlock()
+				return packets
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for %d packets", count)
+		return nil
+	}
+
+	return handler, wait
+}
+
+func TestHandleHTTPRequestKeepAlive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello from %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	handler, wait := collectPackets()
+	listener := proxyHTTP(t, server.Listener.Addr().String(), handler)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	reader := bufio.NewReader(conn)
+	paths := []string{"/one", "/two", "/three"}
+	for _, path := range paths {
+		if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\n\r\n", path); err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	packets := wait(t, len(paths))
+	for _, path := range paths {
+		if packets[path] == nil {
+			t.Errorf("No packet captured for %s", path)
+		} else if expected := "Hello from " + path; string(packets[path].RespBody) != expected {
+			t.Errorf("packets[%s].RespBody = %s, want %s", path, packets[path].RespBody, expected)
+		}
+	}
+}
+
+func TestHandleHTTPRequestPipelined(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Transfer-Encoding", "chunked")
+		_, _ = fmt.Fprintf(w, "Hello from %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	handler, wait := collectPackets()
+	listener := proxyHTTP(t, server.Listener.Addr().String(), handler)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err := conn.Write([]byte(
+		"GET /one HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+			"POST /two HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody" +
+			"HEAD /three HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	)); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodHead} {
+		resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	packets := wait(t, 3)
+	if p := packets["/two"]; p == nil || p.Method != http.MethodPost || string(p.ReqBody) != "body" {
+		t.Fatalf("packets[/two] = %v, want POST with body", p)
+	}
+	if string(packets["/two"].RespBody) != "Hello from /two" {
+		t.Errorf("packets[/two].RespBody = %s, want Hello from /two", packets["/two"].RespBody)
+	}
+	if p := packets["/three"]; p == nil || p.Method != http.MethodHead || len(p.RespBody) != 0 {
+		t.Errorf("packets[/three] = %v, want HEAD with empty body", p)
+	}
+}
+
+func TestHandleHTTPRequestExpectContinue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reading the body sends the 100 Continue
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "Got %s", body)
+	}))
+	defer server.Close()
+
+	handler, wait := collectPackets()
+	listener := proxyHTTP(t, server.Listener.Addr().String(), handler)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	if _, err := fmt.Fprint(conn, "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n"); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	// The body is only sent once the server asks for it
+	reader := bufio.NewReader(conn)
+	interim, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if interim.StatusCode != http.StatusContinue {
+		t.Fatalf("interim.StatusCode = %d, want %d", interim.StatusCode, http.StatusContinue)
+	}
+
+	if _, err := fmt.Fprint(conn, "body"); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	packets := wait(t, 1)
+	if p := packets["/upload"]; p == nil || string(p.ReqBody) != "body" || string(p.RespBody) != "Got body" {
+		t.Errorf("packets[/upload] = %v, want request body body and response body Got body", p)
+	}
+}
+
+func TestHandleHTTPRequestSlowPacketHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Hello from %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	// Like the ui, the packet handler doesn't take packets until it is ready
+	release := make(chan struct{})
+	handled := make(chan *packet.HTTPPacket, 4)
+	listener := proxyHTTP(t, server.Listener.Addr().String(), func(p packet.Packet) {
+		<-release
+		handled <- p.(*packet.HTTPPacket)
+	})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	paths := []string{"/one", "/two"}
+	for _, path := range paths {
+		if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\n\r\n", path); err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	close(release)
+
+	// Each request is handled before its response, and in the order they were sent
+	for _, path := range paths {
+		for _, completed := range []bool{false, true} {
+			select {
+			case p := <-handled:
+				if p.Path != path || (p.Status != "") != completed {
+					t.Errorf("Handled %s with status %q, want %s completed %v", p.Path, p.Status, path, completed)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for packets")
+			}
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	handshakeTypeServerHello = 0x02
+)
+
+// The tls extensions gitm reads from hellos
+const (
+	extensionServerName          = 0
+	extensionSupportedGroups     = 10
+	extensionECPointFormats      = 11
+	extensionSignatureAlgorithms = 13
+	extensionALPN                = 16
+	extensionSupportedVersions   = 43
+)
+
+// recordHeaderLength is the length of a tls record header: content type, version and length
+const recordHeaderLength = 5
+
+// maxHelloLength is the most bytes read looking for a hello, before giving up on it
+const maxHelloLength = 64 * 1024
+
+// clientHello is the part of a tls ClientHello gitm uses to handle and fingerprint the connection.
+type clientHello struct {
+	// serverName is the server name (SNI) the client asked for, or "" if it didn't send one
+	serverName          string
+	version             uint16
+	cipherSuites        []uint16
+	extensions          []uint16
+	supportedGroups     []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	alpnProtocols       []string
+	supportedVersions   []uint16
+}
+
+// serverHello is the part of a tls ServerHello gitm uses to fingerprint the connection.
+type serverHello struct {
+	version     uint16
+	cipherSuite uint16
+	extensions  []uint16
+	// alpnProtocol is the application protocol the server picked, or "" if it didn't pick one
+	alpnProtocol string
+	// supportedVersion is the version picked by a tls 1.3 server, or 0 if it didn't send one
+	supportedVersion uint16
+}
+
+// handshakeMessage reassembles the first handshake message in records, which can span several tls records.
+// If records doesn't hold the whole message yet, nil is returned along with the length records needs to continue.
+func handshakeMessage(records []byte) ([]byte, int, error) {
+	message := make([]byte, 0)
+	offset := 0
+	for {
+		// The handshake message header is its type and 24 bit length
+		if len(message) >= 4 {
+			length := 4 + (int(message[1])<<16 | int(message[2])<<8 | int(message[3]))
+			if len(message) >= length {
+				return message[:length], 0, nil
+			}
+		}
+
+		if len(records) < offset+recordHeaderLength {
+			return nil, offset + recordHeaderLength, nil
+		}
+		header := records[offset : offset+recordHeaderLength]
+		if header[0] != recordTypeHandshake {
+			return nil, 0, fmt.Errorf("unexpected record type %d", header[0])
+		}
+
+		end := offset + recordHeaderLength + (int(header[3])<<8 | int(header[4]))
+		if len(records) < end {
+			return nil, end, nil
+		}
+		message = append(message, records[offset+recordHeaderLength:end]...)
+		offset = end
+	}
+}
+
+// peekClientHello returns the ClientHello handshake message sent by the client, without consuming it.
+// The message can span several records, as long as they all fit in the conn's buffer.
+func peekClientHello(conn *bufferedConn) ([]byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(sniffTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+
+	length := recordHeaderLength
+	for {
+		records, err := conn.reader.Peek(length)
+		if err != nil {
+			return nil, fmt.Errorf("peeking records: %w", err)
+		}
+
+		message, needed, err := handshakeMessage(records)
+		if err != nil || message != nil {
+			return message, err
+		}
+		length = needed
+	}
+}
+
+// peekServerName returns the server name (SNI) in the ClientHello sent by the client, without consuming it.
+// "" is returned if the client didn't send one, and an error if the ClientHello couldn't be read.
+func peekServerName(conn *bufferedConn) (string, error) {
+	message, err := peekClientHello(conn)
+	if err != nil {
+		return "", err
+	}
+
+	hello, err := parseClientHello(message)
+	if err != nil {
+		return "", err
+	}
+
+	return hello.serverName, nil
+}
+
+// helloRecorder collects the bytes of one direction of a tls connection, until they hold its first handshake message.
+type helloRecorder struct {
+	records []byte
+	message []byte
+	done    bool
+}
+
+// record adds b to the bytes collected so far. Nothing is collected once the message is complete,
+// or the bytes turn out not to be a handshake.
+func (r *helloRecorder) record(b []byte) {
+	if r.done || len(b) == 0 {
+		return
+	}
+
+	r.records = append(r.records, b...)
+	message, _, err := handshakeMessage(r.records)
+	if err != nil || message != nil || len(r.records) > maxHelloLength {
+		r.message = message
+		r.records = nil
+		r.done = true
+	}
+}
+
+// helloConn records the first handshake message read from the conn, i.e. the ClientHello from a client,
+// or the ServerHello from a server.
+type helloConn struct {
+	net.Conn
+	mu       sync.Mutex
+	recorder helloRecorder
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.mu.Lock()
+	c.recorder.record(b[:n])
+	c.mu.Unlock()
+
+	return n, err
+}
+
+// hello returns the first handshake message read, or nil if it hasn't been read (yet).
+func (c *helloConn) hello() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.recorder.message
+}
+
+// parseClientHello parses a ClientHello handshake message, i.e. one returned by peekClientHello.
+func parseClientHello(message []byte) (*clientHello, error) {
+	hello := &clientHello{}
+	input := cryptobyte.String(message)
+
+	var (
+		messageType  uint8
+		body         cryptobyte.String
+		sessionID    cryptobyte.String
+		cipherSuites cryptobyte.String
+		compression  cryptobyte.String
+	)
+	if !input.ReadUint8(&messageType) || messageType != handshakeTypeClientHello {
+		return nil, errors.New("not a ClientHello")
+	}
+	if !input.ReadUint24LengthPrefixed(&body) ||
+		!body.ReadUint16(&hello.version) ||
+		!body.Skip(32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errors.New("malformed ClientHello")
+	}
+
+	var err error
+	if hello.cipherSuites, err = readUint16s(cipherSuites); err != nil {
+		return nil, fmt.Errorf("malformed ClientHello cipher suites: %w", err)
+	}
+
+	// Extensions are optional
+	if body.Empty() {
+		return hello, nil
+	}
+
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("malformed ClientHello extensions")
+	}
+	for !extensions.Empty() {
+		var (
+			extension uint16
+			data      cryptobyte.String
+		)
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("malformed ClientHello extension")
+		}
+		hello.extensions = append(hello.extensions, extension)
+
+		var (
+			list cryptobyte.String
+			err  error
+		)
+		switch extension {
+		case extensionServerName:
+			hello.serverName, err = parseServerName(data)
+		case extensionSupportedGroups:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				err = errors.New("malformed supported_groups extension")
+			} else {
+				hello.supportedGroups, err = readUint16s(list)
+			}
+		case extensionECPointFormats:
+			if !data.ReadUint8LengthPrefixed(&list) {
+				err = errors.New("malformed ec_point_formats extension")
+			} else {
+				hello.pointFormats = list
+			}
+		case extensionSignatureAlgorithms:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				err = errors.New("malformed signature_algorithms extension")
+			} else {
+				hello.signatureAlgorithms, err = readUint16s(list)
+			}
+		case extensionALPN:
+			hello.alpnProtocols, err = parseALPN(data)
+		case extensionSupportedVersions:
+			if !data.ReadUint8LengthPrefixed(&list) {
+				err = errors.New("malformed supported_versions extension")
+			} else {
+				hello.supportedVersions, err = readUint16s(list)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hello, nil
+}
+
+// parseServerHello parses a ServerHello handshake message.
+func parseServerHello(message []byte) (*serverHello, error) {
+	hello := &serverHello{}
+	input := cryptobyte.String(message)
+
+	var (
+		messageType uint8
+		body        cryptobyte.String
+		sessionID   cryptobyte.String
+	)
+	if !input.ReadUint8(&messageType) || messageType != handshakeTypeServerHello {
+		return nil, errors.New("not a ServerHello")
+	}
+	if !input.ReadUint24LengthPrefixed(&body) ||
+		!body.ReadUint16(&hello.version) ||
+		!body.Skip(32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16(&hello.cipherSuite) ||
+		// The compression method
+		!body.Skip(1) {
+		return nil, errors.New("malformed ServerHello")
+	}
+
+	// Extensions are optional
+	if body.Empty() {
+		return hello, nil
+	}
+
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("malformed ServerHello extensions")
+	}
+	for !extensions.Empty() {
+		var (
+			extension uint16
+			data      cryptobyte.String
+		)
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("malformed ServerHello extension")
+		}
+		hello.extensions = append(hello.extensions, extension)
+
+		switch extension {
+		case extensionALPN:
+			protocols, err := parseALPN(data)
+			if err != nil {
+				return nil, err
+			}
+			if len(protocols) > 0 {
+				hello.alpnProtocol = protocols[0]
+			}
+		case extensionSupportedVersions:
+			if !data.ReadUint16(&hello.supportedVersion) {
+				return nil, errors.New("malformed supported_versions extension")
+			}
+		}
+	}
+
+	return hello, nil
+}
+
+// parseServerName returns the host name in the data of a server_name extension.
+func parseServerName(data cryptobyte.String) (string, error) {
+	var names cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&names) {
+		return "", errors.New("malformed server_name extension")
+	}
+
+	for !names.Empty() {
+		var (
+			nameType uint8
+			name     cryptobyte.String
+		)
+		if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+			return "", errors.New("malformed server_name extension")
+		}
+		// host_name is the only name type defined
+		if nameType == 0 {
+			return string(name), nil
+		}
+	}
+
+	return "", nil
+}
+
+// parseALPN returns the protocols in the data of an application_layer_protocol_negotiation extension.
+func parseALPN(data cryptobyte.String) ([]string, error) {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return nil, errors.New("malformed alpn extension")
+	}
+
+	protocols := make([]string, 0)
+	for !list.Empty() {
+		var protocol cryptobyte.String
+		if !list.ReadUint8LengthPrefixed(&protocol) {
+			return nil, errors.New("malformed alpn extension")
+		}
+		protocols = append(protocols, string(protocol))
+	}
+
+	return protocols, nil
+}
+
+// readUint16s reads the whole of list as uint16s.
+func readUint16s(list cryptobyte.String) ([]uint16, error) {
+	values := make([]uint16, 0, len(list)/2)
+	for !list.Empty() {
+		var value uint16
+		if !list.ReadUint16(&value) {
+			return nil, errors.New("odd length list")
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+)
+
+// captureClientHello returns a conn with the ClientHello sent by a tls client using config buffered on it.
+func captureClientHello(t *testing.T, config *tls.Config) *bufferedConn {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	// The handshake never completes, it fails once the pipe is closed
+	go func() { _ = tls.Client(client, config).Handshake() }()
+
+	return newBufferedConn(server)
+}
+
+func TestPeekClientHello(t *testing.T) {
+	for serverName, expected := range map[string]string{
+		"example.com": "example.com",
+		// ips aren't sent as the server name
+		"127.0.0.1": "",
+	} {
+		conn := captureClientHello(t, &tls.Config{ServerName: serverName, NextProtos: []string{"h2", "http/1.1"}})
+
+		message, err := peekClientHello(conn)
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		if conn.reader.Buffered() < recordHeaderLength+len(message) {
+			t.Errorf("Expected the ClientHello to still be buffered, only %d bytes are", conn.reader.Buffered())
+		}
+
+		hello, err := parseClientHello(message)
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		if hello.serverName != expected {
+			t.Errorf("Expected serverName = %s, got serverName = %s", expected, hello.serverName)
+		}
+		if !slices.Equal(hello.alpnProtocols, []string{"h2", "http/1.1"}) {
+			t.Errorf("Expected alpnProtocols = [h2 http/1.1], got alpnProtocols = %v", hello.alpnProtocols)
+		}
+		if !slices.Contains(hello.supportedVersions, tls.VersionTLS13) || len(hello.cipherSuites) == 0 ||
+			len(hello.supportedGroups) == 0 || len(hello.signatureAlgorithms) == 0 {
+			t.Errorf("Expected the versions, cipher suites, groups and signature algorithms to be parsed, got %+v", hello)
+		}
+	}
+}
+
+func TestPeekServerNameLargeClientHello(t *testing.T) {
+	// Enough protocols that the ClientHello doesn't fit in bufio's default buffer
+	protocols := make([]string, 40)
+	for i := range protocols {
+		protocols[i] = fmt.Sprintf("%0200d", i)
+	}
+	conn := captureClientHello(t, &tls.Config{ServerName: "large.example.com", NextProtos: protocols})
+
+	serverName, err := peekServerName(conn)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if serverName != "large.example.com" {
+		t.Errorf("Expected serverName = large.example.com, got serverName = %s", serverName)
+	}
+	if conn.reader.Buffered() <= 4096 {
+		t.Errorf("Expected a ClientHello larger than 4096 bytes, got %d bytes", conn.reader.Buffered())
+	}
+}
+
+func TestHelloRecorder(t *testing.T) {
+	conn := captureClientHello(t, &tls.Config{ServerName: "example.com"})
+	message, err := peekClientHello(conn)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	records, _ := conn.reader.Peek(conn.reader.Buffered())
+
+	// The hello arrives a few bytes at a time
+	recorder := helloRecorder{}
+	for i := 0; i < len(records); i += 7 {
+		recorder.record(records[i:min(i+7, len(records))])
+	}
+	if !slices.Equal(recorder.message, message) {
+		t.Errorf("Expected the recorded hello to be the ClientHello")
+	}
+
+	// Bytes that aren't a handshake are given up on
+	recorder = helloRecorder{}
+	recorder.record([]byte("GET / HTTP/1.1\r\n"))
+	if !recorder.done || recorder.message != nil {
+		t.Errorf("Expected the recorder to give up, got done = %v, message = %v", recorder.done, recorder.message)
+	}
+}
+
+func TestParseClientHelloMalformed(t *testing.T) {
+	for _, message := range [][]byte{
+		{},
+		{handshakeTypeClientHello, 0, 0, 10, 3, 3},
+		// A ServerHello
+		{0x02, 0, 0, 0},
+	} {
+		if _, err := parseClientHello(message); err == nil {
+			t.Errorf("Expected an error parsing %v", message)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redawl/gitm/internal/packet"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// http2Proto is the protocol version HTTP/2 packets are recorded with
+const http2Proto = "HTTP/2.0"
+
+// maxHeaderTableSize is the largest hpack dynamic table either side can use.
+// Frames are passed through as is, so the tables are whatever size the client and server agreed on,
+// which is only ever checked against this.
+const maxHeaderTableSize = 1 << 20
+
+// HandleHTTP2 relays HTTP/2 frames between inboundConn and outboundConn, recording each stream as its own packet.
+//
+// Frames are forwarded as is, and decoded on the side. If the frames can't be decoded, the rest of
+// the connection is forwarded without being recorded.
+//
+// httpPacketHandler is called first on the packet when the request for a stream completes,
+// and again when the response completes.
+func HandleHTTP2(inboundConn, outboundConn net.Conn, connInfo packet.ConnInfo, httpPacketHandler func(packet.Packet)) error {
+	_, encrypted := outboundConn.(*tls.Conn)
+	recorder := &http2Recorder{
+		encrypted:     encrypted,
+		connInfo:      connInfo,
+		streams:       make(map[uint32]*http2Stream),
+		packetHandler: queuePackets(httpPacketHandler),
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		recorder.relay(inboundConn, outboundConn, true)
+		closeWrite(outboundConn)
+	}()
+	go func() {
+		defer wg.Done()
+		recorder.relay(outboundConn, inboundConn, false)
+		closeWrite(inboundConn)
+	}()
+	wg.Wait()
+
+	return nil
+}
+
+// http2Stream is a single request and response on an HTTP/2 connection.
+type http2Stream struct {
+	method    string
+	path      string
+	authority string
+	status    string
+
+	reqHeaders  http.Header
+	reqBody     []byte
+	respHeaders http.Header
+	respBody    []byte
+
+	// packet is the packet sent to the packet handler once the request completed
+	packet *packet.HTTPPacket
+}
+
+type http2Recorder struct {
+	encrypted     bool
+	connInfo      packet.ConnInfo
+	packetHandler func(packet.Packet)
+
+	mu      sync.Mutex
+	streams map[uint32]*http2Stream
+}
+
+// relay forwards everything from src to dst, recording the frames along the way.
+func (r *http2Recorder) relay(src, dst net.Conn, fromClient bool) {
+	logger := slog.With("RemoteAddr", src.RemoteAddr(), "fromClient", fromClient)
+	reader := io.TeeReader(src, dst)
+
+	if err := r.readFrames(reader, fromClient); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		logger.Error("Error decoding http2 frames, forwarding the rest without recording", "error", err)
+	}
+
+	if _, err := io.Copy(io.Discard, reader); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Debug("Error forwarding http2 frames", "error", err)
+	}
+}
+
+// readFrames reads frames from reader, recording them until an error occurs.
+func (r *http2Recorder) readFrames(reader io.Reader, fromClient bool) error {
+	if fromClient {
+		preface := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(reader, preface); err != nil {
+			return err
+		}
+		if string(preface) != http2.ClientPreface {
+			return fmt.Errorf("invalid client preface: %q", preface)
+		}
+	}
+
+	decoder := hpack.NewDecoder(4096, nil)
+	decoder.SetAllowedMaxDynamicTableSize(maxHeaderTableSize)
+
+	framer := http2.NewFramer(nil, reader)
+	framer.ReadMetaHeaders = decoder
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			var streamErr http2.StreamError
+			if errors.As(err, &streamErr) {
+				// Only the one stream is broken, the connection can still be decoded
+				r.resetStream(streamErr.StreamID)
+				continue
+			}
+			return err
+		}
+
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			r.handleHeaders(f.StreamID, f.Fields, f.StreamEnded(), fromClient)
+		case *http2.DataFrame:
+			r.handleData(f.StreamID, f.Data(), f.StreamEnded(), fromClient)
+		case *http2.RSTStreamFrame:
+			r.resetStream(f.StreamID)
+		case *http2.PushPromiseFrame:
+			if !f.HeadersEnded() {
+				return errors.New("push promise with continuation frames is not supported")
+			}
+			fields, err := decoder.DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				return fmt.Errorf("decoding push promise: %w", err)
+			}
+			// A pushed response has a request with no body
+			r.handleHeaders(f.PromiseID, fields, true, true)
+		}
+	}
+}
+
+func (r *http2Recorder) handleHeaders(streamID uint32, fields []hpack.HeaderField, ended bool, fromClient bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream := r.streams[streamID]
+	if stream == nil {
+		if !fromClient {
+			// The stream was reset, or started before we were decoding
+			return
+		}
+		stream = &http2Stream{}
+		r.streams[streamID] = stream
+	}
+
+	if fromClient {
+		if stream.reqHeaders == nil {
+			stream.reqHeaders = http.Header{}
+			for _, field := range fields {
+				switch field.Name {
+				case ":method":
+					stream.method = field.Value
+				case ":path":
+					stream.path = field.Value
+				case ":authority":
+					stream.authority = field.Value
+				}
+			}
+		}
+		// The second header block on a stream is the trailers
+		addHeaders(stream.reqHeaders, fields)
+
+		if ended {
+			r.completeRequest(stream)
+		}
+		return
+	}
+
+	status := ""
+	for _, field := range fields {
+		if field.Name == ":status" {
+			status = field.Value
+		}
+	}
+
+	// Interim responses (i.e. 103 Early Hints) are followed by the final response
+	if strings.HasPrefix(status, "1") && !ended {
+		return
+	}
+
+	if stream.respHeaders == nil {
+		stream.respHeaders = http.Header{}
+		if code, err := strconv.Atoi(status); err == nil {
+			stream.status = fmt.Sprintf("%s %s", status, http.StatusText(code))
+		} else {
+			stream.status = status
+		}
+	}
+	addHeaders(stream.respHeaders, fields)
+
+	if ended {
+		r.completeResponse(streamID, stream)
+	}
+}
+
+func (r *http2Recorder) handleData(streamID uint32, data []byte, ended bool, fromClient bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream := r.streams[streamID]
+	if stream == nil {
+		return
+	}
+
+	// data is only valid until the next frame is read
+	if fromClient {
+		stream.reqBody = append(stream.reqBody, data...)
+		if ended {
+			r.completeRequest(stream)
+		}
+	} else {
+		stream.respBody = append(stream.respBody, data...)
+		if ended {
+			r.completeResponse(streamID, stream)
+		}
+	}
+}
+
+// resetStream records whatever was received for a stream that was cancelled.
+func (r *http2Recorder) resetStream(streamID uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stream := r.streams[streamID]; stream != nil && stream.reqHeaders != nil {
+		if stream.status == "" {
+			stream.status = "RST_STREAM"
+		}
+		r.completeResponse(streamID, stream)
+	}
+	delete(r.streams, streamID)
+}
+
+// completeRequest sends the packet for stream to the packet handler, once the client finished sending the request.
+// r.mu must be held.
+func (r *http2Recorder) completeRequest(stream *http2Stream) {
+	if stream.packet != nil {
+		return
+	}
+
+	httpPacket := packet.CreatePacket(
+		r.encrypted,
+		stream.authority,
+		stream.method,
+		"",
+		stream.path,
+		"",
+		http2Proto,
+		nil,
+		nil,
+		stream.reqHeaders,
+		nonNil(stream.reqBody),
+	)
+	httpPacket.ConnInfo = r.connInfo
+	stream.packet = &httpPacket
+
+	r.packetHandler(&httpPacket)
+}
+
+// completeResponse sends the completed packet for stream to the packet handler, and forgets the stream.
+// r.mu must be held.
+func (r *http2Recorder) completeResponse(streamID uint32, stream *http2Stream) {
+	// The server can finish responding before the client finishes its request
+	r.completeRequest(stream)
+
+	completedPacket := packet.CreatePacket(
+		r.encrypted,
+		stream.authority,
+		stream.method,
+		stream.status,
+		stream.path,
+		http2Proto,
+		http2Proto,
+		stream.respHeaders,
+		nonNil(stream.respBody),
+		stream.reqHeaders,
+		nonNil(stream.reqBody),
+	)
+	completedPacket.ID = stream.packet.ID
+	completedPacket.ConnInfo = r.connInfo
+
+	delete(r.streams, streamID)
+	r.packetHandler(&completedPacket)
+}
+
+// addHeaders adds every field that isn't a pseudo header to headers.
+func addHeaders(headers http.Header, fields []hpack.HeaderField) {
+	for _, field := range fields {
+		if !strings.HasPrefix(field.Name, ":") {
+			headers.Add(field.Name, field.Value)
+		}
+	}
+}
+
+func nonNil(body []byte) []byte {
+	if body == nil {
+		return []byte{}
+	}
+
+	return body
+}
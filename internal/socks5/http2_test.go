@@ -0,0 +1,153 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// impersonate points the config dir at a temporary directory, so that interceptTLS impersonates servers with
+// certificates from a fresh gitm CA. The returned pool trusts that CA.
+func impersonate(t *testing.T) *x509.CertPool {
+	t.Helper()
+
+	useTempConfigDir(t)
+	caCert, _, err := getCaCert()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	return roots
+}
+
+// interceptTLSTo starts a listener that intercepts the tls connections it accepts, forwarding them to target.
+// The returned pool trusts the gitm CA target is impersonated with.
+func interceptTLSTo(t *testing.T, target *httptest.Server, conf *internal.Config, packetHandler func(packet.Packet)) (net.Listener, *x509.CertPool) {
+	t.Helper()
+
+	roots := impersonate(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close() //nolint:errcheck
+				server, err := net.Dial("tcp", target.Listener.Addr().String())
+				if err != nil {
+					return
+				}
+				defer server.Close() //nolint:errcheck
+				// Errors show up as missing packets, since this can outlive the test
+				_ = interceptTLS(client, server, conf, "127.0.0.1", packet.ConnInfo{Username: "bob"}, packetHandler)
+			}()
+		}
+	}()
+
+	return listener, roots
+}
+
+func TestInterceptTLSNegotiatesProtocol(t *testing.T) {
+	for _, serverHTTP2 := range []bool{true, false} {
+		t.Run(fmt.Sprintf("server http2 %v", serverHTTP2), func(t *testing.T) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				w.Header().Set("X-Test", "yes")
+				_, _ = fmt.Fprintf(w, "%s %s %s", r.Proto, r.URL.Path, body)
+			}))
+			server.EnableHTTP2 = serverHTTP2
+			server.StartTLS()
+			defer server.Close()
+
+			handler, wait := collectPackets()
+			listener, roots := interceptTLSTo(t, server, &internal.Config{}, handler)
+
+			transport := &http.Transport{
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{RootCAs: roots},
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, listener.Addr().String())
+				},
+			}
+			defer transport.CloseIdleConnections()
+			client := http.Client{Transport: transport}
+
+			expectedProto := "HTTP/1.1"
+			if serverHTTP2 {
+				expectedProto = http2Proto
+			}
+
+			for _, path := range []string{"/one", "/two"} {
+				resp, err := client.Post("https://example.com"+path, "text/plain", strings.NewReader("body"+path))
+				if err != nil {
+					t.Fatalf("Expected err = nil, got err = %v", err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+
+				if resp.Proto != expectedProto {
+					t.Errorf("resp.Proto = %s, want %s", resp.Proto, expectedProto)
+				}
+				if expected := fmt.Sprintf("%s %s body%s", expectedProto, path, path); string(body) != expected {
+					t.Errorf("body = %s, want %s", body, expected)
+				}
+			}
+
+			packets := wait(t, 2)
+			for _, path := range []string{"/one", "/two"} {
+				p := packets[path]
+				if p == nil {
+					t.Fatalf("No packet captured for %s", path)
+				}
+				if p.ReqProto != expectedProto || !p.Encrypted() || p.Username != "bob" || p.Method != http.MethodPost {
+					t.Errorf("packets[%s] = %s %s encrypted %v user %q, want POST %s encrypted for bob", path, p.Method, p.ReqProto, p.Encrypted(), p.Username, expectedProto)
+				}
+				if string(p.ReqBody) != "body"+path || !strings.HasSuffix(string(p.RespBody), path+" body"+path) {
+					t.Errorf("packets[%s] bodies = %q, %q", path, p.ReqBody, p.RespBody)
+				}
+				if p.Status != "200 OK" || p.RespHeaders["X-Test"] == nil {
+					t.Errorf("packets[%s] = status %s, headers %v, want 200 OK with X-Test", path, p.Status, p.RespHeaders)
+				}
+
+				expectedALPN := "http/1.1"
+				if serverHTTP2 {
+					expectedALPN = "h2"
+				}
+				if p.TLS == nil {
+					t.Fatalf("packets[%s].TLS = nil, want tls metadata", path)
+				}
+				if p.TLS.ServerName != "example.com" || p.TLS.Client.ALPN != expectedALPN || p.TLS.Server.ALPN != expectedALPN {
+					t.Errorf("packets[%s].TLS = %+v, want server name example.com and ALPN %s", path, p.TLS, expectedALPN)
+				}
+				if p.TLS.Server.Version != "TLS 1.3" || p.TLS.Server.CipherSuite == "" {
+					t.Errorf("packets[%s].TLS.Server = %+v, want TLS 1.3 with a cipher suite", path, p.TLS.Server)
+				}
+				if len(p.TLS.ServerCertificates) != 1 || !bytes.Equal(p.TLS.ServerCertificates[0], server.Certificate().Raw) {
+					t.Errorf("packets[%s].TLS.ServerCertificates = %d certificates, want the server's certificate", path, len(p.TLS.ServerCertificates))
+				}
+			}
+		})
+	}
+}
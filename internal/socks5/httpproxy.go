@@ -0,0 +1,299 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// ListenAndServeHTTPProxy starts an explicit http proxy which will pass any intercepted packets to packetHandler.
+// Absolute-form requests (i.e. "GET http://example.com/ HTTP/1.1") are forwarded to the origin server,
+// and CONNECT tunnels are intercepted the same way as socks5 connections.
+// If net.Listen fails for the server, an error is returned.
+func ListenAndServeHTTPProxy(conf internal.Config, packetHandler func(packet.Packet)) (net.Listener, error) {
+	return listenAndServe(net.ListenConfig{}, conf.HTTPProxyListenURI, conf, packetHandler, handleHTTPProxyConnection)
+}
+
+func handleHTTPProxyConnection(client net.Conn, conf *internal.Config, packetHandler func(packet.Packet)) error {
+	logger := slog.With("RemoteAddr", client.RemoteAddr(), "LocalAddr", client.LocalAddr())
+
+	inboundConn := newBufferedConn(client)
+	defer inboundConn.Close() //nolint:errcheck
+
+	connInfo := packet.ConnInfo{}
+	var request *http.Request
+	for {
+		var err error
+		if request, err = http.ReadRequest(inboundConn.reader); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading proxy request: %w", err)
+		}
+
+		if len(conf.SocksCredentials) == 0 {
+			break
+		}
+
+		if username, password, ok := parseProxyAuthorization(request); ok && checkCredentials(conf.SocksCredentials, username, password) {
+			connInfo.Username = username
+			break
+		}
+
+		// The client is expected to retry on the same connection with credentials
+		if _, err := io.Copy(io.Discard, request.Body); err != nil {
+			return fmt.Errorf("discarding request body: %w", err)
+		}
+		if _, err := io.WriteString(inboundConn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"gitm\"\r\nContent-Length: 0\r\n\r\n"); err != nil {
+			return fmt.Errorf("sending proxy authentication required: %w", err)
+		}
+	}
+
+	if connInfo.Username != "" {
+		logger = logger.With("Username", connInfo.Username)
+	}
+
+	conn := &absoluteFormConn{
+		Conn:   inboundConn,
+		reader: inboundConn.reader,
+		next:   request,
+	}
+
+	// Every iteration handles the requests for a single host, until the client asks for a different one
+	for conn.next != nil {
+		if conn.next.Method == http.MethodConnect {
+			return handleConnect(inboundConn, conf, conn.next, connInfo, packetHandler)
+		}
+
+		host, err := requestHost(conn.next)
+		if err != nil {
+			if _, err := io.WriteString(inboundConn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"); err != nil {
+				return fmt.Errorf("sending bad request: %w", err)
+			}
+			return err
+		}
+		conn.host = host
+
+		logger.Debug("Proxying absolute-form requests", "host", host)
+
+		if conn.next.URL.Hostname() == "gitm" {
+			return handleGITM(conn, conf)
+		}
+
+		if err := forwardRequests(conn, conf, host, connInfo, packetHandler); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forwardRequests forwards the requests read from conn to host, until conn returns io.EOF.
+func forwardRequests(conn *absoluteFormConn, conf *internal.Config, host string, connInfo packet.ConnInfo, packetHandler func(packet.Packet)) error {
+	dialer, err := newUpstreamDialer(conf)
+	if err != nil {
+		return err
+	}
+
+	server, err := dialer.Dial(host)
+	if err != nil {
+		if _, err := io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"); err != nil {
+			return fmt.Errorf("sending bad gateway: %w", err)
+		}
+		return fmt.Errorf("contacting proxied host: %w", err)
+	}
+	defer server.Close() //nolint:errcheck
+
+	return HandleHTTPRequest(conn, server, connInfo, packetHandler)
+}
+
+// handleConnect opens the tunnel requested by a CONNECT request, and intercepts the traffic sent through it.
+func handleConnect(client *bufferedConn, conf *internal.Config, request *http.Request, connInfo packet.ConnInfo, packetHandler func(packet.Packet)) error {
+	reply := func(status byte, _ net.Addr) error {
+		response := "HTTP/1.1 200 Connection Established\r\n\r\n"
+		if status != StatusSucceeded {
+			response = "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"
+		}
+		_, err := io.WriteString(client, response)
+		return err
+	}
+
+	host, portString, err := net.SplitHostPort(request.Host)
+	if err != nil {
+		if err := reply(StatusGeneralFailure, nil); err != nil {
+			return fmt.Errorf("sending bad gateway: %w", err)
+		}
+		return fmt.Errorf("parsing connect host: %w", err)
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		if err := reply(StatusGeneralFailure, nil); err != nil {
+			return fmt.Errorf("sending bad gateway: %w", err)
+		}
+		return fmt.Errorf("parsing connect port: %w", err)
+	}
+
+	return proxyConnect(client, conf, host, uint16(port), connInfo, packetHandler, reply)
+}
+
+// requestHost returns the host:port an absolute-form request should be sent to.
+func requestHost(request *http.Request) (string, error) {
+	if request.URL.Scheme != "http" || request.URL.Host == "" {
+		return "", fmt.Errorf("not an absolute-form http request: %q", request.RequestURI)
+	}
+
+	if request.URL.Port() == "" {
+		return net.JoinHostPort(request.URL.Hostname(), "80"), nil
+	}
+
+	return request.URL.Host, nil
+}
+
+// parseProxyAuthorization returns the username and password from the Proxy-Authorization header.
+func parseProxyAuthorization(request *http.Request) (string, string, bool) {
+	// Reuse the parsing of the Authorization header, which has the same format
+	authRequest := http.Request{Header: http.Header{"Authorization": request.Header.Values("Proxy-Authorization")}}
+
+	return authRequest.BasicAuth()
+}
+
+// absoluteFormConn rewrites the absolute-form requests read from a client of the explicit http proxy
+// into origin-form, so that they can be sent as is to the origin server by HandleHTTPRequest.
+//
+// Read returns io.EOF once the client sends a request for a host other than host,
+// and that request is kept in next.
+type absoluteFormConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// host is the host:port the requests are currently being sent to
+	host string
+	// next is the request that has been read from the client, but not returned by Read yet
+	next *http.Request
+	// streaming is the request whose body is being returned by Read.
+	// The body is read as it is needed, so that the client can wait for the server (i.e. Expect: 100-continue).
+	streaming *http.Request
+	// upgraded is set once the server accepts a protocol upgrade,
+	// since everything after it is passed through as is
+	upgraded bool
+	buffer   bytes.Buffer
+}
+
+func (c *absoluteFormConn) Read(b []byte) (int, error) {
+	for c.buffer.Len() == 0 {
+		if c.upgraded {
+			return c.reader.Read(b)
+		}
+
+		if c.streaming != nil {
+			if err := c.readBody(len(b)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if c.next == nil {
+			request, err := http.ReadRequest(c.reader)
+			if err != nil {
+				return 0, err
+			}
+			c.next = request
+		}
+
+		if host, err := requestHost(c.next); err != nil || host != c.host || c.next.Method == http.MethodConnect {
+			return 0, io.EOF
+		}
+
+		if err := writeOriginForm(&c.buffer, c.next); err != nil {
+			return 0, fmt.Errorf("rewriting request: %w", err)
+		}
+		if c.next.Body != http.NoBody {
+			c.streaming = c.next
+		}
+		c.next = nil
+	}
+
+	return c.buffer.Read(b)
+}
+
+// readBody reads up to size bytes of the body of c.streaming into c.buffer, in the same framing it was sent in.
+// c.streaming is cleared once the whole body has been read.
+func (c *absoluteFormConn) readBody(size int) error {
+	chunked := len(c.streaming.TransferEncoding) > 0
+
+	data := make([]byte, size)
+	n, err := c.streaming.Body.Read(data)
+	if n > 0 && chunked {
+		fmt.Fprintf(&c.buffer, "%x\r\n%s\r\n", n, data[:n])
+	} else if n > 0 {
+		c.buffer.Write(data[:n])
+	}
+
+	if errors.Is(err, io.EOF) {
+		if chunked {
+			// The trailer is only known once the body has been read
+			c.buffer.WriteString("0\r\n")
+			if err := c.streaming.Trailer.Write(&c.buffer); err != nil {
+				return fmt.Errorf("writing trailer: %w", err)
+			}
+			c.buffer.WriteString("\r\n")
+		}
+		c.streaming = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading request body: %w", err)
+	}
+
+	return nil
+}
+
+// upgrade is called by HandleHTTPRequest once the server answers a websocket upgrade with 101 Switching Protocols.
+// It is called from the goroutine reading from c, before anything after the upgrade is read.
+func (c *absoluteFormConn) upgrade() {
+	c.upgraded = true
+}
+
+// writeOriginForm writes the request line and headers of request to writer in origin-form,
+// without the headers meant for the proxy. The body is left to the caller.
+func writeOriginForm(writer io.Writer, request *http.Request) error {
+	request.Header.Del("Proxy-Authorization")
+	request.Header.Del("Proxy-Connection")
+
+	if _, err := fmt.Fprintf(writer, "%s %s HTTP/1.1\r\nHost: %s\r\n", request.Method, request.URL.RequestURI(), request.Host); err != nil {
+		return err
+	}
+
+	// http.ReadRequest moves these out of the headers, so they are written from what it parsed
+	if len(request.TransferEncoding) > 0 {
+		if _, err := io.WriteString(writer, "Transfer-Encoding: chunked\r\n"); err != nil {
+			return err
+		}
+	}
+	if len(request.Trailer) > 0 {
+		trailers := slices.Sorted(maps.Keys(request.Trailer))
+		if _, err := fmt.Fprintf(writer, "Trailer: %s\r\n", strings.Join(trailers, ", ")); err != nil {
+			return err
+		}
+	}
+
+	if err := request.Header.Write(writer); err != nil {
+		return err
+	}
+	_, err := io.WriteString(writer, "\r\n")
+
+	return err
+}
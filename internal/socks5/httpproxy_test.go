@@ -0,0 +1,257 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// startProxy starts a listener that handles every accepted connection with handler.
+// The address of the proxy is returned.
+func startProxy(
+	t *testing.T,
+	handler func(client net.Conn, conf *internal.Config, packetHandler func(packet.Packet)) error,
+	conf *internal.Config,
+	packetHandler func(packet.Packet),
+) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Errors show up as missing packets, since this can outlive the test
+			go func() { _ = handler(client, conf, packetHandler) }()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestHTTPProxyAbsoluteForm(t *testing.T) {
+	handlerFor := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.RequestURI != r.URL.Path || r.Header.Get("Proxy-Connection") != "" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			_, _ = fmt.Fprintf(w, "Hello from %s", name)
+		})
+	}
+	serverA := httptest.NewServer(handlerFor("a"))
+	defer serverA.Close()
+	serverB := httptest.NewServer(handlerFor("b"))
+	defer serverB.Close()
+
+	handler, wait := collectPackets()
+	proxyURL, _ := url.Parse("http://" + startProxy(t, handleHTTPProxyConnection, &internal.Config{}, handler))
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	defer transport.CloseIdleConnections()
+	client := http.Client{Transport: transport}
+
+	// The transport reuses the same proxy connection for both hosts
+	for _, target := range []string{serverA.URL + "/a", serverB.URL + "/b", serverA.URL + "/a2"} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status = 200, got status = %d", resp.StatusCode)
+		}
+	}
+
+	packets := wait(t, 3)
+	if p := packets["/b"]; p == nil || string(p.RespBody) != "Hello from b" {
+		t.Errorf("packets[/b] = %v, want response from b", p)
+	}
+	if p := packets["/a2"]; p == nil || string(p.RespBody) != "Hello from a" {
+		t.Errorf("packets[/a2] = %v, want response from a", p)
+	}
+}
+
+func TestHTTPProxyDeclinedUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Declines the upgrade, and checks the requests after it are still rewritten
+		if r.RequestURI != r.URL.Path {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", startProxy(t, handleHTTPProxyConnection, &internal.Config{}, func(packet.Packet) {}))
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	reader := bufio.NewReader(conn)
+
+	for _, headers := range []string{"Connection: Upgrade\r\nUpgrade: websocket\r\n", ""} {
+		if _, err := fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\n%s\r\n", server.URL, server.Listener.Addr(), headers); err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status = 200, got status = %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTPProxyAbsoluteFormExpectContinue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reading the body sends the 100 Continue
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "Got %s", body)
+	}))
+	defer server.Close()
+
+	handler, wait := collectPackets()
+	conn, err := net.Dial("tcp", startProxy(t, handleHTTPProxyConnection, &internal.Config{}, handler))
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		path    string
+		framing string
+		body    string
+	}{
+		{"/length", "Content-Length: 4", "body"},
+		{"/chunked", "Transfer-Encoding: chunked", "4\r\nbody\r\n0\r\n\r\n"},
+	}
+	for _, test := range tests {
+		if _, err := fmt.Fprintf(conn, "POST %s%s HTTP/1.1\r\nHost: %s\r\n%s\r\nExpect: 100-continue\r\n\r\n", server.URL, test.path, server.Listener.Addr(), test.framing); err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+
+		// The body is only sent once the server asks for it
+		interim, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("%s: Expected err = nil, got err = %v", test.path, err)
+		}
+		if interim.StatusCode != http.StatusContinue {
+			t.Fatalf("%s: interim.StatusCode = %d, want %d", test.path, interim.StatusCode, http.StatusContinue)
+		}
+
+		if _, err := io.WriteString(conn, test.body); err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("%s: Expected err = nil, got err = %v", test.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "Got body" {
+			t.Errorf("%s: body = %q, want Got body", test.path, body)
+		}
+	}
+
+	packets := wait(t, 2)
+	for _, test := range tests {
+		if p := packets[test.path]; p == nil || string(p.ReqBody) != "body" {
+			t.Errorf("packets[%s] = %v, want request body body", test.path, p)
+		}
+	}
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "Hello through a tunnel")
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var completed *packet.HTTPPacket
+	handler := func(p packet.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		if httpPacket, ok := p.(*packet.HTTPPacket); ok && httpPacket.Status != "" {
+			completed = httpPacket
+		}
+	}
+	conf := &internal.Config{SocksCredentials: []string{"alice:secret"}}
+
+	conn, err := net.Dial("tcp", startProxy(t, handleHTTPProxyConnection, conf, handler))
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	reader := bufio.NewReader(conn)
+
+	target := server.Listener.Addr().String()
+	connect := func(extraHeaders string) int {
+		t.Helper()
+		if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", target, target, extraHeaders); err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := connect(""); status != http.StatusProxyAuthRequired {
+		t.Fatalf("Expected status = 407, got status = %d", status)
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	if status := connect("Proxy-Authorization: Basic " + auth + "\r\n"); status != http.StatusOK {
+		t.Fatalf("Expected status = 200, got status = %d", status)
+	}
+
+	if _, err := io.WriteString(conn, "GET /tunnel HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	// The response is passed on to the client before the packet handler is called
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		p := completed
+		mu.Unlock()
+		if p != nil {
+			if p.Path != "/tunnel" || p.Username != "alice" {
+				t.Errorf("Captured %s for user %q, want /tunnel for user alice", p.Path, p.Username)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Timed out waiting for tunnelled packet")
+}
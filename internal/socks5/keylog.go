@@ -0,0 +1,41 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	keyLogMu sync.Mutex
+	// keyLogFiles are the key log files that have been opened, by path.
+	// They are kept open, since a failed write to a key log fails the handshake.
+	keyLogFiles = make(map[string]*os.File)
+)
+
+// keyLogWriter returns the writer for the NSS key log file at path, which tls session secrets are appended to.
+// nil is returned when path is empty.
+//
+// The secrets of both tls sessions of every intercepted connection are written to it,
+// the one with the client and the one with the server.
+func keyLogWriter(path string) (io.Writer, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+
+	if file := keyLogFiles[path]; file != nil {
+		return file, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening key log file: %w", err)
+	}
+	keyLogFiles[path] = file
+
+	return file, nil
+}
@@ -0,0 +1,59 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/redawl/gitm/internal"
+)
+
+func TestInterceptTLSKeyLog(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	keyLogFile := filepath.Join(t.TempDir(), "keys.log")
+	handler, wait := collectPackets()
+	listener, roots := interceptTLSTo(t, server, &internal.Config{KeyLogFile: keyLogFile}, handler)
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, listener.Addr().String())
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Get("https://example.com/keylog")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	_ = resp.Body.Close()
+	wait(t, 1)
+
+	keyLog, err := os.ReadFile(keyLogFile)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	// Each session is identified by its client random, so both sessions should be there
+	clientRandoms := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(string(keyLog)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("Malformed key log line %q", line)
+		}
+		if fields[0] == "CLIENT_TRAFFIC_SECRET_0" {
+			clientRandoms[fields[1]] = true
+		}
+	}
+	if len(clientRandoms) != 2 {
+		t.Errorf("Found secrets for %d sessions, want 2", len(clientRandoms))
+	}
+}
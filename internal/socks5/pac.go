@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/redawl/gitm/internal"
+)
+
+// pacPaths are the paths the proxy auto-config file is served at.
+// Clients using WPAD look for it at /wpad.dat.
+var pacPaths = []string{"/proxy.pac", "/wpad.dat"}
+
+// SetupPAC creates the server for the proxy auto-config file, listening on conf.PACListenURI.
+func SetupPAC(conf *internal.Config) *http.Server {
+	mux := http.NewServeMux()
+	for _, path := range pacPaths {
+		mux.HandleFunc("GET "+path, func(w http.ResponseWriter, r *http.Request) {
+			slog.Debug("Handling pac file request", "path", r.URL.Path)
+			writePAC(w, r, conf)
+		})
+	}
+
+	return &http.Server{Addr: conf.PACListenURI, Handler: mux}
+}
+
+// writePAC writes the proxy auto-config file for conf, as a response to r.
+func writePAC(w http.ResponseWriter, r *http.Request, conf *internal.Config) {
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	_, _ = io.WriteString(w, pacScript(conf, requestLocalAddr(r)))
+}
+
+// pacScript returns the FindProxyForURL function, which sends the hosts matching conf.PACDirectHosts DIRECT,
+// and, when there are conf.PACProxyHosts, everything not matching them too. Everything else is sent to gitm.
+//
+// The rules are matched like the upstream proxy bypass rules, so cidrs only match hosts that are ips.
+func pacScript(conf *internal.Config, localAddr net.Addr) string {
+	script := new(strings.Builder)
+	script.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(script, "\tvar proxy = %s;\n", strconv.Quote(pacProxies(conf, localAddr)))
+	script.WriteString("\thost = host.toLowerCase();\n")
+	// http://gitm is only reachable through gitm
+	script.WriteString("\tif (host == \"gitm\") {\n\t\treturn proxy;\n\t}\n")
+	if condition := pacCondition(conf.PACDirectHosts); condition != "" {
+		fmt.Fprintf(script, "\tif (%s) {\n\t\treturn \"DIRECT\";\n\t}\n", condition)
+	}
+	if condition := pacCondition(conf.PACProxyHosts); condition != "" {
+		fmt.Fprintf(script, "\tif (!(%s)) {\n\t\treturn \"DIRECT\";\n\t}\n", condition)
+	}
+	script.WriteString("\treturn proxy;\n}\n")
+
+	return script.String()
+}
+
+// pacProxies returns the proxies advertised in the PAC file, in the order clients should try them.
+func pacProxies(conf *internal.Config, localAddr net.Addr) string {
+	socksAddress := reachableAddress(conf.SocksListenURI, localAddr)
+	// Some clients only understand SOCKS, which gitm also accepts
+	socks := "SOCKS5 " + socksAddress + "; SOCKS " + socksAddress
+	if !conf.EnableHTTPProxy {
+		if conf.PACProxyType == internal.PACProxyHTTP {
+			slog.Warn("PAC file is set to advertise the http proxy, but it is disabled. Advertising the socks5 proxy instead")
+		}
+		return socks
+	}
+
+	httpProxy := "PROXY " + reachableAddress(conf.HTTPProxyListenURI, localAddr)
+	switch conf.PACProxyType {
+	case internal.PACProxySocks:
+		return socks
+	case internal.PACProxyHTTP:
+		return httpProxy
+	default:
+		// Clients that can't use socks fall back to the http proxy
+		return httpProxy + "; " + socks
+	}
+}
+
+// pacCondition returns the javascript condition matching the host against rules, or "" if there are no rules.
+func pacCondition(rules []string) string {
+	conditions := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if rule == "" {
+			continue
+		}
+
+		if rule == "*" {
+			conditions = append(conditions, "true")
+			continue
+		}
+
+		if _, cidr, err := net.ParseCIDR(rule); err == nil {
+			if len(cidr.Mask) == net.IPv4len {
+				conditions = append(conditions, fmt.Sprintf("(/^[0-9.]+$/.test(host) && isInNet(host, %s, %s))",
+					strconv.Quote(cidr.IP.String()), strconv.Quote(net.IP(cidr.Mask).String())))
+			} else {
+				// isInNetEx is the IPv6 aware extension supported by most browsers
+				conditions = append(conditions, fmt.Sprintf("(typeof isInNetEx == \"function\" && host.indexOf(\":\") >= 0 && isInNetEx(host, %s))",
+					strconv.Quote(cidr.String())))
+			}
+			continue
+		}
+
+		if ip := net.ParseIP(rule); ip != nil {
+			conditions = append(conditions, fmt.Sprintf("host == %s", strconv.Quote(ip.String())))
+			continue
+		}
+
+		domain := strings.TrimPrefix(strings.TrimPrefix(rule, "*"), ".")
+		conditions = append(conditions, fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", strconv.Quote(domain), strconv.Quote("."+domain)))
+	}
+
+	return strings.Join(conditions, " ||\n\t\t")
+}
@@ -0,0 +1,79 @@
+package socks5
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redawl/gitm/internal"
+)
+
+func TestPACScript(t *testing.T) {
+	conf := &internal.Config{
+		SocksListenURI:     "0.0.0.0:1080",
+		HTTPProxyListenURI: "127.0.0.1:3128",
+		EnableHTTPProxy:    true,
+		PACDirectHosts:     []string{"internal.example.com", "10.0.0.0/8", "fd00::/8"},
+		PACProxyHosts:      []string{"example.com", "192.168.1.1"},
+	}
+	localAddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 8080}
+
+	script := pacScript(conf, localAddr)
+	for _, expected := range []string{
+		`var proxy = "PROXY 127.0.0.1:3128; SOCKS5 192.168.1.10:1080; SOCKS 192.168.1.10:1080";`,
+		`if (host == "gitm") {`,
+		`host == "internal.example.com" || dnsDomainIs(host, ".internal.example.com")`,
+		`isInNet(host, "10.0.0.0", "255.0.0.0")`,
+		`isInNetEx(host, "fd00::/8")`,
+		`if (!(host == "example.com" || dnsDomainIs(host, ".example.com") ||`,
+		`host == "192.168.1.1"`,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Expected script to contain %s, got:\n%s", expected, script)
+		}
+	}
+
+	for proxyType, expected := range map[string]string{
+		internal.PACProxyAll:   "PROXY 127.0.0.1:3128; SOCKS5 192.168.1.10:1080; SOCKS 192.168.1.10:1080",
+		internal.PACProxySocks: "SOCKS5 192.168.1.10:1080; SOCKS 192.168.1.10:1080",
+		internal.PACProxyHTTP:  "PROXY 127.0.0.1:3128",
+	} {
+		conf.PACProxyType = proxyType
+		if actual := pacProxies(conf, localAddr); actual != expected {
+			t.Errorf("pacProxies(%s) = %s, expected %s", proxyType, actual, expected)
+		}
+	}
+
+	// The http proxy can't be advertised when it is disabled
+	conf.EnableHTTPProxy = false
+	if actual := pacProxies(conf, localAddr); strings.Contains(actual, "PROXY") {
+		t.Errorf("pacProxies() = %s, expected only the socks5 proxy", actual)
+	}
+}
+
+func TestSetupPAC(t *testing.T) {
+	server := httptest.NewServer(SetupPAC(&internal.Config{SocksListenURI: "127.0.0.1:1080"}).Handler)
+	defer server.Close()
+
+	for path, expectedStatus := range map[string]int{
+		"/proxy.pac": http.StatusOK,
+		"/wpad.dat":  http.StatusOK,
+		"/":          http.StatusNotFound,
+		"/ca.crt":    http.StatusNotFound,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		resp.Body.Close() //nolint:errcheck
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("GET %s: Expected status = %d, got status = %d", path, expectedStatus, resp.StatusCode)
+		}
+		if expectedStatus == http.StatusOK && resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+			t.Errorf("GET %s: Expected pac content type, got %s", path, resp.Header.Get("Content-Type"))
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package socks5
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 
@@ -28,6 +30,39 @@ func ParseClientGreeting(conn net.Conn) (*ClientGreeting, error) {
 	}, nil
 }
 
+func ParseUsernamePasswordRequest(conn net.Conn) (*UsernamePasswordRequest, error) {
+	buff, err := util.ReadCount(conn, 2)
+	if err != nil {
+		return nil, fmt.Errorf("reading version: %w", err)
+	}
+
+	ver := buff[0]
+	if ver != AuthVer1 {
+		return nil, fmt.Errorf("unsupported auth version: %d", ver)
+	}
+
+	username, err := util.ReadCount(conn, int(buff[1]))
+	if err != nil {
+		return nil, fmt.Errorf("reading username: %w", err)
+	}
+
+	passwordLength, err := util.ReadCount(conn, 1)
+	if err != nil {
+		return nil, fmt.Errorf("reading password length: %w", err)
+	}
+
+	password, err := util.ReadCount(conn, int(passwordLength[0]))
+	if err != nil {
+		return nil, fmt.Errorf("reading password: %w", err)
+	}
+
+	return &UsernamePasswordRequest{
+		Ver:      ver,
+		Username: string(username),
+		Password: string(password),
+	}, nil
+}
+
 func ParseClientConnRequest(conn net.Conn) (*ClientConnRequest, byte, error) {
 	buff, err := util.ReadCount(conn, 4)
 	if err != nil {
@@ -38,57 +73,156 @@ func ParseClientConnRequest(conn net.Conn) (*ClientConnRequest, byte, error) {
 	cmd := buff[1]
 	rsv := buff[2]
 	dstIpType := buff[3]
-	dstIp := ""
 
-	if cmd != CmdConnect {
+	if cmd != CmdConnect && cmd != CmdBind && cmd != CmdUDPAssociate {
 		slog.Error("Unsupported command", "command", cmd)
-		return nil, StatusCommandNotSupported, fmt.Errorf("cmd was not connect: %d", cmd)
+		return nil, StatusCommandNotSupported, fmt.Errorf("cmd not supported: %d", cmd)
+	}
+
+	dstIp, dstPort, status, err := parseAddress(conn, dstIpType)
+	if err != nil {
+		return nil, status, err
+	}
+
+	return &ClientConnRequest{
+		Ver:       ver,
+		Cmd:       cmd,
+		Rsv:       rsv,
+		DstIPType: dstIpType,
+		DstIP:     dstIp,
+		DstPort:   dstPort,
+	}, StatusSucceeded, nil
+}
+
+// ParseSocks4Request reads a SOCKS4 request, or a SOCKS4a request if the client sends a domain name instead of an ip.
+func ParseSocks4Request(conn net.Conn) (*Socks4Request, error) {
+	buff, err := util.ReadCount(conn, 8)
+	if err != nil {
+		return nil, fmt.Errorf("reading first bytes: %w", err)
+	}
+
+	ver := buff[0]
+	if ver != SocksVer4 {
+		return nil, fmt.Errorf("unsupported socks version: %d", ver)
+	}
+
+	userID, err := readNullTerminated(conn)
+	if err != nil {
+		return nil, fmt.Errorf("reading user id: %w", err)
+	}
+
+	dstIp := net.IP(buff[4:8]).String()
+	// SOCKS4a signals that a domain name follows the user id with the address 0.0.0.x, where x is non zero
+	if buff[4] == 0 && buff[5] == 0 && buff[6] == 0 && buff[7] != 0 {
+		domain, err := readNullTerminated(conn)
+		if err != nil {
+			return nil, fmt.Errorf("reading domain name: %w", err)
+		}
+
+		dstIp = domain
+	}
+
+	return &Socks4Request{
+		Ver:     ver,
+		Cmd:     buff[1],
+		DstPort: uint16(buff[2])<<8 + uint16(buff[3]),
+		DstIP:   dstIp,
+		UserID:  userID,
+	}, nil
+}
+
+// ParseUDPRequest decapsulates a datagram sent by the client to the udp relay.
+func ParseUDPRequest(datagram []byte) (*UDPRequest, error) {
+	reader := bytes.NewReader(datagram)
+	buff, err := util.ReadCount(reader, 4)
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	rsv := uint16(buff[0])<<8 + uint16(buff[1])
+	frag := buff[2]
+	dstIpType := buff[3]
+
+	dstIp, dstPort, _, err := parseAddress(reader, dstIpType)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("reading data: %w", err)
 	}
-	switch dstIpType {
+
+	return &UDPRequest{
+		Rsv:       rsv,
+		Frag:      frag,
+		DstIPType: dstIpType,
+		DstIP:     dstIp,
+		DstPort:   dstPort,
+		Data:      data,
+	}, nil
+}
+
+// parseAddress reads an address of type addressType, followed by a port.
+// The status to reply with is returned along with any error.
+func parseAddress(reader io.Reader, addressType byte) (string, uint16, byte, error) {
+	ip := ""
+	switch addressType {
 	case AddressTypeIPv4:
-		buff, err = util.ReadCount(conn, 4)
+		buff, err := util.ReadCount(reader, 4)
 		if err != nil {
-			return nil, StatusGeneralFailure, fmt.Errorf("reading ipv4: %w", err)
+			return "", 0, StatusGeneralFailure, fmt.Errorf("reading ipv4: %w", err)
 		}
-		dstIp = fmt.Sprintf("%d.%d.%d.%d", buff[0], buff[1], buff[2], buff[3])
+		ip = fmt.Sprintf("%d.%d.%d.%d", buff[0], buff[1], buff[2], buff[3])
+	case AddressTypeIPv6:
+		buff, err := util.ReadCount(reader, net.IPv6len)
+		if err != nil {
+			return "", 0, StatusGeneralFailure, fmt.Errorf("reading ipv6: %w", err)
+		}
+		ip = net.IP(buff).String()
 	case AddressTypeDomainName:
-		domainLength, err := util.ReadCount(conn, 1)
+		domainLength, err := util.ReadCount(reader, 1)
 		if err != nil {
-			return nil, StatusGeneralFailure, fmt.Errorf("reading domain name length: %w", err)
+			return "", 0, StatusGeneralFailure, fmt.Errorf("reading domain name length: %w", err)
 		}
 
-		domain, err := util.ReadCount(conn, int(domainLength[0]))
+		domain, err := util.ReadCount(reader, int(domainLength[0]))
 		if err != nil {
-			return nil, StatusGeneralFailure, fmt.Errorf("reading domain name: %w", err)
+			return "", 0, StatusGeneralFailure, fmt.Errorf("reading domain name: %w", err)
 		}
 
-		// Special handling here for our internal hostname
-		if string(domain) == "gitm" {
-			dstIp = "gitm"
-		} else {
-			lookups, err := net.LookupIP(string(domain))
-			if err != nil {
-				return nil, StatusHostUnreachable, fmt.Errorf("looking up ip for domain name: %w", err)
-			}
-			dstIp = lookups[0].String()
-		}
+		// Domain names are resolved when dialing, so that they can be matched against
+		// the upstream proxy bypass rules, and resolved by the upstream proxy
+		ip = string(domain)
 	default:
-		return nil, StatusAddressTypeNotSupported, fmt.Errorf("address type not supported: %d", dstIpType)
+		return "", 0, StatusAddressTypeNotSupported, fmt.Errorf("address type not supported: %d", addressType)
 	}
 
-	buff, err = util.ReadCount(conn, 2)
+	buff, err := util.ReadCount(reader, 2)
 	if err != nil {
-		return nil, StatusGeneralFailure, fmt.Errorf("reading dst port: %w", err)
+		return "", 0, StatusGeneralFailure, fmt.Errorf("reading dst port: %w", err)
 	}
 
-	dstPort := uint16(buff[0])<<8 + uint16(buff[1])
+	return ip, uint16(buff[0])<<8 + uint16(buff[1]), StatusSucceeded, nil
+}
 
-	return &ClientConnRequest{
-		Ver:       ver,
-		Cmd:       cmd,
-		Rsv:       rsv,
-		DstIPType: dstIpType,
-		DstIP:     dstIp,
-		DstPort:   dstPort,
-	}, StatusSucceeded, nil
+// readNullTerminated reads a string terminated by a null byte, as used by SOCKS4.
+// The null byte is consumed, but not returned.
+func readNullTerminated(reader io.Reader) (string, error) {
+	var str []byte
+	for {
+		buff, err := util.ReadCount(reader, 1)
+		if err != nil {
+			return "", err
+		}
+
+		if buff[0] == 0x00 {
+			return string(str), nil
+		}
+
+		if len(str) == 255 {
+			return "", fmt.Errorf("string longer than 255 bytes")
+		}
+		str = append(str, buff[0])
+	}
 }
@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseUsernamePasswordRequest(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close() //nolint:errcheck
+	defer server.Close() //nolint:errcheck
+
+	go func() {
+		_, _ = client.Write([]byte{AuthVer1, 5, 'a', 'l', 'i', 'c', 'e', 3, 'p', 'w', 'd'})
+	}()
+
+	request, err := ParseUsernamePasswordRequest(server)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	if request.Username != "alice" || request.Password != "pwd" {
+		t.Errorf("ParseUsernamePasswordRequest(...) = %s:%s, want alice:pwd", request.Username, request.Password)
+	}
+}
+
+func TestParseUsernamePasswordRequestBadVersion(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close() //nolint:errcheck
+	defer server.Close() //nolint:errcheck
+
+	go func() {
+		_, _ = client.Write([]byte{SocksVer5, 1, 'a', 1, 'b'})
+	}()
+
+	if _, err := ParseUsernamePasswordRequest(server); err == nil {
+		t.Errorf("Expected err != nil, got err = nil")
+	}
+}
+
+func TestParseClientConnRequestIPv6(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close() //nolint:errcheck
+	defer server.Close() //nolint:errcheck
+
+	go func() {
+		request := []byte{SocksVer5, CmdConnect, 0x00, AddressTypeIPv6}
+		request = append(request, net.ParseIP("2001:db8::1")...)
+		request = append(request, 0x01, 0xbb)
+		_, _ = client.Write(request)
+	}()
+
+	request, status, err := ParseClientConnRequest(server)
+	if err != nil || status != StatusSucceeded {
+		t.Fatalf("Expected err = nil, got err = %v, status = %x", err, status)
+	}
+
+	if request.DstIP != "2001:db8::1" || request.DstPort != 443 {
+		t.Errorf("ParseClientConnRequest(...) = %s port %d, want 2001:db8::1 port 443", request.DstIP, request.DstPort)
+	}
+}
+
+func TestParseSocks4aRequest(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close() //nolint:errcheck
+	defer server.Close() //nolint:errcheck
+
+	go func() {
+		request := []byte{SocksVer4, CmdConnect, 0x00, 0x50, 0x00, 0x00, 0x00, 0x01}
+		request = append(request, "bob\x00gitm\x00"...)
+		_, _ = client.Write(request)
+	}()
+
+	request, err := ParseSocks4Request(server)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	if request.DstIP != "gitm" || request.DstPort != 80 || request.UserID != "bob" {
+		t.Errorf("ParseSocks4Request(...) = %s port %d user %s, want gitm port 80 user bob", request.DstIP, request.DstPort, request.UserID)
+	}
+}
@@ -0,0 +1,151 @@
+package socks5
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// shouldInterceptTLS returns whether the tls connection to dstHost, for serverName, is intercepted.
+// Either name matching conf.TLSPassthroughHosts, or having been learned as pinned, passes the connection through. Otherwise, when there are
+// conf.TLSInterceptHosts, only connections where either name matches them are intercepted.
+func shouldInterceptTLS(conf *internal.Config, serverName string, dstHost string) bool {
+	matches := func(rules []string) bool {
+		return (serverName != "" && matchesHost(serverName, rules)) || matchesHost(dstHost, rules)
+	}
+
+	if matches(conf.TLSPassthroughHosts) || pinnedHosts.isPinned(serverName) || pinnedHosts.isPinned(dstHost) {
+		return false
+	}
+	if len(conf.TLSInterceptHosts) > 0 {
+		return matches(conf.TLSInterceptHosts)
+	}
+
+	return true
+}
+
+// hasServerNameRules returns whether connections can be passed through because of their server name alone,
+// i.e. because conf.TLSPassthroughHosts has domains, or hosts were learned as pinned.
+func hasServerNameRules(conf *internal.Config) bool {
+	for _, rule := range conf.TLSPassthroughHosts {
+		rule = strings.TrimSpace(rule)
+		if rule == "" || rule == "*" || net.ParseIP(rule) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(rule); err == nil {
+			continue
+		}
+
+		return true
+	}
+
+	return pinnedHosts.hasPinned()
+}
+
+// passthroughTLS forwards the tls connection from client to server without intercepting it.
+// Only its metadata is recorded: the server name the client sent, and the number of bytes relayed.
+// remoteAddr is the address the client asked to connect to.
+func passthroughTLS(client net.Conn, server net.Conn, remoteAddr string, serverName string, connInfo packet.ConnInfo, packetHandler func(packet.Packet)) {
+	streamPacket := packet.CreateStreamPacket(remoteAddr)
+	streamPacket.ConnInfo = connInfo
+	streamPacket.Passthrough = true
+	streamPacket.ServerName = serverName
+	relayStream(client, server, streamPacket, packetHandler)
+}
+
+// pinnedHosts tracks the hosts whose clients reject gitm's certificates.
+var pinnedHosts = newPinnedHostTracker()
+
+// pinnedHostTracker counts the handshakes in a row clients failed for each host, and remembers the hosts
+// that reached the threshold, so they are passed through before the ui adds them to conf.TLSPassthroughHosts.
+type pinnedHostTracker struct {
+	mu       sync.Mutex
+	failures map[string]int
+	pinned   map[string]bool
+}
+
+func newPinnedHostTracker() *pinnedHostTracker {
+	return &pinnedHostTracker{
+		failures: make(map[string]int),
+		pinned:   make(map[string]bool),
+	}
+}
+
+// handshakeFailed counts a failed handshake for host. It returns the number of handshakes in a row that failed,
+// and whether host was pinned because of this one.
+func (t *pinnedHostTracker) handshakeFailed(host string, threshold int) (int, bool) {
+	host = strings.ToLower(host)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failures[host]++
+	if threshold <= 0 || t.failures[host] < threshold || t.pinned[host] {
+		return t.failures[host], false
+	}
+
+	t.pinned[host] = true
+	return t.failures[host], true
+}
+
+// handshakeSucceeded resets the failures counted for host.
+func (t *pinnedHostTracker) handshakeSucceeded(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.failures, strings.ToLower(host))
+}
+
+func (t *pinnedHostTracker) isPinned(host string) bool {
+	if host == "" {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.pinned[strings.ToLower(host)]
+}
+
+func (t *pinnedHostTracker) hasPinned() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.pinned) > 0
+}
+
+// reset forgets every host, i.e. once the learned hosts are part of conf.TLSPassthroughHosts.
+func (t *pinnedHostTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clear(t.failures)
+	clear(t.pinned)
+}
+
+// recordHandshakeFailure records that the client rejected gitm's certificate for host as a TLSFailurePacket.
+// After conf.TLSPinnedFailureThreshold failures in a row, the host's connections are passed through.
+//
+// interceptTLS only records handshakes that failed after the certificate was presented, since those are the ones
+// the client rejected, i.e. because it pins the server's certificate.
+func recordHandshakeFailure(
+	conf *internal.Config,
+	remoteAddr string,
+	serverName string,
+	host string,
+	reason string,
+	connInfo packet.ConnInfo,
+	packetHandler func(packet.Packet),
+) {
+	failurePacket := packet.CreateTLSFailurePacket(remoteAddr, serverName, host, reason)
+	failurePacket.ConnInfo = connInfo
+	failurePacket.Failures, failurePacket.Passthrough = pinnedHosts.handshakeFailed(host, conf.TLSPinnedFailureThreshold)
+	if failurePacket.Passthrough {
+		slog.Warn("Client keeps rejecting gitm's certificate, passing the host through from now on", "Host", host, "Failures", failurePacket.Failures)
+	}
+
+	packetHandler(failurePacket)
+}
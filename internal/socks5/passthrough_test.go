@@ -0,0 +1,328 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+func TestShouldInterceptTLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		conf       *internal.Config
+		serverName string
+		dstHost    string
+		expected   bool
+	}{
+		{"no rules", &internal.Config{}, "example.com", "93.184.215.14", true},
+		{"passthrough server name", &internal.Config{TLSPassthroughHosts: []string{"bank.example.com"}}, "bank.example.com", "93.184.215.14", false},
+		{"passthrough subdomain", &internal.Config{TLSPassthroughHosts: []string{"example.com"}}, "login.example.com", "93.184.215.14", false},
+		{"passthrough cidr", &internal.Config{TLSPassthroughHosts: []string{"10.0.0.0/8"}}, "", "10.1.2.3", false},
+		{"passthrough other host", &internal.Config{TLSPassthroughHosts: []string{"bank.example.com"}}, "example.com", "93.184.215.14", true},
+		{"intercept listed", &internal.Config{TLSInterceptHosts: []string{"example.com"}}, "api.example.com", "93.184.215.14", true},
+		{"intercept unlisted", &internal.Config{TLSInterceptHosts: []string{"example.com"}}, "example.org", "93.184.215.14", false},
+		{"intercept without server name", &internal.Config{TLSInterceptHosts: []string{"example.com"}}, "", "example.com", true},
+		{
+			"passthrough wins",
+			&internal.Config{TLSInterceptHosts: []string{"example.com"}, TLSPassthroughHosts: []string{"sso.example.com"}},
+			"sso.example.com", "93.184.215.14", false,
+		},
+	}
+
+	for _, test := range tests {
+		if actual := shouldInterceptTLS(test.conf, test.serverName, test.dstHost); actual != test.expected {
+			t.Errorf("%s: Expected shouldInterceptTLS = %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestHasServerNameRules(t *testing.T) {
+	t.Cleanup(pinnedHosts.reset)
+
+	tests := []struct {
+		rules    []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"*", "10.0.0.0/8", "::1"}, false},
+		{[]string{"10.0.0.0/8", "bank.example.com"}, true},
+	}
+	for _, test := range tests {
+		if actual := hasServerNameRules(&internal.Config{TLSPassthroughHosts: test.rules}); actual != test.expected {
+			t.Errorf("hasServerNameRules(%v) = %v, want %v", test.rules, actual, test.expected)
+		}
+	}
+
+	pinnedHosts.handshakeFailed("pinned.example.com", 1)
+	if !hasServerNameRules(&internal.Config{}) {
+		t.Errorf("Expected pinned hosts to count as server name rules")
+	}
+}
+
+func TestUnreadableClientHelloPassedThrough(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer server.Close() //nolint:errcheck
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+
+	conf := &internal.Config{TLSPassthroughHosts: []string{"bank.example.com"}}
+	conn, err := net.Dial("tcp", startProxy(t, handleHTTPProxyConnection, conf, func(packet.Packet) {}))
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", server.Addr(), server.Addr()); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect}); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status = 200, got resp = %v, err = %v", resp, err)
+	}
+
+	// A handshake record that holds a ServerHello instead of a ClientHello
+	hello := []byte{recordTypeHandshake, 0x03, 0x01, 0x00, 0x04, handshakeTypeServerHello, 0x00, 0x00, 0x00}
+	if _, err := conn.Write(hello); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, hello) {
+			t.Errorf("Expected the record to be passed through untouched, got %x", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the record to be passed through")
+	}
+}
+
+func TestPassthroughTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "not intercepted")
+	}))
+	defer server.Close()
+
+	var (
+		mu     sync.Mutex
+		closed *packet.StreamPacket
+	)
+	handler := func(p packet.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		if streamPacket, ok := p.(*packet.StreamPacket); ok && streamPacket.Closed {
+			closed = streamPacket
+		}
+	}
+	conf := &internal.Config{TLSPassthroughHosts: []string{"example.com"}}
+	proxyURL, _ := url.Parse("http://" + startProxy(t, handleHTTPProxyConnection, conf, handler))
+
+	// The client only trusts the server's own certificate, so the connection can't have been intercepted
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	transport.TLSClientConfig.ServerName = "example.com"
+	client := http.Client{Transport: transport}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "not intercepted" {
+		t.Errorf("Expected body = not intercepted, got body = %s", body)
+	}
+	transport.CloseIdleConnections()
+
+	waitFor := func() *packet.StreamPacket {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			streamPacket := closed
+			mu.Unlock()
+			if streamPacket != nil {
+				return streamPacket
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for the passthrough packet")
+		return nil
+	}
+	streamPacket := waitFor()
+
+	if !streamPacket.Passthrough || streamPacket.ServerName != "example.com" {
+		t.Errorf("Expected a passthrough packet for example.com, got %+v", streamPacket)
+	}
+	if streamPacket.ClientBytes == 0 || streamPacket.ServerBytes == 0 || len(streamPacket.ClientData) != 0 || len(streamPacket.ServerData) != 0 {
+		t.Errorf("Expected only byte counts to be recorded, got %+v", streamPacket)
+	}
+	if streamPacket.Fingerprints == nil || !strings.HasPrefix(streamPacket.Fingerprints.JA4, "t13d") || streamPacket.Fingerprints.JA4S == "" {
+		t.Errorf("Expected the hellos to be fingerprinted, got %+v", streamPacket.Fingerprints)
+	}
+	if _, port, _ := net.SplitHostPort(server.Listener.Addr().String()); streamPacket.FormatHostname() != "example.com:"+port {
+		t.Errorf("Expected hostname = example.com:%s, got hostname = %s", port, streamPacket.FormatHostname())
+	}
+}
+
+// tcpPair returns both ends of a tcp connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer listener.Close() //nolint:errcheck
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = dialed.Close()
+		_ = accepted.Close()
+	})
+
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func TestPassthroughTLSCloseWrite(t *testing.T) {
+	client, proxyClient := tcpPair(t)
+	proxyServer, remote := tcpPair(t)
+
+	done := make(chan struct{})
+	go func() {
+		// Clients are always buffered, since their protocol is sniffed first
+		passthroughTLS(newBufferedConn(proxyClient), proxyServer, "127.0.0.1:443", "", packet.ConnInfo{}, func(packet.Packet) {})
+		close(done)
+	}()
+
+	if _, err := remote.Write([]byte("goodbye")); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	_ = remote.CloseWrite()
+
+	// The client only sees EOF if the remote's CloseWrite is passed on
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, err := io.ReadAll(client); err != nil || string(data) != "goodbye" {
+		t.Fatalf("Expected data = goodbye, err = nil, got data = %q, err = %v", data, err)
+	}
+	_ = client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("passthroughTLS did not return after the connections closed")
+	}
+}
+
+func TestPinnedHostTracker(t *testing.T) {
+	tracker := newPinnedHostTracker()
+
+	for i, expectedPinned := range []bool{false, true, false} {
+		failures, pinned := tracker.handshakeFailed("Pinned.example.com", 2)
+		if failures != i+1 || pinned != expectedPinned {
+			t.Errorf("Failure %d: Expected failures = %d, pinned = %v, got failures = %d, pinned = %v", i, i+1, expectedPinned, failures, pinned)
+		}
+	}
+	if !tracker.isPinned("pinned.example.com") {
+		t.Errorf("Expected pinned.example.com to be pinned")
+	}
+
+	// A successful handshake starts the count over
+	tracker.handshakeFailed("flaky.example.com", 2)
+	tracker.handshakeSucceeded("flaky.example.com")
+	if _, pinned := tracker.handshakeFailed("flaky.example.com", 2); pinned || tracker.isPinned("flaky.example.com") {
+		t.Errorf("Expected flaky.example.com not to be pinned")
+	}
+
+	// Hosts are never pinned when the threshold is 0
+	for range 5 {
+		tracker.handshakeFailed("disabled.example.com", 0)
+	}
+	if tracker.isPinned("disabled.example.com") {
+		t.Errorf("Expected disabled.example.com not to be pinned")
+	}
+
+	tracker.reset()
+	if tracker.isPinned("pinned.example.com") {
+		t.Errorf("Expected reset to forget pinned.example.com")
+	}
+}
+
+func TestInterceptTLSLearnsPinnedHosts(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	failures := make(chan *packet.TLSFailurePacket, 2)
+	conf := &internal.Config{TLSPinnedFailureThreshold: 2}
+	listener, _ := interceptTLSTo(t, server, conf, func(p packet.Packet) {
+		if failurePacket, ok := p.(*packet.TLSFailurePacket); ok {
+			failures <- failurePacket
+		}
+	})
+	t.Cleanup(pinnedHosts.reset)
+
+	for i := 1; i <= 2; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		// The client trusts no CA, like a client pinning a certificate gitm doesn't have
+		client := tls.Client(conn, &tls.Config{ServerName: "learned.example.com", RootCAs: x509.NewCertPool()})
+		if err := client.Handshake(); err == nil {
+			t.Errorf("Expected the client to reject the certificate")
+		}
+		_ = client.Close()
+
+		select {
+		case failurePacket := <-failures:
+			if failurePacket.ServerName != "learned.example.com" || failurePacket.Host != "learned.example.com" {
+				t.Errorf("Expected a failure for learned.example.com, got %+v", failurePacket)
+			}
+			if !strings.HasPrefix(failurePacket.Reason, "remote error: tls: ") {
+				t.Errorf("Expected the alert as the reason, got reason = %s", failurePacket.Reason)
+			}
+			if failurePacket.Fingerprints == nil || failurePacket.Fingerprints.JA4 == "" {
+				t.Errorf("Expected the ClientHello to be fingerprinted, got %+v", failurePacket.Fingerprints)
+			}
+			if failurePacket.Failures != i || failurePacket.Passthrough != (i == 2) {
+				t.Errorf("Expected failures = %d, passthrough = %v, got failures = %d, passthrough = %v", i, i == 2, failurePacket.Failures, failurePacket.Passthrough)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for failure %d", i)
+		}
+	}
+
+	if shouldInterceptTLS(conf, "learned.example.com", "127.0.0.1") {
+		t.Errorf("Expected learned.example.com to be passed through")
+	}
+}
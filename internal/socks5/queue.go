@@ -0,0 +1,56 @@
+package socks5
+
+import (
+	"sync"
+
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// packetQueue passes packets to packetHandler one at a time, in the order they were queued.
+// Packets are handled on a goroutine of the queue's own, so that a slow packet handler
+// (i.e. one waiting on the ui) doesn't hold up the connection the packets were captured from.
+type packetQueue struct {
+	packetHandler func(packet.Packet)
+	mu            sync.Mutex
+	packets       []packet.Packet
+	// draining is set while a goroutine is handling the queued packets
+	draining bool
+}
+
+// queuePackets returns a packet handler that queues packets for packetHandler.
+// Each connection should get its own queue, so that connections don't wait on each other.
+func queuePackets(packetHandler func(packet.Packet)) func(packet.Packet) {
+	queue := &packetQueue{packetHandler: packetHandler}
+
+	return queue.handle
+}
+
+// handle queues p, and starts a goroutine to handle it if there isn't one already.
+func (q *packetQueue) handle(p packet.Packet) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.packets = append(q.packets, p)
+	if !q.draining {
+		q.draining = true
+		go q.drain()
+	}
+}
+
+// drain handles the queued packets until there are none left.
+func (q *packetQueue) drain() {
+	for {
+		q.mu.Lock()
+		if len(q.packets) == 0 {
+			q.draining = false
+			q.mu.Unlock()
+			return
+		}
+		p := q.packets[0]
+		q.packets[0] = nil
+		q.packets = q.packets[1:]
+		q.mu.Unlock()
+
+		q.packetHandler(p)
+	}
+}
@@ -1,50 +1,45 @@
 package socks5
 
 import (
-	"bufio"
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
-	"net/http"
-	"net/textproto"
-	"os"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/redawl/gitm/internal"
-	"github.com/redawl/gitm/internal/db"
 	"github.com/redawl/gitm/internal/packet"
-	"github.com/redawl/gitm/internal/util"
+	"golang.org/x/net/http2"
 )
 
 var (
-	ClientConfig = &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10}
+	ClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+		// The application protocols that can be intercepted.
+		// Only the ones the client also offers are offered to the server.
+		NextProtos: []string{http2.NextProtoTLS, "http/1.1"},
+	}
 	ServerConfig = &tls.Config{
 		// Make sure we can forward ALL tls traffic
 		// (or as much as possible with go)
 		MinVersion: tls.VersionTLS10,
+		NextProtos: []string{http2.NextProtoTLS, "http/1.1"},
 		// If client doesn't care about verifying, neither do we
 		InsecureSkipVerify: true,
 		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			domainInfo, err := db.GetDomain(chi.ServerName)
-			if err != nil {
-				return nil, err
-			}
-
-			if domainInfo == nil {
-				if domainInfo, err = AddHostname(chi.ServerName); err != nil {
-					return nil, err
-				}
+			if chi.ServerName == "" {
+				return nil, errors.New("client sent no server name")
 			}
 
-			certificate, err := tls.X509KeyPair(domainInfo.Cert, domainInfo.PrivKey)
-			if err != nil {
-				return nil, err
-			}
-
-			return &certificate, nil
+			dnsNames, ips := hostNames(chi.ServerName)
+			return getCertificate(dnsNames, ips, nil)
 		},
 	}
 )
@@ -52,22 +47,49 @@ var (
 // ListenAndServeSocks5 starts a socks5 proxy which will pass any intercepted packets to packetHandler.
 // If net.Listen fails for the server, an error is returned.
 func ListenAndServeSocks5(conf internal.Config, packetHandler func(packet.Packet)) (net.Listener, error) {
+	return listenAndServe(net.ListenConfig{}, conf.SocksListenURI, conf, packetHandler, handleConnection)
+}
+
+// listenAndServe listens on listenURI using listenConfig, and calls handler for every accepted connection
+// until the listener is closed.
+func listenAndServe(
+	listenConfig net.ListenConfig,
+	listenURI string,
+	conf internal.Config,
+	packetHandler func(packet.Packet),
+	handler func(client net.Conn, conf *internal.Config, packetHandler func(packet.Packet)) error,
+) (net.Listener, error) {
 	if err := InitCaCert(); err != nil {
 		return nil, err
 	}
-	if listener, err := net.Listen("tcp", conf.SocksListenURI); err != nil {
+	// Catch a bad upstream proxy now, instead of on every connection
+	if _, err := newUpstreamDialer(&conf); err != nil {
+		return nil, err
+	}
+	if _, err := keyLogWriter(conf.KeyLogFile); err != nil {
+		return nil, err
+	}
+	if conf.VerifyUpstreamCerts {
+		if _, err := loadUpstreamRoots(conf.UpstreamCAFile); err != nil {
+			return nil, err
+		}
+	}
+	// Pinned hosts learned before a restart are in conf.TLSPassthroughHosts by now
+	pinnedHosts.reset()
+	if listener, err := listenConfig.Listen(context.Background(), "tcp", listenURI); err != nil {
 		return nil, err
 	} else {
 		go func() {
 			for {
 				if client, err := listener.Accept(); err != nil {
-					if !errors.Is(err, net.ErrClosed) {
-						slog.Error("Error accepting connection", "error", err)
+					if errors.Is(err, net.ErrClosed) {
+						return
 					}
+					slog.Error("Error accepting connection", "error", err)
 				} else {
 					logger := slog.With("RemoteAddr", client.RemoteAddr(), "LocalAddr", client.LocalAddr())
 					go func() {
-						if err := handleConnection(client, packetHandler); err != nil {
+						if err := handler(client, &conf, packetHandler); err != nil {
 							logger.Error("Error handling connection", "error", err)
 						}
 					}()
@@ -79,162 +101,366 @@ func ListenAndServeSocks5(conf internal.Config, packetHandler func(packet.Packet
 	}
 }
 
-func handleConnection(client net.Conn, packetHandler func(packet.Packet)) error {
+func handleConnection(client net.Conn, conf *internal.Config, packetHandler func(packet.Packet)) error {
 	logger := slog.With("RemoteAddr", client.RemoteAddr(), "LocalAddr", client.LocalAddr())
+
+	inboundConn := newBufferedConn(client)
+	defer inboundConn.Close() //nolint:errcheck
+
+	version, err := inboundConn.reader.Peek(1)
+	if err != nil {
+		return fmt.Errorf("reading version: %w", err)
+	}
+
+	if version[0] == SocksVer4 {
+		logger.Debug("Handling socks4 connection")
+		return handleSocks4(inboundConn, conf, packetHandler)
+	}
+
 	logger.Debug("Handling socks5 connection")
 
-	greeting, err := ParseClientGreeting(client)
+	greeting, err := ParseClientGreeting(inboundConn)
 	if err != nil {
 		return fmt.Errorf("parsing client greeting: %w", err)
 	}
 
 	logger.Debug("Parsed client greeting", "greeting", greeting)
 
-	if greeting.CanHandle() {
+	if method := greeting.SelectMethod(len(conf.SocksCredentials) > 0); method != MethodNoAcceptableMethods {
 		logger.Debug("Handling Request")
-		if _, err := client.Write(
-			FormatServerChoice(SocksVer5, MethodNoAuthRequired),
+		if _, err := inboundConn.Write(
+			FormatServerChoice(SocksVer5, method),
 		); err != nil {
 			return fmt.Errorf("formatting server choice: %w", err)
 		}
 
-		request, status, err := ParseClientConnRequest(client)
+		connInfo := packet.ConnInfo{}
+		if method == MethodUsernamePassword {
+			if connInfo.Username, err = authenticate(inboundConn, conf.SocksCredentials); err != nil {
+				return fmt.Errorf("authenticating client: %w", err)
+			}
+			logger = logger.With("Username", connInfo.Username)
+		}
+
+		request, status, err := ParseClientConnRequest(inboundConn)
 
 		if status != StatusSucceeded {
-			if _, err := client.Write(FormatConnResponse(
+			if _, err := inboundConn.Write(FormatConnResponse(
 				SocksVer5,
 				status,
-				client.LocalAddr(),
+				inboundConn.LocalAddr(),
 			)); err != nil {
 				return fmt.Errorf("formatting conn response: %w", err)
 			}
 			return fmt.Errorf("parsing client connection request: %w", err)
 		}
 
-		if request.Cmd == CmdUDPAssociate {
-			return handleUDP(client, request)
+		switch request.Cmd {
+		case CmdUDPAssociate:
+			return handleUDP(inboundConn, conf, request, connInfo, packetHandler)
+		case CmdBind:
+			return handleBind(inboundConn, request, connInfo, packetHandler)
 		}
 
-		logger = logger.With("DstIp", request.DstIP, "DstPort", request.DstPort)
-
 		logger.Debug("Parsed conn request", "request", request)
 
-		if request.DstIP == "gitm" {
-			logger.Debug("Handling with gitm webserver")
-			if _, err := client.Write(FormatConnResponse(
-				SocksVer5,
-				StatusSucceeded,
-				client.RemoteAddr(),
-			)); err != nil {
-				return fmt.Errorf("formatting conn response: %w", err)
-			}
-			return handleGITM(client)
+		return proxyConnect(inboundConn, conf, request.DstIP, request.DstPort, connInfo, packetHandler, func(status byte, bndAddr net.Addr) error {
+			_, err := inboundConn.Write(FormatConnResponse(SocksVer5, status, bndAddr))
+			return err
+		})
+	} else {
+		logger.Debug("Cannot handle request")
+		if _, err := inboundConn.Write(FormatServerChoice(SocksVer5, MethodNoAcceptableMethods)); err != nil {
+			return fmt.Errorf("sending no acceptable methods: %w", err)
 		}
+	}
 
-		switch request.DstPort {
-		case 80:
-			defer client.Close() //nolint:errcheck
-			server, err := net.Dial("tcp", net.JoinHostPort(request.DstIP, strconv.FormatUint(uint64(request.DstPort), 10)))
-			if err != nil {
-				logger.Error("Error contacting proxied ip", "error", err)
-				if _, err := client.Write(FormatConnResponse(
-					SocksVer5,
-					StatusHostUnreachable,
-					client.RemoteAddr(),
-				)); err != nil {
-					return fmt.Errorf("formatting conn response: %w", err)
-				}
-				return err
-			}
-			defer func() {
-				if err := server.Close(); err != nil {
-					slog.Error("Error closing server", "error", err)
-				}
-			}()
+	return nil
+}
 
-			logger.Debug("Proxy success")
+// proxyConnect connects to dstIP:dstPort for client, and then intercepts everything sent over the connection.
+// This is shared by every proxy protocol once its handshake is done.
+// dstIP can also be a domain name, and the connection is made through the upstream proxy in conf if there is one.
+//
+// reply is called with the result of connecting, and should send it to the client
+// in whatever format the proxy protocol uses.
+func proxyConnect(
+	client *bufferedConn,
+	conf *internal.Config,
+	dstIP string,
+	dstPort uint16,
+	connInfo packet.ConnInfo,
+	packetHandler func(packet.Packet),
+	reply func(status byte, bndAddr net.Addr) error,
+) error {
+	logger := slog.With("RemoteAddr", client.RemoteAddr(), "LocalAddr", client.LocalAddr(), "DstIp", dstIP, "DstPort", dstPort)
+
+	if dstIP == "gitm" {
+		logger.Debug("Handling with gitm webserver")
+		if err := reply(StatusSucceeded, client.RemoteAddr()); err != nil {
+			return fmt.Errorf("formatting conn response: %w", err)
+		}
+		return handleGITM(client, conf)
+	}
 
-			if _, err := client.Write(FormatConnResponse(
-				SocksVer5,
-				StatusSucceeded,
-				server.LocalAddr(),
-			)); err != nil {
-				return fmt.Errorf("formatting conn response: %w", err)
-			}
+	dialer, err := newUpstreamDialer(conf)
+	if err != nil {
+		if err := reply(StatusGeneralFailure, client.LocalAddr()); err != nil {
+			return fmt.Errorf("sending general failure: %w", err)
+		}
+		return err
+	}
+
+	server, err := dialer.Dial(net.JoinHostPort(dstIP, strconv.FormatUint(uint64(dstPort), 10)))
+	if err != nil {
+		logger.Error("Error contacting proxied ip", "error", err)
+		if err := reply(StatusHostUnreachable, client.LocalAddr()); err != nil {
+			return fmt.Errorf("sending host unreachable: %w", err)
+		}
+		return fmt.Errorf("contacting proxied ip: %w", err)
+	}
+	defer func() {
+		if err := server.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("Error closing server", "error", err)
+		}
+	}()
 
-			return HandleHTTPRequest(client, server, packetHandler)
-		case 443:
-			outboundConn, err := net.Dial("tcp", net.JoinHostPort(request.DstIP, strconv.FormatUint(uint64(request.DstPort), 10)))
+	logger.Debug("Proxy success")
+	if err := reply(StatusSucceeded, server.LocalAddr()); err != nil {
+		return fmt.Errorf("formatting conn response: %w", err)
+	}
+
+	// The server is buffered too, so that the bytes it sends while the client is sniffed aren't lost
+	bufferedServer := newBufferedConn(server)
+	switch sniffConn(client, bufferedServer) {
+	case protocolTLS:
+		serverName, err := peekServerName(client)
+		intercept := shouldInterceptTLS(conf, serverName, dstIP)
+		if err != nil && intercept && hasServerNameRules(conf) {
+			// The server name could have matched a passthrough rule, so it isn't intercepted by mistake
+			logger.Warn("Cannot read the ClientHello to match its server name, passing tls through", "error", err)
+			intercept = false
+		} else if err != nil {
+			logger.Debug("Cannot read the ClientHello", "error", err)
+		}
+
+		if !intercept {
+			logger.Debug("Passing tls through without intercepting", "ServerName", serverName)
+			passthroughTLS(client, bufferedServer, net.JoinHostPort(dstIP, strconv.FormatUint(uint64(dstPort), 10)), serverName, connInfo, packetHandler)
+			return nil
+		}
+		return interceptTLS(client, bufferedServer, conf, dstIP, connInfo, packetHandler)
+	case protocolHTTP:
+		return HandleHTTPRequest(client, bufferedServer, connInfo, packetHandler)
+	case protocolHTTP2:
+		return HandleHTTP2(client, bufferedServer, connInfo, packetHandler)
+	default:
+		logger.Info("Unrecognized protocol, forwarding without logging")
+		transparentProxy(client, bufferedServer)
+	}
+
+	logger.Debug("Finished proxying request")
+
+	return nil
+}
+
+// interceptTLS completes the tls handshake with client using a certificate signed by the gitm CA,
+// and opens a tls connection to server using the hostname the client asked for, or dstHost if it sent none.
+//
+// The handshake with server is done first, so that the client can be offered the application protocol (ALPN)
+// the server picked, and a certificate that mirrors the server's.
+// The decrypted traffic is logged if it is http or http2, and passed through otherwise,
+// with the metadata of both tls sessions in the packets' ConnInfo.
+func interceptTLS(
+	client net.Conn,
+	server net.Conn,
+	conf *internal.Config,
+	dstHost string,
+	connInfo packet.ConnInfo,
+	packetHandler func(packet.Packet),
+) error {
+	var (
+		outboundConn  *tls.Conn
+		requestedHost string
+		presented     bool
+		verified      bool
+		verifyErr     error
+		certRequested bool
+		presentedCert []byte
+	)
+	keyLog, err := keyLogWriter(conf.KeyLogFile)
+	if err != nil {
+		slog.Error("Error opening key log file, tls secrets won't be logged", "error", err)
+	}
+
+	// The hellos are recorded as they are read, to fingerprint both sides of the connection
+	clientHelloConn := &helloConn{Conn: client}
+	serverHelloConn := &helloConn{Conn: server}
+
+	config := ServerConfig.Clone()
+	config.GetConfigForClient = func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+		// Clients that don't send a server name are handled as if they sent the host they asked to connect to
+		requestedHost = chi.ServerName
+		if requestedHost == "" {
+			requestedHost = dstHost
+		}
+
+		clientConfig := ClientConfig.Clone()
+		clientConfig.KeyLogWriter = keyLog
+		clientConfig.InsecureSkipVerify = true
+		clientConfig.ServerName = chi.ServerName
+		clientConfig.NextProtos = supportedProtos(chi.SupportedProtos, ClientConfig.NextProtos)
+		clientConfig.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certRequested = true
+
+			cert, err := clientCertificate(conf, requestedHost)
 			if err != nil {
-				logger.Error("Error contacting proxied ip", "error", err)
-				if _, err := client.Write(FormatConnResponse(
-					SocksVer5,
-					StatusHostUnreachable,
-					client.LocalAddr(),
-				)); err != nil {
-					return fmt.Errorf("sending host unreachable: %w", err)
-				}
-				return fmt.Errorf("contacting proxied ip: %w", err)
+				slog.Error("Error loading client certificate", "host", requestedHost, "error", err)
 			}
-			defer func() {
-				if err := outboundConn.Close(); err != nil {
-					logger.Error("Error closing outboundConn", "error", err)
-				}
-			}()
-
-			logger.Debug("Proxy success")
-			if _, err := client.Write(FormatConnResponse(
-				SocksVer5,
-				StatusSucceeded,
-				client.RemoteAddr(),
-			)); err != nil {
-				return err
+			if cert == nil || err != nil {
+				// Sending no certificate leaves it up to the server whether to continue
+				return &tls.Certificate{}, nil
 			}
-			inboundConn := tls.Server(client, ServerConfig)
-			defer inboundConn.Close() //nolint:errcheck
-
-			if err := inboundConn.Handshake(); err != nil {
-				if errors.Is(err, io.EOF) || err.Error() == "tls: client using inappropriate protocol fallback" {
-					return nil
-				}
-				return fmt.Errorf("tls client handshake: %w", err)
+			if err := cri.SupportsCertificate(cert); err != nil {
+				slog.Warn("Server doesn't support the configured client certificate", "host", requestedHost, "error", err)
 			}
-			config := ClientConfig.Clone()
-			config.InsecureSkipVerify = true
-			config.ServerName = inboundConn.ConnectionState().ServerName
-			return HandleHTTPRequest(inboundConn, tls.Client(outboundConn, config), packetHandler)
-		default:
-			logger.Info("Unrecognized port, forwarding without logging", "request", request)
-			server, err := net.Dial("tcp", net.JoinHostPort(request.DstIP, strconv.FormatUint(uint64(request.DstPort), 10)))
-			if err != nil {
-				_, _ = client.Write(FormatConnResponse(
-					SocksVer5,
-					StatusHostUnreachable,
-					client.RemoteAddr(),
-				))
-				return err
+
+			presentedCert = cert.Certificate[0]
+			return cert, nil
+		}
+
+		outboundConn = tls.Client(serverHelloConn, clientConfig)
+		if err := outboundConn.HandshakeContext(chi.Context()); err != nil {
+			return nil, fmt.Errorf("tls server handshake: %w", err)
+		}
+
+		if conf.VerifyUpstreamCerts {
+			verifyErr = verifyServer(conf, requestedHost, outboundConn.ConnectionState())
+			if verifyErr != nil && matchesHost(requestedHost, conf.RefuseUnverifiedHosts) {
+				return nil, fmt.Errorf("verifying server certificate: %w", verifyErr)
 			}
+			verified = verifyErr == nil
+		}
 
-			logger.Debug("Proxy success")
-			if _, err := client.Write(FormatConnResponse(
-				SocksVer5,
-				StatusSucceeded,
-				server.LocalAddr(),
-			)); err != nil {
-				return err
+		serverConfig := ServerConfig.Clone()
+		serverConfig.KeyLogWriter = keyLog
+		serverConfig.NextProtos = nil
+		if proto := outboundConn.ConnectionState().NegotiatedProtocol; proto != "" {
+			serverConfig.NextProtos = []string{proto}
+		}
+		if certRequested {
+			serverConfig.ClientAuth = tls.RequestClientCert
+		}
+
+		dnsNames, ips := hostNames(requestedHost)
+		serverCerts := outboundConn.ConnectionState().PeerCertificates
+		serverConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certificate, err := getCertificate(dnsNames, ips, serverCerts)
+			presented = err == nil
+			return certificate, err
+		}
+
+		return serverConfig, nil
+	}
+
+	inboundConn := tls.Server(clientHelloConn, config)
+	defer inboundConn.Close() //nolint:errcheck
+
+	err = inboundConn.Handshake()
+	connInfo.Fingerprints = tlsFingerprints(clientHelloConn.hello(), serverHelloConn.hello())
+	if err != nil {
+		if presented {
+			// Everything up to gitm's certificate succeeded, so the client rejected it
+			reason := err.Error()
+			if errors.Is(err, io.EOF) {
+				reason = "client closed the connection"
 			}
-			transparentProxy(client, server)
+			recordHandshakeFailure(conf, server.RemoteAddr().String(), inboundConn.ConnectionState().ServerName, requestedHost, reason, connInfo, packetHandler)
+		}
+		if errors.Is(err, io.EOF) || err.Error() == "tls: client using inappropriate protocol fallback" {
+			return nil
 		}
+		return fmt.Errorf("tls client handshake: %w", err)
+	}
+	pinnedHosts.handshakeSucceeded(requestedHost)
+
+	serverName := inboundConn.ConnectionState().ServerName
+	connInfo.TLS = packet.CreateTLSInfo(inboundConn.ConnectionState(), outboundConn.ConnectionState())
+	connInfo.TLS.Verified = verified
+	if verifyErr != nil {
+		slog.Warn("Server certificate failed verification", "ServerName", serverName, "error", verifyErr)
+		connInfo.TLS.VerificationError = verifyErr.Error()
+	}
+	connInfo.TLS.ClientCertificateRequested = certRequested
+	connInfo.TLS.PresentedCertificate = presentedCert
+	if inboundConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		return HandleHTTP2(inboundConn, outboundConn, connInfo, packetHandler)
+	}
 
-		logger.Debug("Finished proxying request")
-	} else {
-		logger.Debug("Cannot handle request")
-		if _, err := client.Write(FormatServerChoice(SocksVer5, MethodNoAcceptableMethods)); err != nil {
-			return fmt.Errorf("sending no acceptable methods: %w", err)
+	decryptedConn := newBufferedConn(inboundConn)
+	decryptedServer := newBufferedConn(outboundConn)
+	switch sniffConn(decryptedConn, decryptedServer) {
+	case protocolHTTP:
+		return HandleHTTPRequest(decryptedConn, decryptedServer, connInfo, packetHandler)
+	case protocolHTTP2:
+		return HandleHTTP2(decryptedConn, decryptedServer, connInfo, packetHandler)
+	default:
+		slog.Info("Unrecognized protocol inside tls, forwarding without logging", "ServerName", serverName)
+		transparentProxy(decryptedConn, decryptedServer)
+		return nil
+	}
+}
+
+// supportedProtos returns the protocols in offered that are in supported, in the order they were offered.
+func supportedProtos(offered []string, supported []string) []string {
+	protos := make([]string, 0, len(offered))
+	for _, proto := range offered {
+		if slices.Contains(supported, proto) {
+			protos = append(protos, proto)
 		}
 	}
 
-	return nil
+	return protos
+}
+
+// authenticate reads the client's username/password request, and checks it against credentials.
+// The username is returned if the client sent valid credentials.
+func authenticate(client net.Conn, credentials []string) (string, error) {
+	request, err := ParseUsernamePasswordRequest(client)
+	if err != nil {
+		return "", fmt.Errorf("parsing username/password request: %w", err)
+	}
+
+	if checkCredentials(credentials, request.Username, request.Password) {
+		if _, err := client.Write(FormatAuthResponse(AuthStatusSucceeded)); err != nil {
+			return "", fmt.Errorf("sending auth success: %w", err)
+		}
+		return request.Username, nil
+	}
+
+	if _, err := client.Write(FormatAuthResponse(AuthStatusFailure)); err != nil {
+		return "", fmt.Errorf("sending auth failure: %w", err)
+	}
+
+	return "", fmt.Errorf("invalid credentials for user %q", request.Username)
+}
+
+// checkCredentials reports whether username and password match one of the "username:password" credentials.
+func checkCredentials(credentials []string, username string, password string) bool {
+	for _, credential := range credentials {
+		validUsername, validPassword, found := strings.Cut(credential, ":")
+		if !found {
+			slog.Error("Invalid socks credential, must be username:password", "username", validUsername)
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(validUsername), []byte(username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(validPassword), []byte(password)) == 1 {
+			return true
+		}
+	}
+
+	return false
 }
 
 // transparentProxy simply forwards all traffic from client -> server, and vice versa.
@@ -260,53 +486,3 @@ func transparentProxy(client net.Conn, server net.Conn) {
 	client.Close() //nolint:errcheck
 	server.Close() //nolint:errcheck
 }
-
-func handleGITM(client net.Conn) error {
-	reader := textproto.NewReader(bufio.NewReader(client))
-	_, uri, _, err := ReadLine1(reader)
-	if err != nil {
-		return err
-	}
-
-	if _, err := reader.ReadMIMEHeader(); err != nil {
-		return err
-	}
-
-	if uri == "/ca.crt" {
-		configDir, err := util.GetConfigDir()
-		if err != nil {
-			return fmt.Errorf("getting config dir: %w", err)
-		}
-
-		certLocation := configDir + "/ca.crt"
-		contents, err := os.ReadFile(certLocation)
-		if err != nil {
-			slog.Error("Error getting ca cert", "error", err)
-			if _, err := client.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n")); err != nil {
-				return fmt.Errorf("sending internal server error: %w", err)
-			}
-			return nil
-		}
-
-		if _, err := fmt.Fprintf(client, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(contents)); err != nil {
-			return fmt.Errorf("sending 200 OK: %w", err)
-		}
-		if _, err := client.Write(contents); err != nil {
-			return fmt.Errorf("sending body: %w", err)
-		}
-	}
-	// TODO: Need to handle when user does not specify /ca.crt
-
-	return nil
-}
-
-func SetupPAC(conf *internal.Config) *http.Server {
-	return &http.Server{
-		Addr: conf.PACListenURI, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			slog.Debug("Handling pac file request")
-			if r.URL.Path == "/proxy.pac" {
-				_, _ = fmt.Fprintf(w, "function FindProxyForURL(url, host){return \"SOCKS %s\";}", conf.SocksListenURI)
-			}
-		}),
-	}
-}
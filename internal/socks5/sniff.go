@@ -0,0 +1,142 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// sniffTimeout is how long to wait for the client to send its first bytes.
+// Connections where neither side sends anything are passed through once this expires.
+const sniffTimeout = 2 * time.Second
+
+// sniffLength is the number of bytes needed to recognise any supported protocol.
+// The longest is the "OPTIONS " request line prefix.
+const sniffLength = 8
+
+type protocol int
+
+const (
+	protocolUnknown protocol = iota
+	protocolTLS
+	protocolHTTP
+	protocolHTTP2
+)
+
+func (p protocol) String() string {
+	switch p {
+	case protocolTLS:
+		return "tls"
+	case protocolHTTP:
+		return "http"
+	case protocolHTTP2:
+		return "http2"
+	default:
+		return "unknown"
+	}
+}
+
+// httpMethods are the request line prefixes that identify an http/1.x client.
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("CONNECT "),
+	[]byte("OPTIONS "),
+	[]byte("TRACE "),
+	[]byte("PATCH "),
+}
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader,
+// so that the first bytes can be peeked at without consuming them.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// newBufferedConn buffers conn with room to peek at a whole ClientHello, which can be larger than bufio's default size.
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, maxHelloLength),
+	}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite shuts down the writing side of the wrapped conn, if it supports it,
+// so that relays can pass on that the other side is done sending.
+func (c *bufferedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+
+	return nil
+}
+
+// sniffConn waits for the first bytes sent on client, and detects which protocol they belong to.
+// Protocols where the server speaks first (e.g. SMTP or SSH) are detected as protocolUnknown
+// as soon as server sends anything, so that they aren't held up waiting for the client.
+// None of the bytes are consumed from either conn.
+func sniffConn(client *bufferedConn, server *bufferedConn) protocol {
+	if err := client.SetReadDeadline(time.Now().Add(sniffTimeout)); err != nil {
+		return protocolUnknown
+	}
+	defer client.SetReadDeadline(time.Time{}) //nolint:errcheck
+
+	var serverFirst atomic.Bool
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		// The peek is interrupted once the client has sent enough
+		if _, err := server.reader.Peek(1); errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		serverFirst.Store(true)
+		client.SetReadDeadline(time.Now()) //nolint:errcheck
+	}()
+
+	// If the client sends less than sniffLength bytes, whatever was sent is still returned
+	data, err := client.reader.Peek(sniffLength)
+
+	server.SetReadDeadline(time.Now()) //nolint:errcheck
+	<-serverDone
+	server.SetReadDeadline(time.Time{}) //nolint:errcheck
+
+	if err != nil && serverFirst.Load() {
+		return protocolUnknown
+	}
+
+	return sniffProtocol(data)
+}
+
+// sniffProtocol detects the protocol of a connection from the first bytes sent by the client.
+func sniffProtocol(data []byte) protocol {
+	// A tls record starts with the handshake content type, followed by the major version
+	if len(data) >= 3 && data[0] == 0x16 && data[1] == 0x03 && data[2] <= 0x04 {
+		return protocolTLS
+	}
+
+	// Clients with prior knowledge of http2 start with the connection preface
+	if len(data) >= sniffLength && bytes.HasPrefix([]byte(http2.ClientPreface), data[:sniffLength]) {
+		return protocolHTTP2
+	}
+
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(data, method) {
+			return protocolHTTP
+		}
+	}
+
+	return protocolUnknown
+}
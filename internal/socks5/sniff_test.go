@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected protocol
+	}{
+		{"tls 1.0 record", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01}, protocolTLS},
+		{"tls 1.2 record", []byte{0x16, 0x03, 0x03, 0x00, 0xf4, 0x01, 0x00, 0x00}, protocolTLS},
+		{"http get", []byte("GET / HT"), protocolHTTP},
+		{"http options", []byte("OPTIONS "), protocolHTTP},
+		{"short http", []byte("PUT /"), protocolHTTP},
+		{"http2 preface", []byte("PRI * HT"), protocolHTTP2},
+		{"ssh", []byte("SSH-2.0-"), protocolUnknown},
+		{"method without space", []byte("GETTING"), protocolUnknown},
+		{"not a handshake record", []byte{0x17, 0x03, 0x03, 0x00}, protocolUnknown},
+		{"empty", []byte{}, protocolUnknown},
+	}
+
+	for _, test := range tests {
+		if actual := sniffProtocol(test.data); actual != test.expected {
+			t.Errorf("sniffProtocol(%s) = %s, want %s", test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestSniffConnServerSpeaksFirst(t *testing.T) {
+	// Like SMTP, the server greets the client, and then echoes what the client sends
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer listener.Close() //nolint:errcheck
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		_, _ = io.WriteString(conn, "220 smtp.example.com ESMTP\r\n")
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", startProxy(t, handleHTTPProxyConnection, &internal.Config{}, func(packet.Packet) {}))
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	reader := bufio.NewReader(conn)
+
+	target := listener.Addr().String()
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect}); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status = 200, got resp = %v, err = %v", resp, err)
+	}
+
+	// The greeting isn't held back until the client has been sniffed
+	if err := conn.SetReadDeadline(time.Now().Add(sniffTimeout / 2)); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if greeting, err := reader.ReadString('\n'); err != nil || greeting != "220 smtp.example.com ESMTP\r\n" {
+		t.Fatalf("Expected the greeting, got %q, err = %v", greeting, err)
+	}
+
+	if _, err := io.WriteString(conn, "EHLO client\r\n"); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if echo, err := reader.ReadString('\n'); err != nil || echo != "EHLO client\r\n" {
+		t.Errorf("Expected the echo, got %q, err = %v", echo, err)
+	}
+}
@@ -0,0 +1,56 @@
+package socks5
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// handleSocks4 handles a SOCKS4 or SOCKS4a connection.
+// Only CONNECT is supported, and the user id sent by the client is used to tag packets.
+//
+// SOCKS4 has no way to authenticate, so every request is rejected when socks credentials are configured.
+func handleSocks4(client *bufferedConn, conf *internal.Config, packetHandler func(packet.Packet)) error {
+	reject := func() error {
+		_, err := client.Write(FormatSocks4Response(Socks4StatusRejected, client.LocalAddr()))
+		return err
+	}
+
+	request, err := ParseSocks4Request(client)
+	if err != nil {
+		if err := reject(); err != nil {
+			return fmt.Errorf("sending rejected: %w", err)
+		}
+		return fmt.Errorf("parsing socks4 request: %w", err)
+	}
+
+	if request.Cmd != CmdConnect {
+		if err := reject(); err != nil {
+			return fmt.Errorf("sending rejected: %w", err)
+		}
+		return fmt.Errorf("socks4 cmd not supported: %d", request.Cmd)
+	}
+
+	if len(conf.SocksCredentials) > 0 {
+		if err := reject(); err != nil {
+			return fmt.Errorf("sending rejected: %w", err)
+		}
+		return fmt.Errorf("socks4 client %q can't authenticate", request.UserID)
+	}
+
+	slog.Debug("Parsed socks4 request", "request", request)
+
+	connInfo := packet.ConnInfo{Username: request.UserID}
+
+	return proxyConnect(client, conf, request.DstIP, request.DstPort, connInfo, packetHandler, func(status byte, bndAddr net.Addr) error {
+		socks4Status := byte(Socks4StatusGranted)
+		if status != StatusSucceeded {
+			socks4Status = Socks4StatusRejected
+		}
+		_, err := client.Write(FormatSocks4Response(socks4Status, bndAddr))
+		return err
+	})
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// streamUpdateInterval is the minimum time between updates sent for a recorded stream.
+// The final update is always sent when the stream closes.
+const streamUpdateInterval = 500 * time.Millisecond
+
+// streamRecorder accumulates the bytes relayed in both directions of a connection into a StreamPacket.
+// Only the number of bytes is accumulated for passthrough packets.
+type streamRecorder struct {
+	mu     sync.Mutex
+	packet *packet.StreamPacket
+	// clientHello and serverHello record the hellos of passthrough packets, to fingerprint them
+	clientHello   helloRecorder
+	serverHello   helloRecorder
+	lastUpdate    time.Time
+	packetHandler func(packet.Packet)
+}
+
+// streamWriter appends everything written to it to one side of a streamRecorder
+type streamWriter struct {
+	recorder   *streamRecorder
+	fromClient bool
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	w.recorder.record(w.fromClient, b)
+	return len(b), nil
+}
+
+func (r *streamRecorder) record(fromClient bool, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case r.packet.Passthrough && fromClient:
+		r.packet.ClientBytes += int64(len(b))
+		r.recordHello(&r.clientHello, b)
+	case r.packet.Passthrough:
+		r.packet.ServerBytes += int64(len(b))
+		r.recordHello(&r.serverHello, b)
+	case fromClient:
+		r.packet.ClientData = append(r.packet.ClientData, b...)
+	default:
+		r.packet.ServerData = append(r.packet.ServerData, b...)
+	}
+
+	if time.Since(r.lastUpdate) >= streamUpdateInterval {
+		r.update()
+	}
+}
+
+// recordHello records b with hello, and fingerprints the packet once hello is complete.
+// r.mu must be held.
+func (r *streamRecorder) recordHello(hello *helloRecorder, b []byte) {
+	if hello.done {
+		return
+	}
+
+	hello.record(b)
+	if hello.message != nil {
+		// Snapshots share the fingerprints, so they are replaced instead of modified
+		r.packet.Fingerprints = tlsFingerprints(r.clientHello.message, r.serverHello.message)
+	}
+}
+
+// update sends a copy of the packet to packetHandler, since the packet keeps changing while the stream is open.
+// r.mu must be held.
+func (r *streamRecorder) update() {
+	r.lastUpdate = time.Now()
+	snapshot := *r.packet
+	snapshot.ClientData = slices.Clone(r.packet.ClientData)
+	snapshot.ServerData = slices.Clone(r.packet.ServerData)
+	r.packetHandler(&snapshot)
+}
+
+// recordedProxy forwards all traffic from client -> server, and vice versa, like transparentProxy.
+// The traffic is recorded as a StreamPacket, for protocols that gitm can't parse.
+func recordedProxy(client net.Conn, server net.Conn, connInfo packet.ConnInfo, packetHandler func(packet.Packet)) {
+	streamPacket := packet.CreateStreamPacket(server.RemoteAddr().String())
+	streamPacket.ConnInfo = connInfo
+	relayStream(client, server, streamPacket, packetHandler)
+}
+
+// relayStream forwards all traffic from client -> server, and vice versa, recording it into streamPacket.
+// Both connections are closed once both sides are done.
+func relayStream(client net.Conn, server net.Conn, streamPacket *packet.StreamPacket, packetHandler func(packet.Packet)) {
+	logger := slog.With("RemoteAddr", client.RemoteAddr(), "LocalAddr", client.LocalAddr())
+	recorder := &streamRecorder{
+		packet:        streamPacket,
+		packetHandler: queuePackets(packetHandler),
+	}
+
+	recorder.mu.Lock()
+	recorder.update()
+	recorder.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		if _, err := io.Copy(client, io.TeeReader(server, &streamWriter{recorder: recorder})); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("Error proxying server to client", "error", err)
+		}
+		closeWrite(client)
+		done <- struct{}{}
+	}()
+	go func() {
+		if _, err := io.Copy(server, io.TeeReader(client, &streamWriter{recorder: recorder, fromClient: true})); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("Error proxying client to server", "error", err)
+		}
+		closeWrite(server)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	client.Close() //nolint:errcheck
+	server.Close() //nolint:errcheck
+
+	recorder.mu.Lock()
+	recorder.packet.Closed = true
+	recorder.update()
+	recorder.mu.Unlock()
+}
+
+// closeWrite passes on that one side of the connection is done sending, while still allowing the other side to finish.
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(interface{ CloseWrite() error }); ok {
+		tcpConn.CloseWrite() //nolint:errcheck
+	}
+}
@@ -0,0 +1,47 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+// ListenAndServeTransparent starts a transparent proxy, for connections redirected to it by the firewall
+// (i.e. iptables REDIRECT or TPROXY), which will pass any intercepted packets to packetHandler.
+// The destination of each connection is recovered from the connection itself, since the client
+// doesn't know it is being proxied.
+// If net.Listen fails for the server, or transparent proxying isn't supported on this platform, an error is returned.
+func ListenAndServeTransparent(conf internal.Config, packetHandler func(packet.Packet)) (net.Listener, error) {
+	if !transparentSupported {
+		return nil, errors.New("transparent proxying is only supported on linux")
+	}
+
+	return listenAndServe(transparentListenConfig(), conf.TransparentListenURI, conf, packetHandler, handleTransparentConnection)
+}
+
+func handleTransparentConnection(client net.Conn, conf *internal.Config, packetHandler func(packet.Packet)) error {
+	inboundConn := newBufferedConn(client)
+	defer inboundConn.Close() //nolint:errcheck
+
+	dst, err := originalDst(client)
+	if err != nil {
+		return fmt.Errorf("getting original destination: %w", err)
+	}
+
+	// A connection made directly to the listener would otherwise be proxied back to the listener
+	if _, listenPort, err := net.SplitHostPort(conf.TransparentListenURI); err == nil &&
+		dst.String() == client.LocalAddr().String() && fmt.Sprint(dst.Port) == listenPort {
+		return fmt.Errorf("connection to %s was not redirected", dst)
+	}
+
+	slog.Debug("Handling transparent connection", "RemoteAddr", client.RemoteAddr(), "OriginalDst", dst)
+
+	// The tls hostname comes from the client hello, since the client never tells us which host it wanted
+	return proxyConnect(inboundConn, conf, dst.IP.String(), uint16(dst.Port), packet.ConnInfo{}, packetHandler, func(byte, net.Addr) error {
+		return nil
+	})
+}
@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"syscall"
+)
+
+const transparentSupported = true
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which is the same value as
+// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// ipv6Transparent is IPV6_TRANSPARENT from linux/in6.h, which the syscall package doesn't define
+const ipv6Transparent = 75
+
+// transparentListenConfig sets IP_TRANSPARENT (or IPV6_TRANSPARENT for ipv6 listeners) on the listener,
+// so that it can accept connections redirected by TPROXY.
+// This needs CAP_NET_ADMIN, and connections redirected by REDIRECT work without it.
+func transparentListenConfig() net.ListenConfig {
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			level, option, name := syscall.SOL_IP, syscall.IP_TRANSPARENT, "IP_TRANSPARENT"
+			if network == "tcp6" {
+				level, option, name = syscall.SOL_IPV6, ipv6Transparent, "IPV6_TRANSPARENT"
+			}
+
+			return c.Control(func(fd uintptr) {
+				if err := syscall.SetsockoptInt(int(fd), level, option, 1); err != nil {
+					slog.Warn("Cannot set "+name+", TPROXY redirected connections won't be accepted", "error", err)
+				}
+			})
+		},
+	}
+}
+
+// originalDst returns the address conn was sent to before it was redirected.
+// Connections redirected by REDIRECT are looked up in conntrack, and connections
+// redirected by TPROXY keep their original destination as the local address.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a tcp connection: %T", conn)
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("getting raw conn: %w", err)
+	}
+
+	localAddr := conn.LocalAddr().(*net.TCPAddr)
+
+	var dst *net.TCPAddr
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		if localAddr.IP.To4() != nil {
+			// The sockaddr_in is returned in the first 16 bytes
+			var mreq *syscall.IPv6Mreq
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); sockErr == nil {
+				dst = &net.TCPAddr{
+					IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+					Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+				}
+			}
+		} else {
+			// The sockaddr_in6 is returned at the start of the ip6_mtuinfo
+			var mtuInfo *syscall.IPv6MTUInfo
+			if mtuInfo, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); sockErr == nil {
+				port := [2]byte{}
+				binary.NativeEndian.PutUint16(port[:], mtuInfo.Addr.Port)
+				dst = &net.TCPAddr{
+					IP:   net.IP(mtuInfo.Addr.Addr[:]),
+					Port: int(binary.BigEndian.Uint16(port[:])),
+				}
+			}
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("controlling raw conn: %w", err)
+	}
+
+	if sockErr != nil {
+		if errors.Is(sockErr, syscall.ENOENT) || errors.Is(sockErr, syscall.ENOPROTOOPT) {
+			return localAddr, nil
+		}
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,81 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+func TestHandleTransparentConnectionNotRedirected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer listener.Close() //nolint:errcheck
+
+	conf := &internal.Config{TransparentListenURI: listener.Addr().String()}
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer client.Close() //nolint:errcheck
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	dst, err := originalDst(server)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if dst.String() != listener.Addr().String() {
+		t.Errorf("originalDst(...) = %s, want %s", dst, listener.Addr())
+	}
+
+	// Without the check, the connection would be proxied back to the listener forever
+	if err := handleTransparentConnection(server, conf, func(packet.Packet) {}); err == nil {
+		t.Errorf("Expected err != nil, got err = nil")
+	}
+}
+
+func TestTransparentListenConfig(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		level   int
+		option  int
+	}{
+		{"127.0.0.1:0", syscall.SOL_IP, syscall.IP_TRANSPARENT},
+		{"[::1]:0", syscall.SOL_IPV6, ipv6Transparent},
+	} {
+		listenConfig := transparentListenConfig()
+		listener, err := listenConfig.Listen(context.Background(), "tcp", test.address)
+		if err != nil {
+			t.Skipf("Cannot listen on %s: %v", test.address, err)
+		}
+		defer listener.Close() //nolint:errcheck
+
+		rawConn, err := listener.(*net.TCPListener).SyscallConn()
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		value, sockErr := 0, error(nil)
+		if err := rawConn.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), test.level, test.option)
+		}); err != nil || sockErr != nil {
+			t.Fatalf("Expected err = nil, got err = %v, %v", err, sockErr)
+		}
+		// Setting the option needs CAP_NET_ADMIN, so the ipv4 listener tells whether it can be set at all
+		if value != 1 && test.level == syscall.SOL_IP {
+			t.Skipf("Cannot set IP_TRANSPARENT")
+		}
+		if value != 1 {
+			t.Errorf("%s: Expected the transparent option to be set, got %d", test.address, value)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+const transparentSupported = false
+
+func transparentListenConfig() net.ListenConfig {
+	return net.ListenConfig{}
+}
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxying is only supported on linux")
+}
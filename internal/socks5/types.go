@@ -14,9 +14,24 @@ const (
 )
 
 const (
+	SocksVer4 = 0x04
 	SocksVer5 = 0x05
 )
 
+// SOCKS4 reply codes. SOCKS4 replies always use version 0x00.
+const (
+	Socks4ReplyVer       = 0x00
+	Socks4StatusGranted  = 0x5A
+	Socks4StatusRejected = 0x5B
+)
+
+// Username/password authentication, see RFC 1929
+const (
+	AuthVer1            = 0x01
+	AuthStatusSucceeded = 0x00
+	AuthStatusFailure   = 0x01
+)
+
 const (
 	StatusSucceeded               = 0x00
 	StatusGeneralFailure          = 0x01
@@ -48,9 +63,28 @@ type ClientGreeting struct {
 	Auth  []byte
 }
 
-func (g *ClientGreeting) CanHandle() bool {
-	return g.Ver == SocksVer5 &&
-		slices.Contains(g.Auth, MethodNoAuthRequired)
+// SelectMethod picks the authentication method to use with the client.
+// MethodNoAcceptableMethods is returned if the client doesn't support a method we can use.
+func (g *ClientGreeting) SelectMethod(authRequired bool) byte {
+	if g.Ver != SocksVer5 {
+		return MethodNoAcceptableMethods
+	}
+
+	if authRequired {
+		if slices.Contains(g.Auth, MethodUsernamePassword) {
+			return MethodUsernamePassword
+		}
+	} else if slices.Contains(g.Auth, MethodNoAuthRequired) {
+		return MethodNoAuthRequired
+	}
+
+	return MethodNoAcceptableMethods
+}
+
+type UsernamePasswordRequest struct {
+	Ver      byte
+	Username string
+	Password string
 }
 
 type ClientConnRequest struct {
@@ -58,6 +92,26 @@ type ClientConnRequest struct {
 	Cmd       byte
 	Rsv       byte
 	DstIPType byte
+	// DstIP is the destination ip, or the domain name when DstIPType is AddressTypeDomainName
+	DstIP   string
+	DstPort uint16
+}
+
+// Socks4Request is a SOCKS4 or SOCKS4a request.
+// For SOCKS4a, DstIP is the requested domain name.
+type Socks4Request struct {
+	Ver     byte
+	Cmd     byte
+	DstPort uint16
+	DstIP   string
+	UserID  string
+}
+
+type UDPRequest struct {
+	Rsv       uint16
+	Frag      byte
+	DstIPType byte
 	DstIP     string
 	DstPort   uint16
+	Data      []byte
 }
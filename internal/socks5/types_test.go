@@ -0,0 +1,25 @@
+package socks5
+
+import (
+	"testing"
+)
+
+func TestSelectMethod(t *testing.T) {
+	tests := []struct {
+		greeting     ClientGreeting
+		authRequired bool
+		expected     byte
+	}{
+		{ClientGreeting{Ver: SocksVer5, Auth: []byte{MethodNoAuthRequired}}, false, MethodNoAuthRequired},
+		{ClientGreeting{Ver: SocksVer5, Auth: []byte{MethodNoAuthRequired}}, true, MethodNoAcceptableMethods},
+		{ClientGreeting{Ver: SocksVer5, Auth: []byte{MethodNoAuthRequired, MethodUsernamePassword}}, true, MethodUsernamePassword},
+		{ClientGreeting{Ver: SocksVer5, Auth: []byte{MethodUsernamePassword}}, false, MethodNoAcceptableMethods},
+		{ClientGreeting{Ver: 0x04, Auth: []byte{MethodNoAuthRequired}}, false, MethodNoAcceptableMethods},
+	}
+
+	for _, test := range tests {
+		if actual := test.greeting.SelectMethod(test.authRequired); actual != test.expected {
+			t.Errorf("SelectMethod(%t) with methods %x = %x, want %x", test.authRequired, test.greeting.Auth, actual, test.expected)
+		}
+	}
+}
@@ -1,47 +1,279 @@
 package socks5
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"strconv"
+	"sync"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
 )
 
-func handleUDP(client net.Conn, request *ClientConnRequest) error {
-	slog.Info("Handling udp!", "Addr", client.RemoteAddr())
-	server, err := net.Dial("udp", net.JoinHostPort(request.DstIP, fmt.Sprintf("%d", request.DstPort)))
+// maxDatagramSize is the largest datagram that can be relayed
+const maxDatagramSize = 65535
+
+// handleUDP runs a udp relay for the client, as described by the UDP ASSOCIATE command in RFC 1928.
+//
+// Datagrams from the client are decapsulated and sent to their destination, and datagrams
+// from any destination the client has sent to are encapsulated and sent back to the client.
+// The relay is torn down when client closes the tcp connection the association was made on.
+//
+// Datagrams are relayed through the upstream proxy in conf when it is a socks5 proxy. An http upstream proxy
+// can't relay udp, so only datagrams to bypassed destinations are relayed in that case.
+func handleUDP(client net.Conn, conf *internal.Config, request *ClientConnRequest, connInfo packet.ConnInfo, packetHandler func(packet.Packet)) error {
+	logger := slog.With("RemoteAddr", client.RemoteAddr(), "LocalAddr", client.LocalAddr())
+	logger.Debug("Handling udp associate", "request", request)
+
+	// Listen on the same interface the client reached us on, so the relay is reachable by the client
+	localIP := client.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
 	if err != nil {
 		if _, err := client.Write(FormatConnResponse(
 			SocksVer5,
-			StatusHostUnreachable,
-			client.RemoteAddr(),
+			StatusGeneralFailure,
+			client.LocalAddr(),
 		)); err != nil {
 			return fmt.Errorf("formatting conn response: %w", err)
 		}
-		return fmt.Errorf("handling udp: %w", err)
+		return fmt.Errorf("opening udp relay: %w", err)
 	}
+	defer relay.Close() //nolint:errcheck
 
-	if l, err := net.Listen("udp", "0.0.0.0:42069"); err != nil {
-		slog.Error("Error opening udp conn for client", "error", err)
-	} else {
-		go func() {
-			for {
-				if conn, err := l.Accept(); err != nil {
-					slog.Error("Error accepting udp connection", "error", err)
-				} else {
-					go transparentProxy(server, conn)
-					go transparentProxy(conn, server)
-				}
-			}
-		}()
+	outbound, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		if _, err := client.Write(FormatConnResponse(
+			SocksVer5,
+			StatusGeneralFailure,
+			client.LocalAddr(),
+		)); err != nil {
+			return fmt.Errorf("formatting conn response: %w", err)
+		}
+		return fmt.Errorf("opening outbound udp socket: %w", err)
+	}
+	defer outbound.Close() //nolint:errcheck
 
+	var upstream *upstreamUDP
+	dialer, err := newUpstreamDialer(conf)
+	if err == nil {
+		upstream, err = dialer.associateUDP()
+	}
+	if err != nil {
 		if _, err := client.Write(FormatConnResponse(
 			SocksVer5,
-			StatusSucceeded,
-			l.Addr(),
+			StatusGeneralFailure,
+			client.LocalAddr(),
 		)); err != nil {
 			return fmt.Errorf("formatting conn response: %w", err)
 		}
+		return err
 	}
 
+	if _, err := client.Write(FormatConnResponse(
+		SocksVer5,
+		StatusSucceeded,
+		relay.LocalAddr(),
+	)); err != nil {
+		return fmt.Errorf("formatting conn response: %w", err)
+	}
+
+	association := &udpAssociation{
+		relay:         relay,
+		outbound:      outbound,
+		upstream:      upstream,
+		dialer:        dialer,
+		clientIP:      client.RemoteAddr().(*net.TCPAddr).IP,
+		connInfo:      connInfo,
+		packetHandler: queuePackets(packetHandler),
+		destinations:  make(map[string]bool),
+		logger:        logger,
+	}
+	if request.DstPort != 0 {
+		association.clientAddr = &net.UDPAddr{IP: association.clientIP, Port: int(request.DstPort)}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		association.relayFromClient()
+	}()
+	go func() {
+		defer wg.Done()
+		association.relayToClient(outbound, true)
+	}()
+	if upstream != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The upstream relay only receives what the upstream proxy relays for this association,
+			// and the destinations it was sent to can be domain names that the sources won't match
+			association.relayToClient(upstream, false)
+		}()
+	}
+
+	// The client has no other use for the tcp connection, so it being closed (or failing) means we are done
+	if _, err := io.Copy(io.Discard, client); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Debug("Error reading udp associate control connection", "error", err)
+	}
+
+	relay.Close()    //nolint:errcheck
+	outbound.Close() //nolint:errcheck
+	if upstream != nil {
+		upstream.Close() //nolint:errcheck
+	}
+	wg.Wait()
+	logger.Debug("Finished udp associate")
+
 	return nil
 }
+
+// datagramConn receives datagrams from destinations for the udp relay
+type datagramConn interface {
+	ReadFromUDP(buff []byte) (int, *net.UDPAddr, error)
+}
+
+// udpAssociation is the state of a single udp relay
+type udpAssociation struct {
+	// relay is where datagrams are exchanged with the client
+	relay *net.UDPConn
+	// outbound is where datagrams are exchanged directly with destinations
+	outbound *net.UDPConn
+	// upstream is where datagrams are exchanged with destinations through the upstream proxy.
+	// It is nil when there is no upstream proxy that can relay udp.
+	upstream *upstreamUDP
+	dialer   *upstreamDialer
+	clientIP net.IP
+
+	connInfo      packet.ConnInfo
+	packetHandler func(packet.Packet)
+	logger        *slog.Logger
+
+	mu sync.Mutex
+	// clientAddr is where the client sends datagrams from. It is nil until known.
+	clientAddr *net.UDPAddr
+	// destinations are the addresses the client has sent datagrams to.
+	// Only datagrams from these addresses are relayed back to the client.
+	destinations map[string]bool
+}
+
+func (a *udpAssociation) relayFromClient() {
+	buff := make([]byte, maxDatagramSize)
+	for {
+		n, srcAddr, err := a.relay.ReadFromUDP(buff)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				a.logger.Error("Error reading from udp client", "error", err)
+			}
+			return
+		}
+
+		if !a.isClient(srcAddr) {
+			a.logger.Debug("Dropping datagram from unknown source", "source", srcAddr)
+			continue
+		}
+
+		request, err := ParseUDPRequest(buff[:n])
+		if err != nil {
+			a.logger.Error("Error parsing udp request", "error", err)
+			continue
+		}
+
+		if request.Frag != 0 {
+			a.logger.Debug("Dropping fragmented datagram", "frag", request.Frag)
+			continue
+		}
+
+		destination := net.JoinHostPort(request.DstIP, strconv.FormatUint(uint64(request.DstPort), 10))
+		if !a.dialer.direct(request.DstIP) {
+			if a.upstream == nil {
+				a.logger.Warn("Dropping datagram, the upstream proxy can't relay udp", "destination", destination)
+				continue
+			}
+
+			// Domain names are resolved by the upstream proxy, so that they aren't looked up here
+			if _, err := a.upstream.WriteToHost(request.Data, request.DstIP, request.DstPort); err != nil {
+				a.logger.Error("Error sending datagram to destination", "destination", destination, "error", err)
+				continue
+			}
+		} else {
+			dstAddr, err := net.ResolveUDPAddr("udp", destination)
+			if err != nil {
+				a.logger.Error("Error resolving udp destination", "error", err)
+				continue
+			}
+			destination = dstAddr.String()
+
+			a.mu.Lock()
+			a.destinations[destination] = true
+			a.mu.Unlock()
+
+			if _, err := a.outbound.WriteToUDP(request.Data, dstAddr); err != nil {
+				a.logger.Error("Error sending datagram to destination", "destination", destination, "error", err)
+				continue
+			}
+		}
+
+		p := packet.CreateUDPPacket(true, destination, request.Data)
+		p.ConnInfo = a.connInfo
+		a.packetHandler(p)
+	}
+}
+
+// relayToClient relays the datagrams received by outbound to the client.
+// If knownOnly is set, only datagrams from destinations the client has sent datagrams to are relayed.
+func (a *udpAssociation) relayToClient(outbound datagramConn, knownOnly bool) {
+	buff := make([]byte, maxDatagramSize)
+	for {
+		n, srcAddr, err := outbound.ReadFromUDP(buff)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				a.logger.Error("Error reading from udp destination", "error", err)
+			}
+			return
+		}
+
+		a.mu.Lock()
+		known := a.destinations[srcAddr.String()] || !knownOnly
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+
+		if !known || clientAddr == nil {
+			a.logger.Debug("Dropping datagram from unknown destination", "source", srcAddr)
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buff[:n])
+
+		if _, err := a.relay.WriteToUDP(FormatUDPResponse(srcAddr, data), clientAddr); err != nil {
+			a.logger.Error("Error sending datagram to client", "error", err)
+			continue
+		}
+
+		p := packet.CreateUDPPacket(false, srcAddr.String(), data)
+		p.ConnInfo = a.connInfo
+		a.packetHandler(p)
+	}
+}
+
+// isClient reports whether addr is the client, learning the client's port from the first datagram
+// if the client didn't specify it in the UDP ASSOCIATE request.
+func (a *udpAssociation) isClient(addr *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !addr.IP.Equal(a.clientIP) {
+		return false
+	}
+
+	if a.clientAddr == nil {
+		a.clientAddr = addr
+		return true
+	}
+
+	return a.clientAddr.Port == addr.Port
+}
@@ -0,0 +1,203 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+	"github.com/redawl/gitm/internal/util"
+)
+
+func TestHandleUDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer echo.Close() //nolint:errcheck
+	go func() {
+		buff := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(append([]byte("echo "), buff[:n]...), addr)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer listener.Close() //nolint:errcheck
+
+	handled := make(chan *packet.UDPPacket, 2)
+	done := make(chan error)
+	go func() {
+		server, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer server.Close() //nolint:errcheck
+		done <- handleUDP(server, &internal.Config{}, &ClientConnRequest{DstIP: "0.0.0.0"}, packet.ConnInfo{Username: "alice"}, func(p packet.Packet) {
+			handled <- p.(*packet.UDPPacket)
+		})
+	}()
+
+	control, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	reply, err := util.ReadCount(control, 10)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if reply[1] != StatusSucceeded || reply[3] != AddressTypeIPv4 {
+		t.Fatalf("Expected successful ipv4 reply, got %x", reply)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 + int(reply[9])}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer client.Close() //nolint:errcheck
+
+	request := FormatUDPResponse(echo.LocalAddr(), []byte("hello"))
+	if _, err := client.Write(request); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buff := make([]byte, maxDatagramSize)
+	n, err := client.Read(buff)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	response, err := ParseUDPRequest(buff[:n])
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if !bytes.Equal(response.Data, []byte("echo hello")) {
+		t.Errorf("response.Data = %s, want echo hello", response.Data)
+	}
+	if echoAddr := echo.LocalAddr().(*net.UDPAddr); response.DstIP != echoAddr.IP.String() || int(response.DstPort) != echoAddr.Port {
+		t.Errorf("response from %s:%d, want %s", response.DstIP, response.DstPort, echoAddr)
+	}
+
+	_ = control.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected err = nil, got err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handleUDP did not return after the control connection closed")
+	}
+
+	// Packets are handled after the association they were captured from
+	packets := make([]*packet.UDPPacket, 0, 2)
+	for len(packets) < 2 {
+		select {
+		case p := <-handled:
+			packets = append(packets, p)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("len(packets) = %d, want 2", len(packets))
+		}
+	}
+	if !packets[0].FromClient || packets[1].FromClient {
+		t.Errorf("Expected the first packet to be from the client, and the second from the destination")
+	}
+	if packets[0].Username != "alice" {
+		t.Errorf("packets[0].Username = %s, want alice", packets[0].Username)
+	}
+}
+
+func TestHandleUDPUpstreamDomain(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer echo.Close() //nolint:errcheck
+	go func() {
+		buff := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buff[:n], addr)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer listener.Close() //nolint:errcheck
+
+	// gitm is used as its own upstream proxy, which resolves the domain name
+	conf := &internal.Config{UpstreamProxy: "socks5://" + startProxy(t, handleConnection, &internal.Config{}, func(packet.Packet) {})}
+	handled := make(chan *packet.UDPPacket, 2)
+	go func() {
+		server, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close() //nolint:errcheck
+		_ = handleUDP(server, conf, &ClientConnRequest{DstIP: "0.0.0.0"}, packet.ConnInfo{}, func(p packet.Packet) {
+			handled <- p.(*packet.UDPPacket)
+		})
+	}()
+
+	control, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer control.Close() //nolint:errcheck
+	reply, err := util.ReadCount(control, 10)
+	if err != nil || reply[1] != StatusSucceeded {
+		t.Fatalf("Expected successful reply, got %x, err = %v", reply, err)
+	}
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 + int(reply[9])})
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer client.Close() //nolint:errcheck
+
+	port := uint16(echo.LocalAddr().(*net.UDPAddr).Port)
+	destination, err := formatDestination("localhost", port)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if _, err := client.Write(append(append([]byte{0x00, 0x00, 0x00}, destination...), "hello"...)); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	// The reply comes from the address the upstream proxy resolved the domain name to
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buff := make([]byte, maxDatagramSize)
+	n, err := client.Read(buff)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if response, err := ParseUDPRequest(buff[:n]); err != nil || string(response.Data) != "hello" {
+		t.Errorf("Expected the datagram to be echoed, got %+v, err = %v", response, err)
+	}
+
+	select {
+	case p := <-handled:
+		if expected := net.JoinHostPort("localhost", strconv.Itoa(int(port))); p.FormatHostname() != expected {
+			t.Errorf("Captured datagram to %s, want %s", p.FormatHostname(), expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for packets")
+	}
+}
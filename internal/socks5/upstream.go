@@ -0,0 +1,328 @@
+package socks5
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/util"
+)
+
+// upstreamDialer makes the outbound connections for proxied clients,
+// through the upstream proxy when one is configured.
+type upstreamDialer struct {
+	// proxyURL is the upstream proxy, or nil to always connect directly
+	proxyURL *url.URL
+	username string
+	password string
+	// bypass are the hosts that are always connected to directly
+	bypass []string
+}
+
+func newUpstreamDialer(conf *internal.Config) (*upstreamDialer, error) {
+	dialer := &upstreamDialer{
+		username: conf.UpstreamProxyUsername,
+		password: conf.UpstreamProxyPassword,
+		bypass:   conf.UpstreamProxyBypass,
+	}
+
+	if conf.UpstreamProxy == "" {
+		return dialer, nil
+	}
+
+	proxyURL, err := url.Parse(conf.UpstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstream proxy: %w", err)
+	}
+
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q, must be http or socks5", proxyURL.Scheme)
+	}
+
+	if proxyURL.Port() == "" {
+		return nil, fmt.Errorf("upstream proxy %q has no port", conf.UpstreamProxy)
+	}
+
+	dialer.proxyURL = proxyURL
+
+	return dialer, nil
+}
+
+// direct reports whether connections to host are made without the upstream proxy.
+func (d *upstreamDialer) direct(host string) bool {
+	return d.proxyURL == nil || matchesHost(host, d.bypass)
+}
+
+// Dial connects to address, through the upstream proxy unless the host is bypassed.
+// The host is resolved by the upstream proxy, when connecting through it.
+func (d *upstreamDialer) Dial(address string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("parsing address: %w", err)
+	}
+
+	if d.direct(host) {
+		return net.Dial("tcp", address)
+	}
+
+	conn, err := net.Dial("tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("contacting upstream proxy: %w", err)
+	}
+
+	var upstreamConn net.Conn = conn
+	if d.proxyURL.Scheme == "http" {
+		upstreamConn, err = d.connectHTTP(conn, address)
+	} else {
+		var port uint64
+		if port, err = strconv.ParseUint(portString, 10, 16); err == nil {
+			_, err = d.connectSocks5(conn, CmdConnect, host, uint16(port))
+		}
+	}
+
+	if err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, fmt.Errorf("connecting through upstream proxy: %w", err)
+	}
+
+	return upstreamConn, nil
+}
+
+// connectHTTP opens a tunnel to address using the CONNECT method.
+func (d *upstreamDialer) connectHTTP(conn net.Conn, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if d.username != "" {
+		request.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(d.username+":"+d.password)))
+	}
+
+	if err := request.Write(conn); err != nil {
+		return nil, fmt.Errorf("sending connect request: %w", err)
+	}
+
+	// The server may speak first, so anything buffered after the response needs to be kept
+	bufConn := newBufferedConn(conn)
+	response, err := http.ReadResponse(bufConn.reader, request)
+	if err != nil {
+		return nil, fmt.Errorf("reading connect response: %w", err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("connect to %s refused: %s", address, response.Status)
+	}
+
+	return bufConn, nil
+}
+
+// connectSocks5 sends a socks5 request for cmd with the destination host:port, authenticating if needed.
+// The bound address from the reply is returned.
+func (d *upstreamDialer) connectSocks5(conn net.Conn, cmd byte, host string, port uint16) (*net.TCPAddr, error) {
+	methods := []byte{MethodNoAuthRequired}
+	if d.username != "" {
+		methods = append(methods, MethodUsernamePassword)
+	}
+
+	if _, err := conn.Write(append([]byte{SocksVer5, byte(len(methods))}, methods...)); err != nil {
+		return nil, fmt.Errorf("sending client greeting: %w", err)
+	}
+
+	choice, err := util.ReadCount(conn, 2)
+	if err != nil {
+		return nil, fmt.Errorf("reading server choice: %w", err)
+	}
+
+	switch choice[1] {
+	case MethodNoAuthRequired:
+	case MethodUsernamePassword:
+		auth := []byte{AuthVer1, byte(len(d.username))}
+		auth = append(auth, d.username...)
+		auth = append(auth, byte(len(d.password)))
+		auth = append(auth, d.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, fmt.Errorf("sending username/password request: %w", err)
+		}
+
+		response, err := util.ReadCount(conn, 2)
+		if err != nil {
+			return nil, fmt.Errorf("reading auth response: %w", err)
+		}
+		if response[1] != AuthStatusSucceeded {
+			return nil, fmt.Errorf("invalid credentials for user %q", d.username)
+		}
+	default:
+		return nil, fmt.Errorf("no acceptable auth methods")
+	}
+
+	destination, err := formatDestination(host, port)
+	if err != nil {
+		return nil, err
+	}
+	request := append([]byte{SocksVer5, cmd, 0x00}, destination...)
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("sending conn request: %w", err)
+	}
+
+	reply, err := util.ReadCount(conn, 4)
+	if err != nil {
+		return nil, fmt.Errorf("reading conn response: %w", err)
+	}
+
+	bndIP, bndPort, _, err := parseAddress(conn, reply[3])
+	if err != nil {
+		return nil, fmt.Errorf("reading bound address: %w", err)
+	}
+
+	if reply[1] != StatusSucceeded {
+		return nil, fmt.Errorf("request for %s refused with status %d", net.JoinHostPort(host, strconv.Itoa(int(port))), reply[1])
+	}
+
+	return &net.TCPAddr{IP: net.ParseIP(bndIP), Port: int(bndPort)}, nil
+}
+
+// associateUDP creates a udp association with the upstream proxy.
+// nil is returned when there is no upstream proxy that can relay udp.
+func (d *upstreamDialer) associateUDP() (*upstreamUDP, error) {
+	if d.proxyURL == nil || d.proxyURL.Scheme != "socks5" {
+		return nil, nil
+	}
+
+	control, err := net.Dial("tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("contacting upstream proxy: %w", err)
+	}
+
+	// We don't know which address datagrams will be sent from until the socket is opened
+	relayAddr, err := d.connectSocks5(control, CmdUDPAssociate, "0.0.0.0", 0)
+	if err != nil {
+		control.Close() //nolint:errcheck
+		return nil, fmt.Errorf("udp associate with upstream proxy: %w", err)
+	}
+
+	if relayAddr.IP == nil || relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: relayAddr.IP, Port: relayAddr.Port})
+	if err != nil {
+		control.Close() //nolint:errcheck
+		return nil, fmt.Errorf("opening upstream udp socket: %w", err)
+	}
+
+	return &upstreamUDP{control: control, conn: conn}, nil
+}
+
+// upstreamUDP sends and receives datagrams through the udp relay of the upstream proxy.
+type upstreamUDP struct {
+	// control is the tcp connection the association was made on, which must stay open
+	control net.Conn
+	conn    *net.UDPConn
+}
+
+// WriteToHost sends data to host:port through the upstream proxy. host can be a domain name,
+// which the upstream proxy resolves.
+func (u *upstreamUDP) WriteToHost(data []byte, host string, port uint16) (int, error) {
+	destination, err := formatDestination(host, port)
+	if err != nil {
+		return 0, err
+	}
+	datagram := append([]byte{0x00, 0x00, 0x00}, destination...)
+
+	return u.conn.Write(append(datagram, data...))
+}
+
+func (u *upstreamUDP) ReadFromUDP(buff []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, err := u.conn.Read(buff)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		response, err := ParseUDPRequest(buff[:n])
+		if err != nil || response.Frag != 0 {
+			continue
+		}
+
+		srcAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(response.DstIP, strconv.Itoa(int(response.DstPort))))
+		if err != nil {
+			continue
+		}
+
+		return copy(buff, response.Data), srcAddr, nil
+	}
+}
+
+func (u *upstreamUDP) Close() error {
+	u.control.Close() //nolint:errcheck
+	return u.conn.Close()
+}
+
+// formatDestination formats host as an address type and the address, followed by port.
+// Unlike formatAddress, host can be a domain name, as long as it fits in the single length byte socks5 gives it.
+func formatDestination(host string, port uint16) ([]byte, error) {
+	var formatted []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name is %d bytes, socks5 allows at most 255", len(host))
+		}
+		formatted = append(formatted, AddressTypeDomainName, byte(len(host)))
+		formatted = append(formatted, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		formatted = append(formatted, AddressTypeIPv4)
+		formatted = append(formatted, ip4...)
+	} else {
+		formatted = append(formatted, AddressTypeIPv6)
+		formatted = append(formatted, ip.To16()...)
+	}
+
+	return append(formatted, byte(port>>8), byte(port&0xFF)), nil
+}
+
+// matchesHost reports whether host matches any of the rules.
+//
+// A rule is either "*" to match every host, an ip, a cidr (i.e. "10.0.0.0/8"),
+// or a domain name, which also matches all of its subdomains.
+func matchesHost(host string, rules []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if rule == "" {
+			continue
+		}
+
+		if rule == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(rule); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if ruleIP := net.ParseIP(rule); ruleIP != nil {
+			if ruleIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		domain := strings.TrimPrefix(strings.TrimPrefix(rule, "*"), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
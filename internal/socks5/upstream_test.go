@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+func TestMatchesHost(t *testing.T) {
+	rules := []string{"example.com", ".internal", "10.0.0.0/8", "::1"}
+	tests := map[string]bool{
+		"example.com":       true,
+		"www.example.com":   true,
+		"notexample.com":    false,
+		"host.internal":     true,
+		"internal":          true,
+		"10.1.2.3":          true,
+		"11.1.2.3":          false,
+		"::1":               true,
+		"Example.COM.":      true,
+		"example.com.evil":  false,
+		"unrelated.example": false,
+	}
+
+	for host, expected := range tests {
+		if actual := matchesHost(host, rules); actual != expected {
+			t.Errorf("matchesHost(%s, ...) = %v, want %v", host, actual, expected)
+		}
+	}
+
+	if !matchesHost("anything", []string{"*"}) {
+		t.Errorf("matchesHost(anything, [*]) = false, want true")
+	}
+}
+
+func TestUpstreamDialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "Hello through the upstream proxy")
+	}))
+	defer server.Close()
+
+	// gitm is used as its own upstream proxy, requiring credentials
+	upstreamConf := &internal.Config{SocksCredentials: []string{"alice:secret"}}
+	upstreams := map[string]string{
+		"socks5": "socks5://" + startProxy(t, handleConnection, upstreamConf, func(packet.Packet) {}),
+		"http":   "http://" + startProxy(t, handleHTTPProxyConnection, upstreamConf, func(packet.Packet) {}),
+	}
+
+	for name, upstream := range upstreams {
+		t.Run(name, func(t *testing.T) {
+			dialer, err := newUpstreamDialer(&internal.Config{
+				UpstreamProxy:         upstream,
+				UpstreamProxyUsername: "alice",
+				UpstreamProxyPassword: "secret",
+			})
+			if err != nil {
+				t.Fatalf("Expected err = nil, got err = %v", err)
+			}
+
+			conn, err := dialer.Dial(server.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Expected err = nil, got err = %v", err)
+			}
+			defer conn.Close() //nolint:errcheck
+
+			if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+				t.Fatalf("Expected err = nil, got err = %v", err)
+			}
+			response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("Expected err = nil, got err = %v", err)
+			}
+			body, _ := io.ReadAll(response.Body)
+			if string(body) != "Hello through the upstream proxy" {
+				t.Errorf("Response body = %s, want Hello through the upstream proxy", body)
+			}
+		})
+	}
+
+	dialer, err := newUpstreamDialer(&internal.Config{UpstreamProxy: upstreams["http"], UpstreamProxyUsername: "alice", UpstreamProxyPassword: "wrong"})
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if _, err := dialer.Dial(server.Listener.Addr().String()); err == nil {
+		t.Errorf("Expected err != nil with wrong credentials, got err = nil")
+	}
+}
+
+func TestFormatDestination(t *testing.T) {
+	for host, expected := range map[string][]byte{
+		"10.0.0.1":    {AddressTypeIPv4, 10, 0, 0, 1, 0x01, 0xbb},
+		"example.com": append(append([]byte{AddressTypeDomainName, 11}, "example.com"...), 0x01, 0xbb),
+	} {
+		if actual, err := formatDestination(host, 443); err != nil || !bytes.Equal(actual, expected) {
+			t.Errorf("formatDestination(%s, 443) = %v, %v, want %v", host, actual, err, expected)
+		}
+	}
+
+	// The length of a domain name is a single byte
+	if _, err := formatDestination(strings.Repeat("a", 255), 443); err != nil {
+		t.Errorf("Expected err = nil, got err = %v", err)
+	}
+	if _, err := formatDestination(strings.Repeat("a", 256), 443); err == nil {
+		t.Errorf("Expected err != nil for a 256 byte domain name, got err = nil")
+	}
+}
+
+func TestUpstreamDialerUDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer echo.Close() //nolint:errcheck
+	go func() {
+		buff := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buff[:n], addr)
+		}
+	}()
+
+	upstream := startProxy(t, handleConnection, &internal.Config{}, func(packet.Packet) {})
+	dialer, err := newUpstreamDialer(&internal.Config{UpstreamProxy: "socks5://" + upstream})
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	association, err := dialer.associateUDP()
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	defer association.Close() //nolint:errcheck
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	if _, err := association.WriteToHost([]byte("ping"), "localhost", uint16(echoAddr.Port)); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	buff := make([]byte, maxDatagramSize)
+	n, srcAddr, err := association.ReadFromUDP(buff)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if string(buff[:n]) != "ping" || srcAddr.String() != echoAddr.String() {
+		t.Errorf("ReadFromUDP(...) = %s from %s, want ping from %s", buff[:n], srcAddr, echoAddr)
+	}
+}
@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/redawl/gitm/internal"
+)
+
+var (
+	upstreamRootsMu sync.Mutex
+	// upstreamRootPools are the root pools returned by upstreamRoots, by ca bundle path.
+	// Building a pool reads the system roots and the bundle, which is too slow to do on every handshake.
+	upstreamRootPools = make(map[string]*x509.CertPool)
+)
+
+// verifyServer verifies the certificate chain the server sent for host, trusting the system roots
+// and the CAs in conf.UpstreamCAFile.
+// host is the server name the client sent, or the host it asked to connect to when it sent none,
+// and can be an ip address.
+//
+// interceptTLS verifies the server when conf.VerifyUpstreamCerts is set, before the client handshake completes.
+// A failure refuses the client if host is in conf.RefuseUnverifiedHosts, and flags the packets otherwise.
+func verifyServer(conf *internal.Config, host string, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server sent no certificates")
+	}
+
+	roots, err := upstreamRoots(conf.UpstreamCAFile)
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+
+	return err
+}
+
+// upstreamRoots returns the system roots, plus the CAs in the pem bundle caFile if it isn't empty.
+// The pool is built once for every caFile, and rebuilt by loadUpstreamRoots.
+func upstreamRoots(caFile string) (*x509.CertPool, error) {
+	upstreamRootsMu.Lock()
+	roots := upstreamRootPools[caFile]
+	upstreamRootsMu.Unlock()
+	if roots != nil {
+		return roots, nil
+	}
+
+	return loadUpstreamRoots(caFile)
+}
+
+// loadUpstreamRoots builds the pool returned by upstreamRoots for caFile, replacing the one built before,
+// so that changes to the bundle are picked up when the servers are restarted.
+func loadUpstreamRoots(caFile string) (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	if caFile != "" {
+		bundle, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading upstream ca bundle: %w", err)
+		}
+
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in upstream ca bundle %s", caFile)
+		}
+	}
+
+	upstreamRootsMu.Lock()
+	upstreamRootPools[caFile] = roots
+	upstreamRootsMu.Unlock()
+
+	return roots, nil
+}
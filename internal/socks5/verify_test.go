@@ -0,0 +1,145 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/packet"
+)
+
+func TestInterceptTLSVerifiesServer(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The test server's certificate is self signed, so it is its own CA
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		conf         *internal.Config
+		refused      bool
+		verified     bool
+		verification bool
+	}{
+		{"disabled", &internal.Config{}, false, false, false},
+		{"flagged", &internal.Config{VerifyUpstreamCerts: true}, false, false, true},
+		{"trusted ca", &internal.Config{VerifyUpstreamCerts: true, UpstreamCAFile: caFile}, false, true, false},
+		{"refused", &internal.Config{VerifyUpstreamCerts: true, RefuseUnverifiedHosts: []string{"example.com"}}, true, false, false},
+		{"refused host trusted", &internal.Config{VerifyUpstreamCerts: true, UpstreamCAFile: caFile, RefuseUnverifiedHosts: []string{"*"}}, false, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, wait := collectPackets()
+			listener, roots := interceptTLSTo(t, server, test.conf, handler)
+
+			transport := &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, listener.Addr().String())
+				},
+			}
+			defer transport.CloseIdleConnections()
+
+			resp, err := (&http.Client{Transport: transport}).Get("https://example.com/verify")
+			if test.refused {
+				if err == nil {
+					_ = resp.Body.Close()
+					t.Fatalf("Expected the connection to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected err = nil, got err = %v", err)
+			}
+			_ = resp.Body.Close()
+
+			p := wait(t, 1)["/verify"]
+			if p == nil || p.TLS == nil {
+				t.Fatalf("Expected a packet with tls metadata, got %v", p)
+			}
+			if p.TLS.Verified != test.verified {
+				t.Errorf("TLS.Verified = %v, want %v", p.TLS.Verified, test.verified)
+			}
+			if (p.TLSVerificationError() != "") != test.verification {
+				t.Errorf("TLSVerificationError() = %q, want an error %v", p.TLSVerificationError(), test.verification)
+			}
+		})
+	}
+}
+
+func TestInterceptTLSVerifiesDestinationWithoutServerName(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	impersonate(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	conf := &internal.Config{VerifyUpstreamCerts: true, UpstreamCAFile: caFile, RefuseUnverifiedHosts: []string{"*"}}
+
+	for _, test := range []struct {
+		dstHost string
+		refused bool
+	}{
+		{"127.0.0.1", false},
+		// The test server's certificate isn't valid for the address the client asked for
+		{"192.0.2.1", true},
+	} {
+		client, proxyClient := tcpPair(t)
+		proxyServer, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Expected err = nil, got err = %v", err)
+		}
+		go func() {
+			defer proxyClient.Close() //nolint:errcheck
+			defer proxyServer.Close() //nolint:errcheck
+			_ = interceptTLS(proxyClient, proxyServer, conf, test.dstHost, packet.ConnInfo{}, func(packet.Packet) {})
+		}()
+
+		// The client sends no server name
+		tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsClient.Handshake(); (err != nil) != test.refused {
+			t.Errorf("%s: Expected refused = %v, got err = %v", test.dstHost, test.refused, err)
+		}
+		_ = tlsClient.Close()
+	}
+}
+
+func TestUpstreamRootsCached(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	roots, err := upstreamRoots(caFile)
+	if err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	// The bundle isn't read again until the pool is reloaded
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+	if cached, err := upstreamRoots(caFile); err != nil || cached != roots {
+		t.Errorf("Expected the cached pool, got err = %v", err)
+	}
+	if _, err := loadUpstreamRoots(caFile); err == nil {
+		t.Errorf("Expected err != nil, got err = nil")
+	}
+}
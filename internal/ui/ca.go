@@ -0,0 +1,162 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/lang"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/widget"
+	"github.com/redawl/gitm/internal/socks5"
+	"github.com/redawl/gitm/internal/util"
+)
+
+// MakeCAMenu creates the menu item for managing the gitm CA
+func MakeCAMenu(w fyne.Window) *fyne.MenuItem {
+	item := fyne.NewMenuItem(lang.L("Certificate Authority"), nil)
+	item.ChildMenu = fyne.NewMenu("",
+		fyne.NewMenuItem(lang.L("Certificates"), ShowCertificateManager),
+		fyne.NewMenuItemSeparator(),
+		fyne.NewMenuItem(lang.L("Import"), func() { importCA(w) }),
+		fyne.NewMenuItem(lang.L("Rotate"), func() { rotateCA(w) }),
+		fyne.NewMenuItemSeparator(),
+		fyne.NewMenuItem(lang.L("Export DER"), func() { exportCA(socks5.CAFormatDER, w) }),
+		fyne.NewMenuItem(lang.L("Export PEM"), func() { exportCA(socks5.CAFormatPEM, w) }),
+		fyne.NewMenuItem(lang.L("Export PKCS #12"), func() { exportCA(socks5.CAFormatPKCS12, w) }),
+		fyne.NewMenuItem(lang.L("Export iOS / macOS Profile"), func() { exportCA(socks5.CAFormatMobileConfig, w) }),
+		fyne.NewMenuItemSeparator(),
+		fyne.NewMenuItem(lang.L("Check Expiry"), func() {
+			warnings, err := socks5.CheckExpiry()
+			if err != nil {
+				util.ReportUIErrorWithMessage("Error checking certificate expiry", err, w)
+				return
+			}
+			if len(warnings) == 0 {
+				dialog.ShowInformation(lang.L("Certificate Authority"), lang.L("No certificates are about to expire"), w)
+				return
+			}
+			dialog.ShowInformation(lang.L("Certificate Authority"), strings.Join(warnings, "\n"), w)
+		}),
+	)
+
+	return item
+}
+
+// CheckCAExpiry warns the user if the gitm CA, or a certificate it issued, is about to expire.
+func (m *MainWindow) CheckCAExpiry() {
+	warnings, err := socks5.CheckExpiry()
+	if err != nil {
+		slog.Error("Error checking certificate expiry", "error", err)
+		return
+	}
+	if len(warnings) > 0 {
+		dialog.ShowInformation(lang.L("Certificates expiring"), strings.Join(warnings, "\n"), m)
+	}
+}
+
+func importCA(w fyne.Window) {
+	dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+		if err != nil {
+			util.ReportUIErrorWithMessage("Error opening file", err, w)
+			return
+		}
+
+		if reader == nil {
+			return
+		}
+		defer reader.Close() //nolint:errcheck
+
+		contents, err := io.ReadAll(reader)
+		if err != nil {
+			util.ReportUIErrorWithMessage("Error reading file contents", err, w)
+			return
+		}
+
+		password := widget.NewPasswordEntry()
+		dialog.ShowForm(lang.L("Import CA"), lang.L("Import"), lang.L("Cancel"), []*widget.FormItem{
+			widget.NewFormItem(lang.L("Password"), password),
+		}, func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			if err := socks5.ImportCA(contents, password.Text); err != nil {
+				util.ReportUIErrorWithMessage("Error importing CA", err, w)
+				return
+			}
+			dialog.ShowInformation(lang.L("Import CA"), lang.L("CA imported. Make sure your devices trust it."), w)
+		}, w)
+	}, w)
+}
+
+func rotateCA(w fyne.Window) {
+	dialog.ShowConfirm(
+		lang.L("Rotate CA"),
+		lang.L("A new CA will be created, and the certificates issued by the current one deleted. Devices have to trust the new CA before they can be intercepted again. Rotate now?"),
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			if err := socks5.RotateCA(); err != nil {
+				util.ReportUIErrorWithMessage("Error rotating CA", err, w)
+				return
+			}
+			dialog.ShowInformation(lang.L("Rotate CA"), lang.L("CA rotated. Install the new CA on your devices."), w)
+		},
+		w,
+	)
+}
+
+func exportCA(format string, w fyne.Window) {
+	save := func(password string) {
+		contents, err := socks5.ExportCA(format, password)
+		if err != nil {
+			util.ReportUIErrorWithMessage("Error exporting CA", err, w)
+			return
+		}
+
+		saveDialog := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+			if err != nil {
+				util.ReportUIErrorWithMessage("Error saving to file", err, w)
+				return
+			}
+
+			if writer == nil {
+				return
+			}
+			defer writer.Close() //nolint:errcheck
+
+			if _, err := writer.Write(contents); err != nil {
+				util.ReportUIErrorWithMessage("Error writing file contents", err, w)
+			}
+		}, w)
+		saveDialog.SetFileName(fmt.Sprintf("gitm-ca.%s", format))
+		saveDialog.SetFilter(storage.NewExtensionFileFilter([]string{"." + format}))
+		saveDialog.Show()
+	}
+
+	if format != socks5.CAFormatPKCS12 {
+		save("")
+		return
+	}
+
+	// The PKCS #12 export includes the private key, so it must be protected by a password
+	password := widget.NewPasswordEntry()
+	password.Validator = func(s string) error {
+		if s == "" {
+			return errors.New(lang.L("Password is required"))
+		}
+		return nil
+	}
+	dialog.ShowForm(lang.L("Export CA"), lang.L("Export"), lang.L("Cancel"), []*widget.FormItem{
+		widget.NewFormItem(lang.L("Password"), password),
+	}, func(confirmed bool) {
+		if confirmed {
+			save(password.Text)
+		}
+	}, w)
+}
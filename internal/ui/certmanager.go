@@ -0,0 +1,184 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/lang"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"github.com/redawl/gitm/internal/socks5"
+	"github.com/redawl/gitm/internal/util"
+)
+
+// CertificateManager lists the forged certificates stored in the db,
+// and lets the user delete or reissue them.
+type CertificateManager struct {
+	widget.BaseWidget
+	window       fyne.Window
+	table        *widget.Table
+	certificates []socks5.CertificateInfo
+	// selected is the row of the selected certificate, or -1 if none is selected
+	selected int
+}
+
+var certificateColumns = []string{"Domain", "SANs", "Expires", "Key Type"}
+
+// NewCertificateManager creates a CertificateManager, showing its dialogs on w
+func NewCertificateManager(w fyne.Window) *CertificateManager {
+	m := &CertificateManager{window: w, selected: -1}
+	m.table = widget.NewTable(
+		func() (int, int) { return len(m.certificates), len(certificateColumns) },
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.Truncation = fyne.TextTruncateEllipsis
+			return label
+		},
+		func(id widget.TableCellID, co fyne.CanvasObject) {
+			co.(*widget.Label).SetText(m.cellText(id))
+		},
+	)
+	m.table.ShowHeaderRow = true
+	m.table.CreateHeader = func() fyne.CanvasObject {
+		label := widget.NewLabel("")
+		label.TextStyle.Bold = true
+		return label
+	}
+	m.table.UpdateHeader = func(id widget.TableCellID, template fyne.CanvasObject) {
+		if id.Row == -1 {
+			template.(*widget.Label).SetText(lang.L(certificateColumns[id.Col]))
+		}
+	}
+	m.table.OnSelected = func(id widget.TableCellID) {
+		m.selected = id.Row
+	}
+	m.table.OnUnselected = func(widget.TableCellID) {
+		m.selected = -1
+	}
+	m.table.SetColumnWidth(0, 250)
+	m.table.SetColumnWidth(1, 350)
+	m.table.SetColumnWidth(2, 150)
+	m.table.SetColumnWidth(3, 120)
+
+	m.ExtendBaseWidget(m)
+	m.Reload()
+
+	return m
+}
+
+// cellText is the text of the cell at id
+func (m *CertificateManager) cellText(id widget.TableCellID) string {
+	certificate := m.certificates[id.Row]
+	switch id.Col {
+	case 0:
+		if certificate.Mirrored {
+			return certificate.Domain + " " + lang.L("(mirrored)")
+		}
+		return certificate.Domain
+	case 1:
+		return strings.Join(certificate.SANs, ", ")
+	case 2:
+		if certificate.Error != "" {
+			return lang.L("Invalid")
+		} else if certificate.Expired() {
+			return lang.L("Expired")
+		} else if !certificate.IssuedByCA {
+			return lang.L("Old CA")
+		}
+		return certificate.NotAfter.Format(time.DateOnly)
+	default:
+		return certificate.KeyType
+	}
+}
+
+// Reload reloads the certificates from the db
+func (m *CertificateManager) Reload() {
+	certificates, err := socks5.ListCertificates()
+	if err != nil {
+		util.ReportUIErrorWithMessage("Error listing certificates", err, m.window)
+	}
+	m.certificates = certificates
+	m.selected = -1
+	m.table.UnselectAll()
+	m.table.Refresh()
+}
+
+// withSelected calls f with the selected certificate, or tells the user to select one
+func (m *CertificateManager) withSelected(f func(certificate socks5.CertificateInfo)) {
+	if m.selected < 0 || m.selected >= len(m.certificates) {
+		dialog.ShowInformation(lang.L("Certificates"), lang.L("Select a certificate first"), m.window)
+		return
+	}
+
+	f(m.certificates[m.selected])
+}
+
+func (m *CertificateManager) showPEM() {
+	m.withSelected(func(certificate socks5.CertificateInfo) {
+		NewPopoutDialog(certificate.Key, lang.L("Dismiss"), func() fyne.CanvasObject {
+			return widget.NewTextGridFromString(certificate.PEM)
+		}, m.window).Show()
+	})
+}
+
+func (m *CertificateManager) reissue() {
+	m.withSelected(func(certificate socks5.CertificateInfo) {
+		if err := socks5.ReissueCertificate(certificate.Key); err != nil {
+			util.ReportUIErrorWithMessage("Error reissuing certificate", err, m.window)
+		}
+		m.Reload()
+	})
+}
+
+func (m *CertificateManager) delete() {
+	m.withSelected(func(certificate socks5.CertificateInfo) {
+		dialog.ShowConfirm(
+			lang.L("Delete certificate"),
+			fmt.Sprintf(lang.L("Delete the certificate for %s? A new one is issued the next time it is intercepted."), certificate.Domain),
+			func(confirmed bool) {
+				if !confirmed {
+					return
+				}
+				if err := socks5.DeleteCertificate(certificate.Key); err != nil {
+					util.ReportUIErrorWithMessage("Error deleting certificate", err, m.window)
+				}
+				m.Reload()
+			},
+			m.window,
+		)
+	})
+}
+
+func (m *CertificateManager) prune() {
+	pruned, err := socks5.PruneCertificates()
+	if err != nil {
+		util.ReportUIErrorWithMessage("Error pruning certificates", err, m.window)
+	}
+	m.Reload()
+	dialog.ShowInformation(lang.L("Certificates"), fmt.Sprintf(lang.L("Deleted %d certificates not issued by the current CA"), pruned), m.window)
+}
+
+func (m *CertificateManager) CreateRenderer() fyne.WidgetRenderer {
+	toolbar := container.NewHBox(
+		widget.NewButtonWithIcon(lang.L("Refresh"), theme.ViewRefreshIcon(), m.Reload),
+		widget.NewButtonWithIcon(lang.L("Show PEM"), theme.DocumentIcon(), m.showPEM),
+		widget.NewButtonWithIcon(lang.L("Reissue"), theme.MediaReplayIcon(), m.reissue),
+		widget.NewButtonWithIcon(lang.L("Delete"), theme.DeleteIcon(), m.delete),
+		layout.NewSpacer(),
+		widget.NewButtonWithIcon(lang.L("Prune"), theme.ContentClearIcon(), m.prune),
+	)
+
+	return widget.NewSimpleRenderer(container.NewBorder(toolbar, nil, nil, nil, m.table))
+}
+
+// ShowCertificateManager opens the certificate manager in its own window
+func ShowCertificateManager() {
+	w := util.NewWindowIfNotExists(lang.L("Certificates"))
+	w.SetContent(NewCertificateManager(w))
+	w.Show()
+}
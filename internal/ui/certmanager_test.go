@@ -0,0 +1,37 @@
+package ui
+
+import (
+	"testing"
+
+	"fyne.io/fyne/v2/test"
+	"fyne.io/fyne/v2/widget"
+	"github.com/redawl/gitm/internal"
+	"github.com/redawl/gitm/internal/socks5"
+)
+
+func TestCertificateManager(t *testing.T) {
+	app := test.NewTempApp(t)
+	app.Preferences().SetString(internal.ConfigDir, t.TempDir())
+	if _, err := socks5.AddHostname("manager.example.com"); err != nil {
+		t.Fatalf("Expected err = nil, got err = %v", err)
+	}
+
+	w := test.NewWindow(nil)
+	manager := NewCertificateManager(w)
+
+	if len(manager.certificates) != 1 {
+		t.Fatalf("len(manager.certificates) = %d, expected 1", len(manager.certificates))
+	}
+	if domain := manager.cellText(widget.TableCellID{Row: 0, Col: 0}); domain != "manager.example.com" {
+		t.Errorf("Domain = %s, expected manager.example.com", domain)
+	}
+	if keyType := manager.cellText(widget.TableCellID{Row: 0, Col: 3}); keyType != "ECDSA P-256" {
+		t.Errorf("Key Type = %s, expected ECDSA P-256", keyType)
+	}
+
+	manager.table.Select(widget.TableCellID{Row: 0, Col: 0})
+	manager.reissue()
+	if len(manager.certificates) != 1 || manager.selected != -1 {
+		t.Errorf("Expected the reissued certificate to be reloaded, got %d certificates", len(manager.certificates))
+	}
+}
@@ -14,10 +14,18 @@ type PacketDisplay struct {
 	entry       *PacketEntry
 	placeHolder *PlaceHolder
 	label       *widget.Label
+	// tlsButton shows the tls metadata of the packet, when it has any
+	tlsButton *widget.Button
 
 	packet packet.Packet
 }
 
+// tlsPacket is a packet that may have been captured on an intercepted tls connection
+type tlsPacket interface {
+	FormatTLS() string
+	TLSVerificationError() string
+}
+
 func NewPacketDisplay(title string, w fyne.Window, handleDecodeResult func(string)) *PacketDisplay {
 	packetDisplay := &PacketDisplay{
 		entry: NewPacketEntry(w, handleDecodeResult),
@@ -27,6 +35,18 @@ func NewPacketDisplay(title string, w fyne.Window, handleDecodeResult func(strin
 		},
 		placeHolder: NewPlaceHolder(lang.L("Select a packet"), theme.InfoIcon()),
 	}
+	packetDisplay.tlsButton = &widget.Button{
+		Text:       lang.L("TLS"),
+		Icon:       EncryptedIcon(),
+		Importance: widget.LowImportance,
+		OnTapped: func() {
+			text := packetDisplay.packet.(tlsPacket).FormatTLS()
+			NewPopoutDialog(lang.L("TLS"), lang.L("Dismiss"), func() fyne.CanvasObject {
+				return widget.NewTextGridFromString(text)
+			}, w).Show()
+		},
+	}
+	packetDisplay.tlsButton.Hide()
 
 	packetDisplay.ExtendBaseWidget(packetDisplay)
 
@@ -36,7 +56,7 @@ func NewPacketDisplay(title string, w fyne.Window, handleDecodeResult func(strin
 func (p *PacketDisplay) CreateRenderer() fyne.WidgetRenderer {
 	return widget.NewSimpleRenderer(
 		container.NewBorder(
-			container.NewVBox(p.label, widget.NewSeparator()),
+			container.NewVBox(container.NewBorder(nil, nil, nil, p.tlsButton, p.label), widget.NewSeparator()),
 			nil,
 			nil,
 			nil,
@@ -59,6 +79,12 @@ func (p *PacketDisplay) SetPacket(pack packet.Packet, displayRequest bool) {
 
 	p.placeHolder.Hide()
 
+	if tlsPack, ok := pack.(tlsPacket); ok && displayRequest && tlsPack.FormatTLS() != "" {
+		p.tlsButton.Show()
+	} else {
+		p.tlsButton.Hide()
+	}
+
 	p.entry.SetText(text)
 
 	p.entry.ScrollToTop()
@@ -66,6 +92,7 @@ func (p *PacketDisplay) SetPacket(pack packet.Packet, displayRequest bool) {
 
 func (p *PacketDisplay) UnsetPacket() {
 	p.placeHolder.Show()
+	p.tlsButton.Hide()
 	p.entry.SetText("")
 	p.entry.ScrollToTop()
 }
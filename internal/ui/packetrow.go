@@ -5,6 +5,7 @@ import (
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	"github.com/redawl/gitm/internal/packet"
 	"github.com/redawl/gitm/internal/util"
@@ -84,7 +85,13 @@ func (row *PacketRow) CreateRenderer() fyne.WidgetRenderer {
 }
 
 func (row *PacketRow) UpdateRow(p packet.Packet) {
-	if p.Encrypted() {
+	if tlsPack, ok := p.(tlsPacket); ok && tlsPack.TLSVerificationError() != "" {
+		// The server's certificate failed verification
+		row.icon.SetResource(theme.WarningIcon())
+	} else if _, ok := p.(*packet.TLSFailurePacket); ok {
+		// The client rejected gitm's certificate
+		row.icon.SetResource(theme.ErrorIcon())
+	} else if p.Encrypted() {
 		row.icon.SetResource(EncryptedIcon())
 	} else {
 		row.icon.SetResource(NotEncryptedIcon())
@@ -2,6 +2,8 @@ package settings
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -72,34 +74,52 @@ func ipPortValidator(s string) error {
 		return nil
 	}
 
-	parts := strings.Split(s, ":")
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return fmt.Errorf("must be ip:port, or [ipv6]:port: %w", err)
+	}
+
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("%q is not a valid IPv4 or IPv6 address", host)
+	}
 
-	if len(parts) != 2 {
-		return fmt.Errorf("must have one colon")
+	if i, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("parsing port: %w", err)
+	} else {
+		if i < 0 || i > 65535 {
+			return fmt.Errorf("port must be between 0 and 65535")
+		}
 	}
 
-	ipParts := strings.Split(parts[0], ".")
+	return nil
+}
 
-	if len(ipParts) != 4 {
-		return fmt.Errorf("only IPv4 addresses are supported for now")
+func upstreamProxyValidator(s string) error {
+	if len(s) == 0 {
+		return nil
 	}
 
-	for _, part := range ipParts {
-		if i, err := strconv.Atoi(part); err != nil {
-			return fmt.Errorf("parsing ip: %w", err)
-		} else {
-			if i < 0 || i > 255 {
-				return fmt.Errorf("quad must be between 0 and 255")
-			}
-		}
+	proxyURL, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("parsing url: %w", err)
 	}
 
-	if i, err := strconv.Atoi(parts[1]); err != nil {
-		return fmt.Errorf("parsing port: %w", err)
-	} else {
-		if i < 0 || i > 65536 {
-			return fmt.Errorf("port must be between 0 and 65536")
-		}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5" {
+		return fmt.Errorf("must be http://host:port or socks5://host:port")
+	}
+
+	if proxyURL.Hostname() == "" || proxyURL.Port() == "" {
+		return fmt.Errorf("must include a host and port")
+	}
+
+	return nil
+}
+
+func countValidator(s string) error {
+	if i, err := strconv.Atoi(s); err != nil {
+		return fmt.Errorf("must be a number: %w", err)
+	} else if i < 0 {
+		return fmt.Errorf("must be 0 or more")
 	}
 
 	return nil
@@ -116,6 +136,70 @@ func dirValidator(s string) error {
 	return nil
 }
 
+// excludesValidator rejects text containing separator, which splits the columns of a pair table when saved
+func excludesValidator(separator string) fyne.StringValidator {
+	return func(s string) error {
+		if strings.Contains(s, separator) {
+			return fmt.Errorf("cannot contain %q", separator)
+		}
+
+		return nil
+	}
+}
+
+// newPairTable creates an editable table with two columns, where each row edits
+// the matching index of keys and values. The entries of each column are checked with
+// keyValidator and valueValidator, when they aren't nil.
+func newPairTable(keys *[]string, values *[]string, keyHeader string, valueHeader string, keyValidator fyne.StringValidator, valueValidator fyne.StringValidator) *widget.Table {
+	table := widget.NewTable(
+		func() (int, int) { return len(*keys), 2 },
+		func() fyne.CanvasObject {
+			return widget.NewEntry()
+		},
+		func(id widget.TableCellID, co fyne.CanvasObject) {
+			entry := co.(*widget.Entry)
+			// Entries are reused between columns, so the validator is set with the text
+			if id.Col == 0 {
+				entry.Validator = keyValidator
+				entry.OnChanged = func(s string) {
+					(*keys)[id.Row] = s
+				}
+				entry.SetText((*keys)[id.Row])
+			} else {
+				entry.Validator = valueValidator
+				entry.OnChanged = func(s string) {
+					(*values)[id.Row] = s
+				}
+				entry.SetText((*values)[id.Row])
+			}
+		},
+	)
+
+	table.HideSeparators = true
+	table.ShowHeaderRow = true
+	table.CreateHeader = func() fyne.CanvasObject {
+		label := widget.NewLabel("")
+
+		label.TextStyle.Bold = true
+		label.Alignment = fyne.TextAlignCenter
+		return label
+	}
+
+	table.UpdateHeader = func(id widget.TableCellID, template fyne.CanvasObject) {
+		if id.Row == -1 {
+			if id.Col == 0 {
+				template.(*widget.Label).SetText(keyHeader)
+			} else {
+				template.(*widget.Label).SetText(valueHeader)
+			}
+		}
+	}
+
+	table.Refresh()
+
+	return table
+}
+
 // MakeSettingsUI creates a window for settings that the user can modify
 func MakeSettingsUI(w fyne.Window, restart func()) dialog.Dialog {
 	a := fyne.CurrentApp()
@@ -129,19 +213,147 @@ func MakeSettingsUI(w fyne.Window, restart func()) dialog.Dialog {
 		Text:      prefs.String(internal.PACListenURI),
 		Validator: ipPortValidator,
 	}
+	pacProxyType := widget.NewSelect([]string{internal.PACProxyAll, internal.PACProxySocks, internal.PACProxyHTTP}, nil)
+	pacProxyType.SetSelected(prefs.StringWithFallback(internal.PACProxyType, internal.PACProxyAll))
+	pacDirectHosts := widget.NewMultiLineEntry()
+	pacDirectHosts.SetPlaceHolder("intranet.example.com\n10.0.0.0/8")
+	pacDirectHosts.SetText(strings.Join(prefs.StringList(internal.PACDirectHosts), "\n"))
+	pacProxyHosts := widget.NewMultiLineEntry()
+	pacProxyHosts.SetPlaceHolder(lang.L("Every host"))
+	pacProxyHosts.SetText(strings.Join(prefs.StringList(internal.PACProxyHosts), "\n"))
 	pacEnabled := &widget.Check{
 		Checked: prefs.Bool(internal.EnablePACServer),
 		OnChanged: func(b bool) {
 			if !b {
 				pacURL.Disable()
+				pacProxyType.Disable()
+				pacDirectHosts.Disable()
+				pacProxyHosts.Disable()
 			} else {
 				pacURL.Enable()
+				pacProxyType.Enable()
+				pacDirectHosts.Enable()
+				pacProxyHosts.Enable()
 			}
 		},
 	}
 
 	pacEnabled.OnChanged(pacEnabled.Checked)
 
+	httpProxyURL := &widget.Entry{
+		Text:      prefs.String(internal.HTTPProxyListenURI),
+		Validator: ipPortValidator,
+	}
+	httpProxyEnabled := &widget.Check{
+		Checked: prefs.Bool(internal.EnableHTTPProxy),
+		OnChanged: func(b bool) {
+			if !b {
+				httpProxyURL.Disable()
+			} else {
+				httpProxyURL.Enable()
+			}
+		},
+	}
+
+	httpProxyEnabled.OnChanged(httpProxyEnabled.Checked)
+
+	transparentURL := &widget.Entry{
+		Text:      prefs.String(internal.TransparentListenURI),
+		Validator: ipPortValidator,
+	}
+	transparentEnabled := &widget.Check{
+		Checked: prefs.Bool(internal.EnableTransparentProxy),
+		OnChanged: func(b bool) {
+			if !b {
+				transparentURL.Disable()
+			} else {
+				transparentURL.Enable()
+			}
+		},
+	}
+
+	transparentEnabled.OnChanged(transparentEnabled.Checked)
+
+	upstreamProxy := &widget.Entry{
+		Text:        prefs.String(internal.UpstreamProxy),
+		PlaceHolder: "http://proxy:3128",
+		Validator:   upstreamProxyValidator,
+	}
+	upstreamUsername := &widget.Entry{
+		Text: prefs.String(internal.UpstreamProxyUsername),
+	}
+	upstreamPassword := widget.NewPasswordEntry()
+	upstreamPassword.SetText(prefs.String(internal.UpstreamProxyPassword))
+	upstreamBypass := widget.NewMultiLineEntry()
+	upstreamBypass.SetPlaceHolder("example.com\n10.0.0.0/8")
+	upstreamBypass.SetText(strings.Join(prefs.StringList(internal.UpstreamProxyBypass), "\n"))
+
+	upstreamCAFile := &widget.Entry{
+		Text:      prefs.String(internal.UpstreamCAFile),
+		Validator: dirValidator,
+	}
+	upstreamCAFile.ActionItem = widget.NewButton(lang.L("Choose"), func() {
+		dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil {
+				util.ReportUIErrorWithMessage("Error opening CA bundle", err, w)
+				return
+			}
+			if reader == nil {
+				return
+			}
+			reader.Close() //nolint:errcheck
+
+			upstreamCAFile.SetText(reader.URI().Path())
+		}, w)
+	})
+	refuseUnverified := widget.NewMultiLineEntry()
+	refuseUnverified.SetPlaceHolder("example.com\n*")
+	refuseUnverified.SetText(strings.Join(prefs.StringList(internal.RefuseUnverifiedHosts), "\n"))
+	verifyUpstream := &widget.Check{
+		Checked: prefs.Bool(internal.VerifyUpstreamCerts),
+		OnChanged: func(b bool) {
+			if !b {
+				upstreamCAFile.Disable()
+				refuseUnverified.Disable()
+			} else {
+				upstreamCAFile.Enable()
+				refuseUnverified.Enable()
+			}
+		},
+	}
+
+	verifyUpstream.OnChanged(verifyUpstream.Checked)
+
+	tlsInterceptHosts := widget.NewMultiLineEntry()
+	tlsInterceptHosts.SetPlaceHolder(lang.L("Every host"))
+	tlsInterceptHosts.SetText(strings.Join(prefs.StringList(internal.TLSInterceptHosts), "\n"))
+	tlsPassthroughHosts := widget.NewMultiLineEntry()
+	tlsPassthroughHosts.SetPlaceHolder("bank.example.com\n10.0.0.0/8")
+	tlsPassthroughHosts.SetText(strings.Join(prefs.StringList(internal.TLSPassthroughHosts), "\n"))
+	tlsPinnedFailureThreshold := &widget.Entry{
+		Text:      strconv.Itoa(prefs.IntWithFallback(internal.TLSPinnedFailureThreshold, internal.DefaultTLSPinnedFailureThreshold)),
+		Validator: countValidator,
+	}
+
+	keyLogFile := &widget.Entry{
+		Text:        prefs.String(internal.KeyLogFile),
+		PlaceHolder: lang.L("Disabled"),
+	}
+	keyLogFile.ActionItem = widget.NewButton(lang.L("Choose"), func() {
+		dialog.ShowFileSave(func(writer fyne.URIWriteCloser, err error) {
+			if err != nil {
+				util.ReportUIErrorWithMessage("Error choosing key log file", err, w)
+				return
+			}
+			if writer == nil {
+				return
+			}
+			writer.Close() //nolint:errcheck
+
+			keyLogFile.SetText(writer.URI().Path())
+		}, w)
+	})
+
 	configDir := &widget.Entry{
 		Text:      prefs.String(internal.ConfigDir),
 		Validator: dirValidator,
@@ -194,63 +406,82 @@ func MakeSettingsUI(w fyne.Window, restart func()) dialog.Dialog {
 		decodingCommands[index] = command
 	}
 
-	table := widget.NewTable(
-		func() (int, int) { return len(decodingLabels), 2 },
-		func() fyne.CanvasObject {
-			entry := widget.NewEntry()
-			entry.Validator = func(s string) error {
-				if strings.Contains(s, ":") {
-					return fmt.Errorf("cannot contain a colon")
-				}
+	table := newPairTable(&decodingLabels, &decodingCommands, lang.L("Label"), lang.L("Command"), excludesValidator(":"), excludesValidator(":"))
 
-				return nil
-			}
-			return entry
-		},
-		func(id widget.TableCellID, co fyne.CanvasObject) {
-			entry := co.(*widget.Entry)
-			if id.Col == 0 {
-				entry.OnChanged = func(s string) {
-					decodingLabels[id.Row] = s
-				}
-				entry.SetText(decodingLabels[id.Row])
-			} else {
-				entry.OnChanged = func(s string) {
-					decodingCommands[id.Row] = s
-				}
-				entry.SetText(decodingCommands[id.Row])
-			}
-		},
-	)
+	credentials := prefs.StringList(internal.SocksCredentials)
 
-	table.HideSeparators = true
-	table.ShowHeaderRow = true
-	table.CreateHeader = func() fyne.CanvasObject {
-		label := widget.NewLabel("")
+	usernames := make([]string, len(credentials))
+	passwords := make([]string, len(credentials))
 
-		label.TextStyle.Bold = true
-		label.Alignment = fyne.TextAlignCenter
-		return label
+	for index, credential := range credentials {
+		usernames[index], passwords[index], _ = strings.Cut(credential, ":")
 	}
 
-	table.UpdateHeader = func(id widget.TableCellID, template fyne.CanvasObject) {
-		if id.Row == -1 {
-			if id.Col == 0 {
-				template.(*widget.Label).SetText(lang.L("Label"))
-			} else {
-				template.(*widget.Label).SetText(lang.L("Command"))
-			}
-		}
+	// Passwords can contain colons, since credentials are split at the first one
+	credentialsTable := newPairTable(&usernames, &passwords, lang.L("Username"), lang.L("Password"), excludesValidator(":"), nil)
+
+	clientCertificates := prefs.StringList(internal.ClientCertificates)
+
+	certHosts := make([]string, len(clientCertificates))
+	certFiles := make([]string, len(clientCertificates))
+
+	for index, clientCertificate := range clientCertificates {
+		certHosts[index], certFiles[index], _ = internal.SplitClientCertificate(clientCertificate)
 	}
 
-	table.Refresh()
+	// Hosts can be ipv6 addresses and files windows paths, so only = separates them
+	clientCertificatesTable := newPairTable(&certHosts, &certFiles, lang.L("Host"), lang.L("Certificate File"), excludesValidator("="), nil)
 
 	form := make([]*widget.FormItem, 0)
 	// TODO: Remove entryLayout? How does this look now?
 	// Keeping it causes issues on some devices
 	form = append(form, widget.NewFormItem(lang.L("Socks5 Proxy URL"), socks5Url))
+	form = append(form, widget.NewFormItem(lang.L("Socks5 Credentials"),
+		container.NewBorder(
+			nil,
+			container.NewHBox(
+				widget.NewButton(lang.L("Add Credential"), func() {
+					usernames = append(usernames, "")
+					passwords = append(passwords, "")
+					credentialsTable.Refresh()
+				}),
+			), nil, nil,
+			NewTableLayout(credentialsTable),
+		),
+	))
+	form = append(form, widget.NewFormItem(lang.L("Enable HTTP proxy"), httpProxyEnabled))
+	form = append(form, widget.NewFormItem(lang.L("HTTP Proxy URL"), httpProxyURL))
+	form = append(form, widget.NewFormItem(lang.L("Enable transparent proxy"), transparentEnabled))
+	form = append(form, widget.NewFormItem(lang.L("Transparent Proxy URL"), transparentURL))
+	form = append(form, widget.NewFormItem(lang.L("Upstream Proxy URL"), upstreamProxy))
+	form = append(form, widget.NewFormItem(lang.L("Upstream Proxy Username"), upstreamUsername))
+	form = append(form, widget.NewFormItem(lang.L("Upstream Proxy Password"), upstreamPassword))
+	form = append(form, widget.NewFormItem(lang.L("Bypass Upstream Proxy For"), upstreamBypass))
+	form = append(form, widget.NewFormItem(lang.L("Intercept TLS For"), tlsInterceptHosts))
+	form = append(form, widget.NewFormItem(lang.L("Don't Intercept TLS For"), tlsPassthroughHosts))
+	form = append(form, widget.NewFormItem(lang.L("Pass Through After Failed Handshakes"), tlsPinnedFailureThreshold))
+	form = append(form, widget.NewFormItem(lang.L("Verify Server Certificates"), verifyUpstream))
+	form = append(form, widget.NewFormItem(lang.L("Extra Trusted CAs"), upstreamCAFile))
+	form = append(form, widget.NewFormItem(lang.L("Refuse Unverified Hosts"), refuseUnverified))
+	form = append(form, widget.NewFormItem(lang.L("Client Certificates"),
+		container.NewBorder(
+			nil,
+			container.NewHBox(
+				widget.NewButton(lang.L("Add Client Certificate"), func() {
+					certHosts = append(certHosts, "")
+					certFiles = append(certFiles, "")
+					clientCertificatesTable.Refresh()
+				}),
+			), nil, nil,
+			NewTableLayout(clientCertificatesTable),
+		),
+	))
+	form = append(form, widget.NewFormItem(lang.L("TLS Key Log File"), keyLogFile))
 	form = append(form, widget.NewFormItem(lang.L("Enable PAC server"), pacEnabled))
 	form = append(form, widget.NewFormItem(lang.L("PAC URL"), pacURL))
+	form = append(form, widget.NewFormItem(lang.L("PAC Proxy Type"), pacProxyType))
+	form = append(form, widget.NewFormItem(lang.L("PAC Direct Hosts"), pacDirectHosts))
+	form = append(form, widget.NewFormItem(lang.L("PAC Proxied Hosts"), pacProxyHosts))
 	form = append(form, widget.NewFormItem(lang.L("GITM Config Directory"), configDir))
 	form = append(form, widget.NewFormItem(lang.L("Theme"), themeEntry))
 	form = append(form, widget.NewFormItem(lang.L("Custom Decodings"),
@@ -277,8 +508,30 @@ func MakeSettingsUI(w fyne.Window, restart func()) dialog.Dialog {
 		func(b bool) {
 			if b {
 				prefs.SetString(internal.SocksListenURI, socks5Url.Text)
+				prefs.SetBool(internal.EnableHTTPProxy, httpProxyEnabled.Checked)
+				prefs.SetString(internal.HTTPProxyListenURI, httpProxyURL.Text)
+				prefs.SetBool(internal.EnableTransparentProxy, transparentEnabled.Checked)
+				prefs.SetString(internal.TransparentListenURI, transparentURL.Text)
+				prefs.SetString(internal.UpstreamProxy, upstreamProxy.Text)
+				prefs.SetString(internal.UpstreamProxyUsername, upstreamUsername.Text)
+				prefs.SetString(internal.UpstreamProxyPassword, upstreamPassword.Text)
+
+				prefs.SetStringList(internal.UpstreamProxyBypass, strings.Fields(upstreamBypass.Text))
+				prefs.SetStringList(internal.TLSInterceptHosts, strings.Fields(tlsInterceptHosts.Text))
+				prefs.SetStringList(internal.TLSPassthroughHosts, strings.Fields(tlsPassthroughHosts.Text))
+				if threshold, err := strconv.Atoi(tlsPinnedFailureThreshold.Text); err == nil {
+					prefs.SetInt(internal.TLSPinnedFailureThreshold, threshold)
+				}
+				prefs.SetBool(internal.VerifyUpstreamCerts, verifyUpstream.Checked)
+				prefs.SetString(internal.UpstreamCAFile, upstreamCAFile.Text)
+				prefs.SetStringList(internal.RefuseUnverifiedHosts, strings.Fields(refuseUnverified.Text))
+				prefs.SetString(internal.KeyLogFile, keyLogFile.Text)
+
 				prefs.SetBool(internal.EnablePACServer, pacEnabled.Checked)
 				prefs.SetString(internal.PACListenURI, pacURL.Text)
+				prefs.SetString(internal.PACProxyType, pacProxyType.Selected)
+				prefs.SetStringList(internal.PACDirectHosts, strings.Fields(pacDirectHosts.Text))
+				prefs.SetStringList(internal.PACProxyHosts, strings.Fields(pacProxyHosts.Text))
 				prefs.SetString(internal.ConfigDir, configDir.Text)
 				if themeEntry.Text == "" {
 					fyne.CurrentApp().Settings().SetTheme(nil)
@@ -300,6 +553,28 @@ func MakeSettingsUI(w fyne.Window, restart func()) dialog.Dialog {
 
 				prefs.SetStringList(internal.CustomDecodings, newCustomDecodings)
 
+				newCredentials := make([]string, 0, len(usernames))
+
+				for index := range usernames {
+					// Leaving the username empty removes the credential
+					if usernames[index] != "" {
+						newCredentials = append(newCredentials, usernames[index]+":"+passwords[index])
+					}
+				}
+
+				prefs.SetStringList(internal.SocksCredentials, newCredentials)
+
+				newClientCertificates := make([]string, 0, len(certHosts))
+
+				for index := range certHosts {
+					// Leaving the host empty removes the client certificate
+					if certHosts[index] != "" {
+						newClientCertificates = append(newClientCertificates, internal.ClientCertificate(certHosts[index], certFiles[index]))
+					}
+				}
+
+				prefs.SetStringList(internal.ClientCertificates, newClientCertificates)
+
 				dialog.ShowConfirm(lang.L("Success!"), lang.L("New settings saved, would you like to restart the servers?"), func(b bool) {
 					if b {
 						restart()
@@ -0,0 +1,51 @@
+package settings
+
+import (
+	"testing"
+)
+
+func TestIPPortValidator(t *testing.T) {
+	valid := []string{"", "127.0.0.1:1080", "0.0.0.0:0", "[::1]:1080", "[2001:db8::1]:65535"}
+	for _, s := range valid {
+		if err := ipPortValidator(s); err != nil {
+			t.Errorf("ipPortValidator(%q) = %v, want nil", s, err)
+		}
+	}
+
+	invalid := []string{"127.0.0.1", "::1:1080", "256.0.0.1:1080", "127.0.0.1:65536", "example.com:80", "[::1]:port"}
+	for _, s := range invalid {
+		if err := ipPortValidator(s); err == nil {
+			t.Errorf("ipPortValidator(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestUpstreamProxyValidator(t *testing.T) {
+	valid := []string{"", "http://proxy:3128", "socks5://10.0.0.1:1080", "socks5://[::1]:1080"}
+	for _, s := range valid {
+		if err := upstreamProxyValidator(s); err != nil {
+			t.Errorf("upstreamProxyValidator(%q) = %v, want nil", s, err)
+		}
+	}
+
+	invalid := []string{"proxy:3128", "https://proxy:3128", "http://proxy", "socks5://:1080"}
+	for _, s := range invalid {
+		if err := upstreamProxyValidator(s); err == nil {
+			t.Errorf("upstreamProxyValidator(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestExcludesValidator(t *testing.T) {
+	validator := excludesValidator("=")
+	valid := []string{"", "::1", "fd00::/8", `C:\certs\client.pem`}
+	for _, s := range valid {
+		if err := validator(s); err != nil {
+			t.Errorf("excludesValidator(=)(%q) = %v, want nil", s, err)
+		}
+	}
+
+	if err := validator("a=b"); err == nil {
+		t.Errorf("excludesValidator(=)(%q) = nil, want error", "a=b")
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime/debug"
 
+	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/storage/repository"
 	"fyne.io/fyne/v2/theme"
@@ -40,7 +42,7 @@ func setupLogging(debugEnabled bool) error {
 	return nil
 }
 
-// setupBackend sets up the socks5 proxy.
+// setupBackend sets up the socks5 proxy, and the http and transparent proxies if they are enabled.
 // Returns a cleanup function for gracefully shutting down the backend
 func setupBackend(conf internal.Config, httpHandler func(packet.Packet)) (func(), error) {
 	socksListener, err := socks5.ListenAndServeSocks5(conf, httpHandler)
@@ -48,6 +50,25 @@ func setupBackend(conf internal.Config, httpHandler func(packet.Packet)) (func()
 		return nil, fmt.Errorf("socks5 proxy: %w", err)
 	}
 
+	var httpProxyListener net.Listener
+	if conf.EnableHTTPProxy {
+		if httpProxyListener, err = socks5.ListenAndServeHTTPProxy(conf, httpHandler); err != nil {
+			_ = socksListener.Close()
+			return nil, fmt.Errorf("http proxy: %w", err)
+		}
+	}
+
+	var transparentListener net.Listener
+	if conf.EnableTransparentProxy {
+		if transparentListener, err = socks5.ListenAndServeTransparent(conf, httpHandler); err != nil {
+			_ = socksListener.Close()
+			if httpProxyListener != nil {
+				_ = httpProxyListener.Close()
+			}
+			return nil, fmt.Errorf("transparent proxy: %w", err)
+		}
+	}
+
 	var server *http.Server
 	if conf.EnablePACServer {
 		server = socks5.SetupPAC(&conf)
@@ -62,8 +83,20 @@ func setupBackend(conf internal.Config, httpHandler func(packet.Packet)) (func()
 		if err := socksListener.Close(); err != nil {
 			slog.Error("Error closing socks listener", "error", err)
 		}
-		if err := server.Close(); err != nil {
-			slog.Error("Error closing pac server", "error", err)
+		if httpProxyListener != nil {
+			if err := httpProxyListener.Close(); err != nil {
+				slog.Error("Error closing http proxy listener", "error", err)
+			}
+		}
+		if transparentListener != nil {
+			if err := transparentListener.Close(); err != nil {
+				slog.Error("Error closing transparent proxy listener", "error", err)
+			}
+		}
+		if server != nil {
+			if err := server.Close(); err != nil {
+				slog.Error("Error closing pac server", "error", err)
+			}
 		}
 	}, nil
 }
@@ -75,12 +108,21 @@ func main() {
 		slog.Error("Error initializing logging", "error", err)
 	}
 
+	if isCommand(os.Args[1:]) {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	packetChan := make(chan packet.Packet)
+	handlePacket := func(p packet.Packet) {
+		// Hosts learned as pinned stay passed through after a restart
+		if failurePacket, ok := p.(*packet.TLSFailurePacket); ok && failurePacket.Passthrough {
+			fyne.Do(func() { internal.AddTLSPassthroughHost(app.Preferences(), failurePacket.Host) })
+		}
+		packetChan <- p
+	}
 
 	slog.Info("Starting backend...")
-	restart, err := setupBackend(conf, func(p packet.Packet) {
-		packetChan <- p
-	})
+	restart, err := setupBackend(conf, handlePacket)
 	if err != nil {
 		w := app.NewWindow("Settings")
 		slog.Error("Error setting up backend", "error", err)
@@ -107,14 +149,13 @@ func main() {
 	mainWindow := ui.MakeMainWindow(packetChan, func() {
 		slog.Info("Restarting backend...")
 		restart()
-		restart, err = setupBackend(internal.FromPreferences(app.Preferences()), func(p packet.Packet) {
-			packetChan <- p
-		})
+		restart, err = setupBackend(internal.FromPreferences(app.Preferences()), handlePacket)
 		if err != nil || restart == nil {
 			slog.Error("Error setting up backend", "error", err)
 			restart = func() {}
 		}
 	})
+	mainWindow.CheckCAExpiry()
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Printf("Crash! Attempting to save data. \nReason: %s\n", r)
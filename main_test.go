@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/redawl/gitm/internal"
@@ -89,3 +90,21 @@ func TestConnectivityThroughProxy(t *testing.T) {
 		return
 	}
 }
+
+func TestIsCommand(t *testing.T) {
+	tests := map[string]bool{
+		"":                    false,
+		"ca status":           true,
+		"certs list":          true,
+		"help":                true,
+		"-h":                  true,
+		"-psn_0_12345":        false,
+		"https://example.com": false,
+	}
+
+	for args, expected := range tests {
+		if actual := isCommand(strings.Fields(args)); actual != expected {
+			t.Errorf("isCommand(%q) = %v, want %v", args, actual, expected)
+		}
+	}
+}